@@ -0,0 +1,311 @@
+// Package audit provides an append-only log of the
+// changes operators make using tutil. Entries are only
+// rewritten to pseudonymize the users who are erased
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrOperatorRequired is returned when auditing a change without an operator
+	ErrOperatorRequired = errors.New("operator is required to make changes, set the operator flag or TUTIL_OPERATOR")
+	// ErrNoAuditLog is returned when auditing a change before the audit log table is created
+	ErrNoAuditLog = errors.New("audit log table does not exist, run migrations up")
+)
+
+// Entry is a record of a change made by an operator. Entries are never
+// deleted, so there is no soft delete, and are only updated by Pseudonymize
+type Entry struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+	Operator  string    `gorm:"type:varchar(255);index"`
+	Command   string    `gorm:"type:varchar(255);index"`
+	// Arguments are the command line arguments, as a json array
+	Arguments string `gorm:"type:text"`
+	// Target is the user, or other resource, the change was made to
+	Target string `gorm:"type:varchar(255);index"`
+	// Before and After are the json encoded values before and after the change
+	Before string `gorm:"type:text"`
+	After  string `gorm:"type:text"`
+}
+
+// TableName sets the table used to store audit entries
+func (Entry) TableName() string {
+	return "audit_log"
+}
+
+// Auditor is used to record the changes made by a single command invocation
+type Auditor struct {
+	db        *gorm.DB
+	operator  string
+	command   string
+	arguments []string
+}
+
+// New instantiates an auditor for a command. It should be created before
+// making any changes, so that changes are refused without an operator,
+// or without an audit log to record them in
+func New(db *gorm.DB, operator, command string, arguments []string) (*Auditor, error) {
+	if err := ValidateOperator(operator); err != nil {
+		return nil, err
+	}
+	if !db.HasTable(&Entry{}) {
+		return nil, ErrNoAuditLog
+	}
+	return &Auditor{
+		db:        db,
+		operator:  operator,
+		command:   command,
+		arguments: arguments,
+	}, nil
+}
+
+// ValidateOperator is used to refuse changes without an operator, for
+// commands which can't create their auditor before making changes, such
+// as the migrations which create the audit log
+func ValidateOperator(operator string) error {
+	if strings.TrimSpace(operator) == "" {
+		return ErrOperatorRequired
+	}
+	return nil
+}
+
+// Record is used to append an entry to the audit log. The before and
+// after values are json encoded, nil values are recorded as null
+func (a *Auditor) Record(target string, before, after interface{}) error {
+	args, err := json.Marshal(a.arguments)
+	if err != nil {
+		return err
+	}
+	beforeJSON, err := json.Marshal(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := json.Marshal(after)
+	if err != nil {
+		return err
+	}
+	return a.db.Create(&Entry{
+		Operator:  a.operator,
+		Command:   a.command,
+		Arguments: string(args),
+		Target:    target,
+		Before:    string(beforeJSON),
+		After:     string(afterJSON),
+	}).Error
+}
+
+// Pseudonymize is used to replace values, such as the username and email
+// address of an erased user, with their replacement in the audit log. Targets
+// and arguments which are a value, or a flag set to a value, are replaced, as
+// are strings and keys of the before and after values which equal a value,
+// such as the usernames listed by a takedown. Values embedded in longer
+// strings, such as a free text reason, are not replaced.
+// The number of entries changed is returned.
+func Pseudonymize(db *gorm.DB, replacements map[string]string) (int, error) {
+	var (
+		targets  []string
+		patterns []string
+		args     []interface{}
+	)
+	for value := range replacements {
+		if value == "" {
+			continue
+		}
+		targets = append(targets, value)
+		// arguments are json encoded, so a value is followed by its closing quote
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return 0, err
+		}
+		patterns = append(patterns, "arguments LIKE ?")
+		args = append(args, "%"+escapeLike(string(encoded[1:])))
+		// before and after values hold the value as a json string
+		patterns = append(patterns, "before LIKE ?", "after LIKE ?")
+		args = append(args, "%"+escapeLike(string(encoded))+"%", "%"+escapeLike(string(encoded))+"%")
+	}
+	if len(targets) == 0 {
+		return 0, nil
+	}
+	var entries []Entry
+	if err := db.Where(
+		"target IN (?) OR "+strings.Join(patterns, " OR "), append([]interface{}{targets}, args...)...,
+	).Find(&entries).Error; err != nil {
+		return 0, err
+	}
+	var changed int
+	for _, entry := range entries {
+		target, ok := replacements[entry.Target]
+		if !ok || entry.Target == "" {
+			target = entry.Target
+		}
+		var arguments []string
+		if err := json.Unmarshal([]byte(entry.Arguments), &arguments); err != nil {
+			return changed, err
+		}
+		arguments = pseudonymizeArguments(arguments, replacements)
+		encoded, err := json.Marshal(arguments)
+		if err != nil {
+			return changed, err
+		}
+		before, err := pseudonymizeJSON(entry.Before, replacements)
+		if err != nil {
+			return changed, err
+		}
+		after, err := pseudonymizeJSON(entry.After, replacements)
+		if err != nil {
+			return changed, err
+		}
+		if target == entry.Target && string(encoded) == entry.Arguments &&
+			before == entry.Before && after == entry.After {
+			continue
+		}
+		if err := db.Model(&entry).UpdateColumns(map[string]interface{}{
+			"target":    target,
+			"arguments": string(encoded),
+			"before":    before,
+			"after":     after,
+		}).Error; err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// Pseudonymize is used to replace values in the arguments
+// recorded by the auditor, in the same way as Pseudonymize
+func (a *Auditor) Pseudonymize(replacements map[string]string) {
+	a.arguments = pseudonymizeArguments(a.arguments, replacements)
+}
+
+// pseudonymizeArguments returns a copy of the arguments, replacing
+// arguments which are a value, or a flag set to a value
+func pseudonymizeArguments(arguments []string, replacements map[string]string) []string {
+	replaced := make([]string, len(arguments))
+	for i, arg := range arguments {
+		replaced[i] = arg
+		if r, ok := replacements[arg]; ok && arg != "" {
+			replaced[i] = r
+		} else if j := strings.Index(arg, "="); j >= 0 {
+			if r, ok := replacements[arg[j+1:]]; ok && arg[j+1:] != "" {
+				replaced[i] = arg[:j+1] + r
+			}
+		}
+	}
+	return replaced
+}
+
+// pseudonymizeJSON returns a json encoded value, replacing strings and object
+// keys which are a value. It is returned unchanged when nothing is replaced,
+// so that the order of keys encoded from structs is kept
+func pseudonymizeJSON(encoded string, replacements map[string]string) (string, error) {
+	if encoded == "" {
+		return encoded, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(encoded))
+	// keep numbers as they were recorded, rather than as floats
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+	value, replaced := pseudonymizeValue(value, replacements)
+	if !replaced {
+		return encoded, nil
+	}
+	out, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// pseudonymizeValue replaces the strings and object keys of a decoded json
+// value which are a value, returning whether anything was replaced
+func pseudonymizeValue(value interface{}, replacements map[string]string) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		if r, ok := replacements[v]; ok && v != "" {
+			return r, true
+		}
+	case []interface{}:
+		var replaced bool
+		for i, elem := range v {
+			var ok bool
+			if v[i], ok = pseudonymizeValue(elem, replacements); ok {
+				replaced = true
+			}
+		}
+		return v, replaced
+	case map[string]interface{}:
+		var replaced bool
+		out := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			elem, ok := pseudonymizeValue(elem, replacements)
+			if r, found := replacements[key]; found && key != "" {
+				key, ok = r, true
+			}
+			if ok {
+				replaced = true
+			}
+			out[key] = elem
+		}
+		return out, replaced
+	}
+	return value, false
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Filter restricts the entries returned by List, zero values match everything
+type Filter struct {
+	Operator string
+	Command  string
+	Target   string
+	Since    time.Time
+	Until    time.Time
+	// Limit is the maximum number of entries, the most recent are returned
+	Limit int
+}
+
+// List is used to query the audit log, returning entries oldest first
+func List(db *gorm.DB, filter Filter) ([]Entry, error) {
+	query := db.Order("id DESC")
+	if filter.Operator != "" {
+		query = query.Where("operator = ?", filter.Operator)
+	}
+	if filter.Command != "" {
+		query = query.Where("command = ?", filter.Command)
+	}
+	if filter.Target != "" {
+		query = query.Where("target = ?", filter.Target)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var entries []Entry
+	if err := query.Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	// reverse so the most recent entries are printed last
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
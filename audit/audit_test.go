@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestOperatorRequired(t *testing.T) {
+	for _, operator := range []string{"", "  "} {
+		if _, err := New(nil, operator, "add-credits", nil); err != ErrOperatorRequired {
+			t.Fatalf("expected operator %q to be refused", operator)
+		}
+	}
+}
+
+func TestPseudonymizeArguments(t *testing.T) {
+	replacements := map[string]string{"alice": "erased", "alice@example.org": "erased@deleteduser.org"}
+	args := []string{"user", "erase", "--user", "alice", "-email=alice@example.org", "--reason=alice", "malice", "--note="}
+	got := pseudonymizeArguments(args, replacements)
+	want := []string{"user", "erase", "--user", "erased", "-email=erased@deleteduser.org", "--reason=erased", "malice", "--note="}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if args[3] != "alice" {
+		t.Fatal("expected arguments not to be changed in place")
+	}
+	if escapeLike(`50%_\`) != `50\%\_\\` {
+		t.Fatalf("bad escaped pattern %s", escapeLike(`50%_\`))
+	}
+}
+
+func TestPseudonymizeJSON(t *testing.T) {
+	replacements := map[string]string{"alice": "erased"}
+	tests := []struct {
+		name    string
+		encoded string
+		want    string
+	}{
+		{"null", "null", "null"},
+		{"unchanged keeps key order", `{"b":1,"a":"malice"}`, `{"b":1,"a":"malice"}`},
+		{"list", `{"removed":["bob","alice"],"size":12345678901234567}`, `{"removed":["bob","erased"],"size":12345678901234567}`},
+		{"key", `{"alice":"failed"}`, `{"erased":"failed"}`},
+		{"nested", `{"user":{"name":"alice"}}`, `{"user":{"name":"erased"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pseudonymizeJSON(tt.encoded, replacements)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAuditor(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Entry{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	auditor, err := New(db, "tester", "add-credits", []string{"add-credits", "--user", "testaudituser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Where("target = ?", "testaudituser").Delete(&Entry{})
+	for _, credits := range []float64{10, 20} {
+		if err := auditor.Record(
+			"testaudituser",
+			map[string]interface{}{"credits": credits - 10},
+			map[string]interface{}{"credits": credits},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := List(db, Filter{Target: "testaudituser", Since: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", len(entries))
+	}
+	if entries[0].After != `{"credits":10}` || entries[1].After != `{"credits":20}` {
+		t.Fatalf("bad entries: %+v", entries)
+	}
+	if entries[0].Operator != "tester" || entries[0].Arguments != `["add-credits","--user","testaudituser"]` {
+		t.Fatalf("bad entry: %+v", entries[0])
+	}
+	// the most recent entries are returned when limited
+	if entries, err := List(db, Filter{Target: "testaudituser", Limit: 1}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].After != `{"credits":20}` {
+		t.Fatalf("bad limited entries: %+v", entries)
+	}
+	if entries, err := List(db, Filter{Target: "testaudituser", Command: "reset"}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatal("expected no entries for other commands")
+	}
+	// users listed in the values of changes to other targets are pseudonymized
+	takedown, err := New(db, "tester", "takedown", []string{"takedown", "--pin.hash", "testaudithash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Where("target = ?", "testaudithash").Delete(&Entry{})
+	if err := takedown.Record("testaudithash", nil, map[string]interface{}{
+		"removed": []string{"testauditother", "testaudituser"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// erased users are pseudonymized
+	defer db.Where("target = ?", "testauditerased").Delete(&Entry{})
+	if changed, err := Pseudonymize(db, map[string]string{"testaudituser": "testauditerased"}); err != nil {
+		t.Fatal(err)
+	} else if changed != 3 {
+		t.Fatalf("expected 3 entries to be pseudonymized, got %v", changed)
+	}
+	if entries, err := List(db, Filter{Target: "testaudithash"}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].After != `{"removed":["testauditother","testauditerased"]}` {
+		t.Fatalf("bad pseudonymized values: %+v", entries)
+	}
+	entries, err = List(db, Filter{Target: "testauditerased"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Arguments != `["add-credits","--user","testauditerased"]` {
+		t.Fatalf("bad pseudonymized entries: %+v", entries)
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
@@ -0,0 +1,211 @@
+// Package bulk provides validation of credit and tier
+// changes for many users at once, read from csv
+package bulk
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/credits"
+	"github.com/RTradeLtd/tutil/tier"
+	"github.com/jinzhu/gorm"
+)
+
+// Row is a single change read from csv in the format username,value,reason[,note]
+// where value is an amount of credits or a tier name
+type Row struct {
+	// Record is the position of the row in the csv file, counting any header
+	Record   int
+	UserName string
+	Value    string
+	Reason   string
+	Note     string
+}
+
+// RowError is a row which failed validation
+type RowError struct {
+	Row Row
+	Err error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("record %v (%s): %s", e.Row.Record, e.Row.UserName, e.Err.Error())
+}
+
+// ReadCSV is used to read rows from csv. A header row
+// starting with username is skipped, as are empty lines
+func ReadCSV(r io.Reader) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var rows []Row
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "username") {
+			continue
+		}
+		if len(record) < 3 || len(record) > 4 {
+			return nil, fmt.Errorf("record %v: expected 3 or 4 fields, got %v", n, len(record))
+		}
+		row := Row{
+			Record:   n,
+			UserName: strings.TrimSpace(record[0]),
+			Value:    strings.TrimSpace(record[1]),
+			Reason:   strings.TrimSpace(record[2]),
+		}
+		if len(record) == 4 {
+			row.Note = strings.TrimSpace(record[3])
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no rows found")
+	}
+	return rows, nil
+}
+
+// ValidateCredits is used to validate every row as a credit adjustment, with
+// the value as the signed amount and the reason as a reason code. Users must
+// exist, and unless force is set, the adjustments to a user must not leave a
+// negative balance. Adjustments are only returned if every row is valid.
+func ValidateCredits(db *gorm.DB, rows []Row, operator string, force bool) ([]credits.Adjustment, []RowError, error) {
+	var (
+		um       = models.NewUserManager(db)
+		adjs     = make([]credits.Adjustment, 0, len(rows))
+		balances = make(map[string]float64)
+		rowErrs  []RowError
+	)
+	for _, row := range rows {
+		amount, err := strconv.ParseFloat(row.Value, 64)
+		if err != nil {
+			rowErrs = append(rowErrs, RowError{row, fmt.Errorf("invalid credits %q", row.Value)})
+			continue
+		}
+		if amount == 0 {
+			rowErrs = append(rowErrs, RowError{row, credits.ErrZeroAmount})
+			continue
+		}
+		if err := credits.ValidateReason(row.Reason); err != nil {
+			rowErrs = append(rowErrs, RowError{row, err})
+			continue
+		}
+		balance, ok := balances[row.UserName]
+		if !ok {
+			balance, err = um.GetCreditsForUser(row.UserName)
+			if err == gorm.ErrRecordNotFound {
+				rowErrs = append(rowErrs, RowError{row, errors.New("user does not exist")})
+				continue
+			} else if err != nil {
+				return nil, nil, err
+			}
+		}
+		balances[row.UserName] = balance + amount
+		if balance+amount < 0 && !force {
+			rowErrs = append(rowErrs, RowError{row, credits.ErrNegativeBalance})
+			continue
+		}
+		adjs = append(adjs, credits.Adjustment{
+			UserName: row.UserName,
+			Amount:   amount,
+			Reason:   row.Reason,
+			Note:     row.Note,
+			Operator: operator,
+			Force:    force,
+		})
+	}
+	if len(rowErrs) > 0 {
+		return nil, rowErrs, nil
+	}
+	return adjs, nil, nil
+}
+
+// ValidateTiers is used to validate every row as a tier change, with the value
+// as the tier name and the reason as free text. Users must have a usage entry,
+// may only appear once, and must be allowed to change to the tier. Requests
+// are only returned if every row is valid.
+func ValidateTiers(db *gorm.DB, rows []Row) ([]tier.Request, []RowError, error) {
+	var (
+		us      = models.NewUsageManager(db)
+		reqs    = make([]tier.Request, 0, len(rows))
+		seen    = make(map[string]bool)
+		rowErrs []RowError
+	)
+	for _, row := range rows {
+		if seen[row.UserName] {
+			rowErrs = append(rowErrs, RowError{row, errors.New("user appears more than once")})
+			continue
+		}
+		seen[row.UserName] = true
+		newTier, err := tier.Parse(row.Value)
+		if err != nil {
+			rowErrs = append(rowErrs, RowError{row, err})
+			continue
+		}
+		if row.Reason == "" {
+			rowErrs = append(rowErrs, RowError{row, tier.ErrReasonRequired})
+			continue
+		}
+		usg, err := us.FindByUserName(row.UserName)
+		if err == gorm.ErrRecordNotFound {
+			rowErrs = append(rowErrs, RowError{row, errors.New("user does not have a usage entry")})
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if err := tier.ValidateTransition(usg.Tier, newTier); err != nil {
+			rowErrs = append(rowErrs, RowError{row, err})
+			continue
+		}
+		reqs = append(reqs, tier.Request{
+			UserName: row.UserName,
+			Tier:     newTier,
+			Reason:   row.Reason,
+		})
+	}
+	if len(rowErrs) > 0 {
+		return nil, rowErrs, nil
+	}
+	return reqs, nil, nil
+}
+
+// CreditSummary returns the total credits adjusted per reason code, sorted by reason
+func CreditSummary(adjs []credits.Adjustment) []string {
+	totals := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, adj := range adjs {
+		totals[adj.Reason] += adj.Amount
+		counts[adj.Reason]++
+	}
+	summary := make([]string, 0, len(totals))
+	for reason, total := range totals {
+		summary = append(summary, fmt.Sprintf("%s: %v adjustments totalling %+g credits", reason, counts[reason], total))
+	}
+	sort.Strings(summary)
+	return summary
+}
+
+// TierSummary returns the number of users changed to each tier, sorted by tier
+func TierSummary(reqs []tier.Request) []string {
+	counts := make(map[models.DataUsageTier]int)
+	for _, req := range reqs {
+		counts[req.Tier]++
+	}
+	summary := make([]string, 0, len(counts))
+	for t, count := range counts {
+		summary = append(summary, fmt.Sprintf("%s: %v users", t, count))
+	}
+	sort.Strings(summary)
+	return summary
+}
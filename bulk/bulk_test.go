@@ -0,0 +1,170 @@
+package bulk
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/credits"
+	"github.com/RTradeLtd/tutil/tier"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestReadCSV(t *testing.T) {
+	rows, err := ReadCSV(strings.NewReader(
+		"username,credits,reason,note\n" +
+			"alice, 10, promo, spring promo\n" +
+			"bob,-2.5,correction\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{Record: 2, UserName: "alice", Value: "10", Reason: "promo", Note: "spring promo"},
+		{Record: 3, UserName: "bob", Value: "-2.5", Reason: "correction"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("expected %v rows, got %v", len(want), len(rows))
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Fatalf("row %v = %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+	for _, input := range []string{"", "username,credits,reason\n", "alice,10\n"} {
+		if _, err := ReadCSV(strings.NewReader(input)); err == nil {
+			t.Fatalf("expected error reading %q", input)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	credit := CreditSummary([]credits.Adjustment{
+		{Amount: 10, Reason: credits.ReasonPromo},
+		{Amount: 5, Reason: credits.ReasonPromo},
+		{Amount: -1, Reason: credits.ReasonCorrection},
+	})
+	if len(credit) != 2 ||
+		credit[0] != "correction: 1 adjustments totalling -1 credits" ||
+		credit[1] != "promo: 2 adjustments totalling +15 credits" {
+		t.Fatalf("bad credit summary: %v", credit)
+	}
+	tiers := TierSummary([]tier.Request{
+		{Tier: models.Paid}, {Tier: models.Partner}, {Tier: models.Paid},
+	})
+	if len(tiers) != 2 || tiers[0] != "paid: 2 users" || tiers[1] != "partner: 1 users" {
+		t.Fatalf("bad tier summary: %v", tiers)
+	}
+}
+
+func TestValidateCredits(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := models.NewUserManager(db).NewUserAccount("testbulkcredits", "password123", "testbulkcredits@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	if err := db.Model(usr).UpdateColumn("credits", 5).Error; err != nil {
+		t.Fatal(err)
+	}
+	valid := []Row{
+		{Record: 1, UserName: usr.UserName, Value: "10", Reason: credits.ReasonPromo},
+		{Record: 2, UserName: usr.UserName, Value: "-12", Reason: credits.ReasonCorrection},
+	}
+	adjs, rowErrs, err := ValidateCredits(db, valid, "tester", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowErrs) != 0 || len(adjs) != 2 {
+		t.Fatalf("expected 2 valid adjustments, got %v and errors %v", adjs, rowErrs)
+	}
+	invalid := []Row{
+		{Record: 1, UserName: usr.UserName, Value: "ten", Reason: credits.ReasonPromo},
+		{Record: 2, UserName: usr.UserName, Value: "0", Reason: credits.ReasonPromo},
+		{Record: 3, UserName: usr.UserName, Value: "1", Reason: "notareason"},
+		{Record: 4, UserName: "testbulkcreditsmissing", Value: "1", Reason: credits.ReasonPromo},
+		// the balance is 5, so this would leave it negative
+		{Record: 5, UserName: usr.UserName, Value: "-6", Reason: credits.ReasonCorrection},
+	}
+	adjs, rowErrs, err = ValidateCredits(db, invalid, "tester", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adjs != nil || len(rowErrs) != len(invalid) {
+		t.Fatalf("expected every row to be invalid, got %v", rowErrs)
+	}
+	if rowErrs[4].Err != credits.ErrNegativeBalance {
+		t.Fatalf("expected ErrNegativeBalance, got %v", rowErrs[4].Err)
+	}
+	// force allows a negative balance
+	if _, rowErrs, err = ValidateCredits(db, invalid[4:], "tester", true); err != nil {
+		t.Fatal(err)
+	} else if len(rowErrs) != 0 {
+		t.Fatalf("expected forced adjustment to be valid, got %v", rowErrs)
+	}
+}
+
+func TestValidateTiers(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := models.NewUserManager(db).NewUserAccount("testbulktiers", "password123", "testbulktiers@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	reqs, rowErrs, err := ValidateTiers(db, []Row{
+		{Record: 1, UserName: usr.UserName, Value: "Paid", Reason: "upgrade"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowErrs) != 0 || len(reqs) != 1 || reqs[0].Tier != models.Paid {
+		t.Fatalf("expected a valid paid tier change, got %v and errors %v", reqs, rowErrs)
+	}
+	invalid := []Row{
+		{Record: 1, UserName: usr.UserName, Value: "gold", Reason: "upgrade"},
+		{Record: 2, UserName: usr.UserName, Value: "paid", Reason: "upgrade"},
+		{Record: 3, UserName: "testbulktiersnousage", Value: "paid", Reason: "upgrade"},
+		{Record: 4, UserName: "testbulktiersnoreason", Value: "paid"},
+	}
+	reqs, rowErrs, err = ValidateTiers(db, invalid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs != nil || len(rowErrs) != len(invalid) {
+		t.Fatalf("expected every row to be invalid, got %v", rowErrs)
+	}
+	// users can never be changed to the unverified tier
+	if _, rowErrs, err = ValidateTiers(db, []Row{
+		{Record: 1, UserName: usr.UserName, Value: "unverified", Reason: "downgrade"},
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(rowErrs) != 1 {
+		t.Fatalf("expected unverified tier change to be invalid, got %v", rowErrs)
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
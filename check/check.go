@@ -0,0 +1,157 @@
+// Package check provides data consistency checks across
+// users, their usage, and their uploads
+package check
+
+import (
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+)
+
+// UsageMismatch is a user whose recorded data usage does
+// not match the total size of their uploads
+type UsageMismatch struct {
+	UserName             string
+	CurrentDataUsedBytes uint64
+	UploadBytes          uint64
+	// UnsizedUploads are the number of uploads without a recorded
+	// size, which are counted as 0 bytes in UploadBytes
+	UnsizedUploads int
+}
+
+// Fixable returns whether the usage can be set to UploadBytes. Usage of users
+// with unsized uploads must be repaired with a usage.Recalculator instead,
+// which retrieves the missing sizes from IPFS.
+func (m UsageMismatch) Fixable() bool {
+	return m.UnsizedUploads == 0
+}
+
+// Report is the outcome of a consistency check
+type Report struct {
+	// UsersWithoutUsage are users with no usage entry
+	UsersWithoutUsage []string
+	// UsageWithoutUser are usage entries whose user does not exist
+	UsageWithoutUser []string
+	// OrphanedUploads are uploads whose user does not exist, for
+	// example those left over from a partial user deletion
+	OrphanedUploads []models.Upload
+	// UsageMismatches are users whose data usage does not match their uploads
+	UsageMismatches []UsageMismatch
+}
+
+// Consistent returns whether the check found no problems
+func (r *Report) Consistent() bool {
+	return len(r.UsersWithoutUsage) == 0 &&
+		len(r.UsageWithoutUser) == 0 &&
+		len(r.OrphanedUploads) == 0 &&
+		len(r.UsageMismatches) == 0
+}
+
+// Checker is used to check, and fix, data consistency
+type Checker struct {
+	db *gorm.DB
+}
+
+// NewChecker instantiates the consistency checker
+func NewChecker(db *gorm.DB) *Checker {
+	return &Checker{db: db}
+}
+
+// Check is used to find inconsistencies between users, usage and uploads
+func (c *Checker) Check() (*Report, error) {
+	report := &Report{}
+	if err := c.db.Table("users").Joins(
+		"LEFT JOIN usages ON usages.user_name = users.user_name AND usages.deleted_at IS NULL",
+	).Where(
+		"users.deleted_at IS NULL AND usages.id IS NULL",
+	).Order("users.user_name").Pluck("users.user_name", &report.UsersWithoutUsage).Error; err != nil {
+		return nil, err
+	}
+	if err := c.db.Table("usages").Joins(
+		"LEFT JOIN users ON users.user_name = usages.user_name AND users.deleted_at IS NULL",
+	).Where(
+		"usages.deleted_at IS NULL AND users.id IS NULL",
+	).Order("usages.user_name").Pluck("usages.user_name", &report.UsageWithoutUser).Error; err != nil {
+		return nil, err
+	}
+	if err := c.db.Joins(
+		"LEFT JOIN users ON users.user_name = uploads.user_name AND users.deleted_at IS NULL",
+	).Where(
+		"users.id IS NULL",
+	).Order("uploads.id").Find(&report.OrphanedUploads).Error; err != nil {
+		return nil, err
+	}
+	if err := c.db.Table("usages").Select(
+		"usages.user_name, usages.current_data_used_bytes, COALESCE(SUM(uploads.size), 0) AS upload_bytes, " +
+			"SUM(CASE WHEN uploads.id IS NOT NULL AND COALESCE(uploads.size, 0) <= 0 THEN 1 ELSE 0 END) AS unsized_uploads",
+	).Joins(
+		"LEFT JOIN uploads ON uploads.user_name = usages.user_name AND uploads.deleted_at IS NULL",
+	).Where(
+		"usages.deleted_at IS NULL",
+	).Group(
+		"usages.user_name, usages.current_data_used_bytes",
+	).Having(
+		"usages.current_data_used_bytes <> COALESCE(SUM(uploads.size), 0)",
+	).Order("usages.user_name").Scan(&report.UsageMismatches).Error; err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Fix is used to repair the inconsistencies found by a check, in a single transaction:
+//
+//   - users without usage receive a usage entry in the free tier, or
+//     the unverified tier if their email is not verified
+//   - usage entries without a user are removed
+//   - orphaned uploads are removed, leaving their content to be
+//     collected as orphaned pins
+//   - data usage is set to the total size of the user's uploads, unless
+//     any of their uploads has no recorded size
+func (c *Checker) Fix(report *Report) error {
+	tx := c.db.Begin()
+	if err := fix(tx, report); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func fix(tx *gorm.DB, report *Report) error {
+	var (
+		um = models.NewUserManager(tx)
+		us = models.NewUsageManager(tx)
+	)
+	for _, username := range report.UsersWithoutUsage {
+		user, err := um.FindByUserName(username)
+		if err != nil {
+			return err
+		}
+		tier := models.Free
+		if !user.EmailEnabled {
+			tier = models.Unverified
+		}
+		if _, err := us.NewUsageEntry(username, tier); err != nil {
+			return err
+		}
+	}
+	for _, username := range report.UsageWithoutUser {
+		if err := tx.Where("user_name = ?", username).Delete(&models.Usage{}).Error; err != nil {
+			return err
+		}
+	}
+	for _, upload := range report.OrphanedUploads {
+		if err := tx.Delete(&upload).Error; err != nil {
+			return err
+		}
+	}
+	for _, mismatch := range report.UsageMismatches {
+		if !mismatch.Fixable() {
+			continue
+		}
+		if err := tx.Model(&models.Usage{}).Where(
+			"user_name = ?", mismatch.UserName,
+		).UpdateColumn("current_data_used_bytes", mismatch.UploadBytes).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
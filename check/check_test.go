@@ -0,0 +1,114 @@
+package check
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestConsistent(t *testing.T) {
+	if !(&Report{}).Consistent() {
+		t.Fatal("expected empty report to be consistent")
+	}
+	if (&Report{UsageWithoutUser: []string{"user"}}).Consistent() {
+		t.Fatal("expected report with problems to be inconsistent")
+	}
+	if (UsageMismatch{UnsizedUploads: 1}).Fixable() {
+		t.Fatal("expected usage of users with unsized uploads to not be fixable")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		um = models.NewUserManager(db)
+		us = models.NewUsageManager(db)
+		up = models.NewUploadManager(db)
+	)
+	// user with mismatched usage
+	usr, err := um.NewUserAccount("testcheckuser", "password123", "testcheckuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	if upload, err := up.NewUpload("testhash1", "file", models.UploadOptions{
+		Username: usr.UserName, NetworkName: "public", HoldTimeInMonths: 1, Size: 100,
+	}); err != nil {
+		t.Fatal(err)
+	} else {
+		defer db.Unscoped().Delete(upload)
+	}
+	// usage without a user
+	if usg, err := us.NewUsageEntry("testcheckorphan", models.Free); err != nil {
+		t.Fatal(err)
+	} else {
+		defer db.Unscoped().Delete(usg)
+	}
+	// upload without a user
+	if upload, err := up.NewUpload("testhash1", "file", models.UploadOptions{
+		Username: "testcheckorphan", NetworkName: "public", HoldTimeInMonths: 1,
+	}); err != nil {
+		t.Fatal(err)
+	} else {
+		defer db.Unscoped().Delete(upload)
+	}
+	checker := NewChecker(db)
+	report, err := checker.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(report.UsageWithoutUser, "testcheckorphan") {
+		t.Fatal("expected usage without user")
+	}
+	var foundOrphan, foundMismatch bool
+	for _, upload := range report.OrphanedUploads {
+		foundOrphan = foundOrphan || upload.UserName == "testcheckorphan"
+	}
+	for _, m := range report.UsageMismatches {
+		foundMismatch = foundMismatch || (m.UserName == usr.UserName && m.UploadBytes == 100)
+	}
+	if !foundOrphan || !foundMismatch {
+		t.Fatal("expected orphaned upload and usage mismatch")
+	}
+	if err := checker.Fix(report); err != nil {
+		t.Fatal(err)
+	}
+	usg, err := us.FindByUserName(usr.UserName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usg.CurrentDataUsedBytes != 100 {
+		t.Fatal("expected data usage to be repaired")
+	}
+	if _, err := us.FindByUserName("testcheckorphan"); err == nil {
+		t.Fatal("expected usage without user to be removed")
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
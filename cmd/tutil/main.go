@@ -1,20 +1,38 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"html/template"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/RTradeLtd/cmd/v2"
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2"
 	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/audit"
+	"github.com/RTradeLtd/tutil/bulk"
+	"github.com/RTradeLtd/tutil/check"
+	creditledger "github.com/RTradeLtd/tutil/credits"
+	"github.com/RTradeLtd/tutil/mail"
+	"github.com/RTradeLtd/tutil/migrations"
+	"github.com/RTradeLtd/tutil/migrations/checkpoint"
 	useremailmigration "github.com/RTradeLtd/tutil/migrations/user"
 	"github.com/RTradeLtd/tutil/pin"
+	"github.com/RTradeLtd/tutil/suspension"
+	"github.com/RTradeLtd/tutil/takedown"
+	"github.com/RTradeLtd/tutil/tier"
+	"github.com/RTradeLtd/tutil/usage"
 	usermgmt "github.com/RTradeLtd/tutil/user"
 	"github.com/jinzhu/gorm"
 )
@@ -40,16 +58,77 @@ var (
 	recipientName  *string
 	uploadType     *string
 	user           *string
+	emailAddress   *string
+	reason         *string
+	operator       *string
 	// bucket flags
 	bucketLocation *string
 	accountTier    *string
 	credits        *float64
+	note           *string
+	force          *bool
+	creditsEntry   *uint
+	bulkFile       *string
+	refundPolicy   *string
+	network        *string
+	networkAll     *bool
+	networkID      *string
+	pinFile        *string
+	pinOlderThan   *time.Duration
+	pinType        *string
+	pinHash        *string
+	pinMonths      *int
+	pinWaive       *bool
+	reportBy       *string
+	reportFormat   *string
+	takedownRef    *string
+	takedownNotify *bool
+	userExpiring   *int
+	userFormat     *string
+	userFreezeGC   *bool
+	userNotify     *bool
+	schedule       *string
+	deletionFreq   *time.Duration
+	erasureKey     *string
+	erasurePubKey  *string
+	erasureOutFile *string
+	yes            *bool
 	gcOutFile      *string
 
 	notifyDays      *int
+	notifyRedirect  *string
+	notifyOutFile   *string
 	expireFrequency *time.Duration
 
 	pinToRemove *string
+
+	dryRun *bool
+
+	webhookURL *string
+
+	migrationID *string
+	batchSize   *int
+	restart     *bool
+	fix         *bool
+	all         *bool
+
+	broadcastTemplate     *string
+	broadcastSubject      *string
+	broadcastTiers        *string
+	broadcastEmailEnabled *bool
+	broadcastHasUploads   *bool
+	broadcastMinUsage     *uint64
+	broadcastMax          *int
+
+	orphansUnpin *bool
+	orphansRepin *bool
+	orphansGrace *time.Duration
+
+	auditOperator *string
+	auditCommand  *string
+	auditTarget   *string
+	auditSince    *time.Duration
+	auditLimit    *int
 )
 
 func baseFlagSet() *flag.FlagSet {
@@ -74,16 +153,25 @@ func baseFlagSet() *flag.FlagSet {
 	// email flags
 	sendEmail = f.Bool("email-enabled", false,
 		"used to activate email notification")
-	emailRecipient = f.String("email-recipient", "alext@rtradetechnologies.com",
-		"email to send metrics to")
+	emailRecipient = f.String("email-recipient", "",
+		"deprecated alias of notify.redirect")
 	recipientName = f.String("recipient-name", "",
 		"email recipient name")
 
 	user = f.String("user", "", "user to operate commands against")
+	emailAddress = f.String("email", "", "email address to operate commands against")
+	reason = f.String("reason", "", "reason for the operation being performed")
+	operator = f.String("operator", defaultOperator(),
+		"name of the person performing the operation, defaults to $TUTIL_OPERATOR or $USER")
 
-	accountTier = f.String("account.tier", "", "accoutn tier to apply")
+	accountTier = f.String("account.tier", "", "account tier to apply")
 
-	credits = f.Float64("credits", 0, "the amount of credits to add")
+	credits = f.Float64("credits", 0, "the amount of credits to add, negative amounts remove credits")
+	note = f.String("note", "", "free text note describing the operation being performed")
+	force = f.Bool("force", false, "allow credit adjustments to result in a negative balance")
+	bulkFile = f.String("bulk.file", "",
+		"csv file of changes to apply to many users, in the format username,value,reason[,note]")
+	creditsEntry = f.Uint("credits.entry", 0, "id of the credit ledger entry to operate commands against")
 
 	gcOutFile = f.String("gc.out.file", fmt.Sprintf(
 		"collected_garbage-%v.txt", time.Now().UnixNano()),
@@ -91,10 +179,409 @@ func baseFlagSet() *flag.FlagSet {
 	)
 	expireFrequency = flag.Duration("pin.expire.frequency", time.Hour, "enables controlling the frequency of pin expiration")
 	notifyDays = f.Int("notify.days", 7, "the number of days before we will warn about an expired pin")
+	notifyRedirect = f.String("notify.redirect", "", "email address to send every reminder to instead of the user")
+	notifyOutFile = f.String("notify.out.file", "", "file to write reminders to when using dry-run, defaults to stdout")
 	pinToRemove = f.String("pin.to.remove", "", "the pin we want to remove")
+	network = f.String("network", pin.PublicNetwork, "name of the ipfs network to operate pin commands against")
+	networkAll = f.Bool("network.all", false, "operate pin commands against every network instead of the network flag")
+	networkID = f.String("network.identity", "tutil",
+		"service account private networks are accessed as through the nexus delegator, it must be a user of the network")
+	pinFile = f.String("pin.file", "", "file of hashes to operate pin commands against, one per line")
+	pinOlderThan = f.Duration("pin.older.than", 0, "only operate pin commands against pins created more than this long ago")
+	pinType = f.String("pin.type", "", "only operate pin commands against pins of this upload type")
+	pinHash = f.String("pin.hash", "", "hash of the pin to operate pin commands against")
+	pinMonths = f.Int("pin.months", 0, "number of months to extend pins by")
+	pinWaive = f.Bool("pin.waive", false, "extend pins without charging credits, regardless of account tier")
+	reportBy = f.String("report.by", "tier,type,network",
+		"comma separated list of dimensions to group the pin report by, from "+strings.Join(pin.ReportDimensions, ", "))
+	reportFormat = f.String("report.format", "table",
+		"format of the pin report, one of "+strings.Join(pin.ReportFormats, ", "))
+
+	// user flags
+	userExpiring = f.Int("user.expiring.days", 30, "show uploads of a user garbage collected within this many days")
+	userFormat = f.String("user.format", "text", "format to show users in, one of "+strings.Join(usermgmt.ProfileFormats, ", "))
+	userFreezeGC = f.Bool("user.freeze.gc", false, "do not garbage collect the pins of a suspended user until they are reactivated")
+	userNotify = f.Bool("user.notify", true, "email users when their account is suspended or reactivated")
+	schedule = f.String("schedule", "30d", "cancellation window before a scheduled user deletion is executed, in days such as 30d or as a duration")
+	deletionFreq = f.Duration("user.deletion.frequency", time.Hour, "frequency at which the deletion service executes due deletions")
+	erasureKey = f.String("erasure.key", "", "file containing the hex encoded ed25519 private key erasure certificates are signed with")
+	erasurePubKey = f.String("erasure.public.key", "", "file containing the hex encoded ed25519 public key erasure certificates are verified with")
+	erasureOutFile = f.String("erasure.out.file", "", "file to write erasure certificates to, defaults to stdout")
+
+	// takedown flags
+	takedownRef = f.String("takedown.reference", "", "reference of the request a takedown is made for, such as a DMCA case number")
+	takedownNotify = f.Bool("takedown.notify", true, "email users whose uploads are removed by a takedown")
+	refundPolicy = f.String("refund.policy", "",
+		"refund to issue when removing pins, one of full, prorated, none. Defaults to prorated, or to none for takedowns")
+	yes = f.Bool("yes", false, "apply changes without asking for confirmation")
+
+	dryRun = f.Bool("dry-run", false, "preview the changes a command would make without applying them")
+
+	webhookURL = f.String("webhook.url", "", "url to post pin expiration reminders to")
+
+	migrationID = f.String("migration.id", "", "id of the migration to operate commands against")
+	batchSize = f.Int("batch.size", useremailmigration.DefaultBatchSize, "number of records to process per batch")
+	restart = f.Bool("restart", false, "ignore saved progress of an interrupted run and start from the beginning")
+	fix = f.Bool("fix", false, "repair any problems found by a check")
+	all = f.Bool("all", false, "operate commands against all users")
+
+	broadcastTemplate = f.String("broadcast.template", "", "path to the html template file to broadcast")
+	broadcastSubject = f.String("broadcast.subject", "", "subject of the broadcast email")
+	broadcastTiers = f.String("broadcast.tiers", "", "comma separated list of account tiers to broadcast to, defaults to all tiers")
+	broadcastEmailEnabled = f.Bool("broadcast.email.enabled", true, "only broadcast to users with email enabled")
+	broadcastHasUploads = f.Bool("broadcast.has.uploads", false, "only broadcast to users with at least one upload")
+	broadcastMinUsage = f.Uint64("broadcast.min.usage", 0, "only broadcast to users using at least this many bytes")
+	broadcastMax = f.Int("broadcast.max", 500, "maximum number of deliverable recipients, the broadcast is refused if exceeded")
+
+	orphansUnpin = f.Bool("orphans.unpin", false, "unpin content on the node which no upload references")
+	orphansRepin = f.Bool("orphans.repin", false, "pin the content of uploads which is missing from the node")
+	orphansGrace = f.Duration("orphans.grace", 24*time.Hour,
+		"only unpin content which has been unreferenced for this long, as content is pinned before its upload is recorded")
+
+	auditOperator = f.String("audit.operator", "", "only list audit entries made by this operator")
+	auditCommand = f.String("audit.command", "", "only list audit entries made by this command")
+	auditTarget = f.String("audit.target", "", "only list audit entries made to this target, defaults to the user flag")
+	auditSince = f.Duration("audit.since", 0, "only list audit entries made within this duration")
+	auditLimit = f.Int("audit.limit", 100, "maximum number of audit entries to list, the most recent are listed")
 	return f
 }
 
+// newPinUtil returns the pin utilities, accessing private
+// networks as the service identity
+func newPinUtil(db *gorm.DB, cfg *config.TemporalConfig) (*pin.Util, error) {
+	pinUtil, err := pin.NewPinUtil(db, cfg)
+	if err != nil {
+		return nil, err
+	}
+	pinUtil.Identity = *networkID
+	return pinUtil, nil
+}
+
+// uploadIDs returns the IDs of uploads, recorded in the
+// audit log instead of their owners
+func uploadIDs(uploads []models.Upload) []uint {
+	ids := make([]uint, len(uploads))
+	for i, upload := range uploads {
+		ids[i] = upload.ID
+	}
+	return ids
+}
+
+// deletionTarget returns the audit target of a user deletion, which
+// is its deletion request as the username is removed once executed
+func deletionTarget(id uint) string {
+	return fmt.Sprintf("deletion-request/%v", id)
+}
+
+// recordDeletions is used to record every executed deletion in the audit log
+func recordDeletions(auditor *audit.Auditor, result *usermgmt.DeletionResult) {
+	for _, id := range result.Completed {
+		record(auditor, deletionTarget(id), map[string]interface{}{"completed": false}, map[string]interface{}{"completed": true})
+	}
+}
+
+// notifyRedirectAddress returns the address to send every reminder to,
+// honoring the deprecated email-recipient flag
+func notifyRedirectAddress() string {
+	if *notifyRedirect != "" {
+		return *notifyRedirect
+	}
+	return *emailRecipient
+}
+
+// erasureSigningKey returns the private key erasure certificates are signed with
+func erasureSigningKey() ed25519.PrivateKey {
+	key, err := usermgmt.ParseErasureKey(readKeyFile("erasure.key", *erasureKey))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// erasureVerifyKey returns the public key erasure certificates are verified with
+func erasureVerifyKey() ed25519.PublicKey {
+	key, err := usermgmt.ParseErasurePublicKey(readKeyFile("erasure.public.key", *erasurePubKey))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// readKeyFile returns the contents of the key file set by a flag
+func readKeyFile(name, path string) string {
+	if path == "" {
+		log.Fatalf("%s flag not specified", name)
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(key)
+}
+
+// defaultOperator returns the operator recorded for changes when none is specified
+func defaultOperator() string {
+	if name := os.Getenv("TUTIL_OPERATOR"); name != "" {
+		return name
+	}
+	return os.Getenv("USER")
+}
+
+// newAuditor is used to record the changes made by a command in the audit
+// log. Commands are refused without an operator before any change is made
+func newAuditor(db *gorm.DB, command string) *audit.Auditor {
+	auditor, err := audit.New(db, *operator, command, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	return auditor
+}
+
+// newMigrationAuditor is used to record the migrations a command applied or
+// reverted. It is created after the migrations ran, as the audit log is itself
+// created by a migration, and is nil if the audit log does not exist yet
+func newMigrationAuditor(db *gorm.DB, command string) *audit.Auditor {
+	auditor, err := audit.New(db, *operator, command, os.Args[1:])
+	if err == audit.ErrNoAuditLog {
+		log.Println("audit log table does not exist yet, migrations are not recorded in it")
+		return nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return auditor
+}
+
+// recordMigration is used to record a migration being applied or
+// reverted, unless the audit log does not exist yet
+func recordMigration(auditor *audit.Auditor, id string, before, after bool) {
+	if auditor == nil {
+		return
+	}
+	record(auditor, id, map[string]interface{}{"applied": before}, map[string]interface{}{"applied": after})
+}
+
+// record is used to append a change that was made to the audit log
+func record(auditor *audit.Auditor, target string, before, after interface{}) {
+	if err := auditor.Record(target, before, after); err != nil {
+		log.Fatalf("change was made but failed to record audit entry: %s", err)
+	}
+}
+
+// parseRefundPolicy returns the refund policy of the refund.policy
+// flag, or the default policy of the command if it is not set
+func parseRefundPolicy(def pin.RefundPolicy) (pin.RefundPolicy, error) {
+	if *refundPolicy == "" {
+		return def, nil
+	}
+	return pin.ParseRefundPolicy(*refundPolicy)
+}
+
+// pinNetwork returns the network to operate pin commands against, which is
+// every network if the network.all flag is set
+func pinNetwork() string {
+	if *networkAll {
+		return ""
+	}
+	return *network
+}
+
+// notifySuspension is used to email a user about a change to their suspension.
+// The change has already been made, so failures are only logged
+func notifySuspension(cfg *config.TemporalConfig, db *gorm.DB, s *suspension.Suspension, subject string) {
+	mm, err := mail.NewManager(cfg, db)
+	if err != nil {
+		log.Printf("failed to notify %s: %s", s.UserName, err)
+		return
+	}
+	usr, err := models.NewUserManager(db).FindByUserName(s.UserName)
+	if err != nil {
+		log.Printf("failed to notify %s: %s", s.UserName, err)
+		return
+	}
+	if _, err := mm.Send(mail.NewMessage(subject, suspension.Notice(s)), usr.UserName, usr.EmailAddress); err != nil {
+		log.Printf("failed to notify %s: %s", s.UserName, err)
+		return
+	}
+	log.Printf("notified %s", s.UserName)
+}
+
+// confirm is used to ask the operator to confirm a change, unless the yes flag is set
+func confirm(question string) bool {
+	if *yes {
+		return true
+	}
+	fmt.Printf("%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// accountState returns the billing state of a user for the audit log
+func accountState(db *gorm.DB, username string) (map[string]interface{}, error) {
+	credits, err := models.NewUserManager(db).GetCreditsForUser(username)
+	if err != nil {
+		return nil, err
+	}
+	usg, err := models.NewUsageManager(db).FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"credits":                 credits,
+		"tier":                    usg.Tier,
+		"current_data_used_bytes": usg.CurrentDataUsedBytes,
+	}, nil
+}
+
+// webhookState returns the webhook registered for a user for the audit log
+func webhookState(pinUtil *pin.Util, username string) (map[string]interface{}, error) {
+	hooks, err := pinUtil.Webhooks()
+	if err != nil {
+		return nil, err
+	}
+	hook, ok := hooks[username]
+	if !ok {
+		return nil, nil
+	}
+	return map[string]interface{}{"url": hook.URL}, nil
+}
+
+// recordCreditEntry is used to record a credit ledger entry in the audit log
+func recordCreditEntry(auditor *audit.Auditor, entry *creditledger.Entry) {
+	record(auditor, entry.UserName,
+		map[string]interface{}{"credits": entry.BalanceBefore},
+		map[string]interface{}{"credits": entry.BalanceAfter, "ledger_entry": entry.ID},
+	)
+}
+
+// setTier is used to change the tier of the user specified
+// by the user flag, recording the operator and reason
+func setTier(cfg *config.TemporalConfig, command, name string) {
+	if *bulkFile != "" {
+		setTiers(cfg, command)
+		return
+	}
+	if *user == "" {
+		log.Fatal("user flag not specified")
+	}
+	newTier, err := tier.Parse(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := newDB(cfg, *dbNoSSL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auditor := newAuditor(db, command)
+	change, err := tier.NewManager(db).Set(*user, newTier, *operator, *reason)
+	if err != nil {
+		log.Fatal(err)
+	}
+	record(auditor, change.UserName,
+		map[string]interface{}{"tier": change.FromTier},
+		map[string]interface{}{"tier": change.ToTier, "reason": change.Reason},
+	)
+	log.Printf("changed tier of %s from %s to %s", change.UserName, change.FromTier, change.ToTier)
+}
+
+// readBulkFile is used to read the rows of the bulk file
+func readBulkFile() []bulk.Row {
+	file, err := os.Open(*bulkFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := bulk.ReadCSV(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return rows
+}
+
+// refuseInvalidRows is used to report every invalid row,
+// refusing to make any changes if there are any
+func refuseInvalidRows(rowErrs []bulk.RowError) {
+	if len(rowErrs) == 0 {
+		return
+	}
+	for _, rowErr := range rowErrs {
+		fmt.Printf("invalid\t%s\n", rowErr.Error())
+	}
+	log.Fatalf("%v invalid rows, no changes were made", len(rowErrs))
+}
+
+// setTiers is used to change the tiers of the users in the bulk file
+func setTiers(cfg *config.TemporalConfig, command string) {
+	db, err := newDB(cfg, *dbNoSSL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rows := readBulkFile()
+	reqs, rowErrs, err := bulk.ValidateTiers(db, rows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	refuseInvalidRows(rowErrs)
+	for _, line := range bulk.TierSummary(reqs) {
+		log.Println(line)
+	}
+	if *dryRun {
+		log.Printf("dry run: %v tier changes are valid", len(reqs))
+		return
+	}
+	auditor := newAuditor(db, command)
+	changes, err := tier.NewManager(db).SetAll(reqs, *operator)
+	if err != nil {
+		log.Fatalf("%s, no changes were made", err)
+	}
+	for i, change := range changes {
+		record(auditor, change.UserName,
+			map[string]interface{}{"tier": change.FromTier},
+			map[string]interface{}{"tier": change.ToTier, "reason": change.Reason},
+		)
+		fmt.Printf("ok\trecord %v\t%s\t%s -> %s\n", rows[i].Record, change.UserName, change.FromTier, change.ToTier)
+	}
+	log.Printf("changed the tier of %v users", len(changes))
+}
+
+// adjustCredits is used to adjust the credits of the users in the bulk file
+func adjustCredits(cfg *config.TemporalConfig, command string) {
+	db, err := newDB(cfg, *dbNoSSL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rows := readBulkFile()
+	adjs, rowErrs, err := bulk.ValidateCredits(db, rows, *operator, *force)
+	if err != nil {
+		log.Fatal(err)
+	}
+	refuseInvalidRows(rowErrs)
+	for _, line := range bulk.CreditSummary(adjs) {
+		log.Println(line)
+	}
+	if *dryRun {
+		log.Printf("dry run: %v credit adjustments are valid", len(adjs))
+		return
+	}
+	auditor := newAuditor(db, command)
+	entries, err := creditledger.NewLedger(db).AdjustAll(adjs)
+	if err != nil {
+		log.Fatalf("%s, no changes were made", err)
+	}
+	for i, entry := range entries {
+		recordCreditEntry(auditor, entry)
+		fmt.Printf(
+			"ok\trecord %v\t%s\t%+g\t%v -> %v\tentry %v\n",
+			rows[i].Record, entry.UserName, entry.Amount, entry.BalanceBefore, entry.BalanceAfter, entry.ID,
+		)
+	}
+	log.Printf("made %v credit adjustments", len(entries))
+}
+
 func newDB(cfg *config.TemporalConfig, noSSL bool) (*gorm.DB, error) {
 	dbm, err := database.New(cfg, database.Options{
 		SSLModeDisable: noSSL,
@@ -105,6 +592,22 @@ func newDB(cfg *config.TemporalConfig, noSSL bool) (*gorm.DB, error) {
 	return dbm.DB, nil
 }
 
+func newMigrator(cfg *config.TemporalConfig) (*migrations.Migrator, error) {
+	db, err := newDB(cfg, *dbNoSSL)
+	if err != nil {
+		return nil, err
+	}
+	return migrations.New(db, migrations.All)
+}
+
+func newMailManager(cfg *config.TemporalConfig) (*mail.Manager, error) {
+	db, err := newDB(cfg, *dbNoSSL)
+	if err != nil {
+		return nil, err
+	}
+	return mail.NewManager(cfg, db)
+}
+
 var commands = map[string]cmd.Cmd{
 	"delete-user-data": {
 		Blurb: "delete user data for gdpr compliance",
@@ -113,79 +616,926 @@ var commands = map[string]cmd.Cmd{
 			if err != nil {
 				log.Fatal(err)
 			}
+			auditor := newAuditor(db, "delete-user-data")
 			manager := usermgmt.NewUserManager(db)
+			uploads, err := manager.GetUploads(*user)
+			if err != nil {
+				log.Fatal(err)
+			}
 			if err := manager.Delete(*user); err != nil {
 				log.Fatal(err)
 			}
+			// personal data is deliberately not recorded
+			record(auditor, "", map[string]interface{}{"uploads": len(uploads)}, nil)
 		},
 	},
 	"migrations": {
-		Blurb:         "manage complex database migrations",
+		Blurb:         "manage versioned database migrations",
+		Description:   "manage versioned database migrations, applied migrations are recorded in the tutil_migrations table. Migrations run by hand before they were tracked, such as the apr 17 user verification, are recorded as applied when the table is created",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"list": {
+				Blurb: "list all migrations",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					for _, mig := range migrations.All {
+						fmt.Printf("%s\t%s\n", mig.ID, mig.Description)
+					}
+				},
+			},
+			"status": {
+				Blurb: "show which migrations have been applied",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					migrator, err := newMigrator(&cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					statuses, err := migrator.Status()
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, st := range statuses {
+						if st.Applied {
+							fmt.Printf("%s\tapplied %s\n", st.ID, st.AppliedAt.Format(time.RFC3339))
+						} else {
+							fmt.Printf("%s\tpending\n", st.ID)
+						}
+					}
+				},
+			},
+			"up": {
+				Blurb:       "apply pending migrations",
+				Description: "apply all pending migrations, or those up to and including migration.id",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if err := audit.ValidateOperator(*operator); err != nil {
+						log.Fatal(err)
+					}
+					migrator, err := migrations.New(db, migrations.All)
+					if err != nil {
+						log.Fatal(err)
+					}
+					ran, err := migrator.Up(*migrationID)
+					auditor := newMigrationAuditor(db, "migrations up")
+					for _, id := range ran {
+						log.Printf("applied migration %s", id)
+						recordMigration(auditor, id, false, true)
+					}
+					if err != nil {
+						log.Fatal(err)
+					}
+					if len(ran) == 0 {
+						log.Println("no pending migrations")
+					}
+				},
+			},
+			"down": {
+				Blurb:       "revert the latest applied migration",
+				Description: "revert the latest applied migration. If migration.id is set, it must be the latest applied migration",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if err := audit.ValidateOperator(*operator); err != nil {
+						log.Fatal(err)
+					}
+					migrator, err := migrations.New(db, migrations.All)
+					if err != nil {
+						log.Fatal(err)
+					}
+					id, err := migrator.Down(*migrationID)
+					if err != nil {
+						log.Fatal(err)
+					}
+					recordMigration(newMigrationAuditor(db, "migrations down"), id, true, false)
+					log.Printf("reverted migration %s", id)
+				},
+			},
+			"mark": {
+				Blurb:       "record a migration as applied without running it",
+				Description: "record migration.id as applied without running it, for migrations which were applied before being tracked",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *migrationID == "" {
+						log.Fatal("migration.id flag is empty")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if err := audit.ValidateOperator(*operator); err != nil {
+						log.Fatal(err)
+					}
+					migrator, err := migrations.New(db, migrations.All)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if err := migrator.Mark(*migrationID); err != nil {
+						log.Fatal(err)
+					}
+					recordMigration(newMigrationAuditor(db, "migrations mark"), *migrationID, false, true)
+					log.Printf("marked migration %s as applied", *migrationID)
+				},
+			},
+		},
+	},
+	"audit": {
+		Blurb:         "query the operator audit log",
+		Description:   "every command that makes changes records the operator, command, arguments, target and the values before and after the change",
 		ChildRequired: true,
 		Children: map[string]cmd.Cmd{
-			"unverified-user-migration": {
-				Blurb: "verify all unverified user accounts for apr 17 migration",
+			"list": {
+				Blurb:       "list audit entries",
+				Description: "list audit entries, oldest first, optionally filtered by audit.operator, audit.command, audit.target and audit.since",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					filter := audit.Filter{
+						Operator: *auditOperator,
+						Command:  *auditCommand,
+						Target:   *auditTarget,
+						Limit:    *auditLimit,
+					}
+					if filter.Target == "" {
+						filter.Target = *user
+					}
+					if *auditSince > 0 {
+						filter.Since = time.Now().Add(-*auditSince)
+					}
+					entries, err := audit.List(db, filter)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, entry := range entries {
+						fmt.Printf(
+							"%s\t%s\t%s\t%s\tbefore %s\tafter %s\targs %s\n",
+							entry.CreatedAt.UTC().Format(time.RFC3339), entry.Operator, entry.Command,
+							entry.Target, entry.Before, entry.After, entry.Arguments,
+						)
+					}
+				},
+			},
+		},
+	},
+	"check": {
+		Blurb:         "check data consistency",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"consistency": {
+				Blurb:       "cross-validate users, usage and uploads",
+				Description: "finds users without usage, usage without users, uploads owned by nonexistent users, and data usage that does not match the total size of a user's uploads. Use fix to repair them",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					checker := check.NewChecker(db)
+					report, err := checker.Check()
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, name := range report.UsersWithoutUsage {
+						fmt.Printf("user without usage\t%s\n", name)
+					}
+					for _, name := range report.UsageWithoutUser {
+						fmt.Printf("usage without user\t%s\n", name)
+					}
+					for _, upload := range report.OrphanedUploads {
+						fmt.Printf("orphaned upload\t%v\t%s\t%s\n", upload.ID, upload.UserName, upload.Hash)
+					}
+					for _, m := range report.UsageMismatches {
+						fmt.Printf(
+							"usage mismatch\t%s\trecorded %v\tuploads %v\n",
+							m.UserName, m.CurrentDataUsedBytes, m.UploadBytes,
+						)
+						if !m.Fixable() {
+							fmt.Printf(
+								"\t%v uploads without a size, fix will not repair usage, use usage recalculate instead\n",
+								m.UnsizedUploads,
+							)
+						}
+					}
+					if report.Consistent() {
+						log.Println("no inconsistencies found")
+						return
+					}
+					if !*fix {
+						log.Fatal("inconsistencies found, run with fix to repair them")
+					}
+					auditor := newAuditor(db, "check consistency")
+					if err := checker.Fix(report); err != nil {
+						log.Fatal(err)
+					}
+					record(auditor, "", report, nil)
+					log.Println("inconsistencies repaired")
+				},
+			},
+		},
+	},
+	"usage": {
+		Blurb:         "manage account data usage",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"recalculate": {
+				Blurb:       "recompute data usage from uploads",
+				Description: "re-derive the data usage of a user, or all users, from the size of their uploads, using the IPFS node of their network for uploads without a recorded size. Shows the difference and applies it in a single transaction, unless dry-run is set",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" && !*all {
+						log.Fatal("either user or all flag must be specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					recalc := usage.NewRecalculator(db, pinUtil)
+					var diffs []*usage.Diff
+					if *all {
+						diffs, err = recalc.CalculateAll()
+					} else {
+						var diff *usage.Diff
+						diff, err = recalc.Calculate(*user)
+						diffs = []*usage.Diff{diff}
+					}
+					if err != nil {
+						log.Fatal(err)
+					}
+					var changed int
+					for _, diff := range diffs {
+						if !diff.Changed() {
+							continue
+						}
+						changed++
+						fmt.Printf(
+							"%s\trecorded %v\tcomputed %v\t%s bytes\n",
+							diff.UserName, diff.Recorded, diff.Computed, diff.Delta(),
+						)
+					}
+					if *dryRun {
+						log.Printf("dry run: usage of %v of %v users would change", changed, len(diffs))
+						return
+					}
+					auditor := newAuditor(db, "usage recalculate")
+					if err := recalc.Apply(diffs); err != nil {
+						log.Fatal(err)
+					}
+					for _, diff := range diffs {
+						if diff.Changed() {
+							record(auditor, diff.UserName,
+								map[string]interface{}{"current_data_used_bytes": diff.Recorded},
+								map[string]interface{}{"current_data_used_bytes": diff.Computed},
+							)
+						}
+					}
+					log.Printf("updated usage of %v of %v users", changed, len(diffs))
+				},
+			},
+		},
+	},
+	"user": {
+		Blurb:         "manage user accounts",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"show": {
+				Blurb:       "show a user account",
+				Description: "show the account of user, or of the user with email, without secrets. Includes usage, tier, credits, uploads, and uploads garbage collected within user.expiring.days",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					users := usermgmt.NewUserManager(db)
+					usr, err := users.Lookup(*user, *emailAddress)
+					if err != nil {
+						log.Fatal(err)
+					}
+					profile, err := users.Show(usr, time.Duration(*userExpiring)*24*time.Hour, time.Now().UTC())
+					if err != nil {
+						log.Fatal(err)
+					}
+					if err := profile.Write(os.Stdout, *userFormat); err != nil {
+						log.Fatal(err)
+					}
+				},
+			},
+			"delete": {
+				Blurb:       "schedule the deletion of a user account",
+				Description: "schedule the deletion of user for gdpr compliance once the schedule window has passed, recording the operator and reason. The account is disabled immediately, and the deletion can be cancelled within the window. Due deletions are executed by the user deletions service",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag not specified")
+					}
+					window, err := usermgmt.ParseWindow(*schedule)
+					if err != nil {
+						log.Fatal(err)
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					auditor := newAuditor(db, "user delete")
+					req, err := usermgmt.NewUserManager(db).ScheduleDeletion(*user, *reason, *operator, window, time.Now().UTC())
+					if err != nil {
+						log.Fatal(err)
+					}
+					record(auditor, deletionTarget(req.ID),
+						map[string]interface{}{"account_enabled": req.AccountWasEnabled},
+						map[string]interface{}{"account_enabled": false, "deletion_due_at": req.DueAt},
+					)
+					log.Printf("scheduled %s of %s at %s", deletionTarget(req.ID), *user, req.DueAt.Format(time.RFC3339))
+				},
+			},
+			"erase": {
+				Blurb:       "completely erase a user account",
+				Description: "immediately erase user for gdpr compliance, clearing their personal fields, revoking their credentials, removing their uploads and unpinning content no other user references. Records retained for accounting, and the audit log, have the username replaced. A certificate of everything erased, signed with erasure.key, is written to erasure.out.file, which must not exist yet. Use dry-run to preview the content which would be unpinned and retained",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag not specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					manager := usermgmt.NewUserManager(db)
+					preview, err := manager.PreviewErasure(*user)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, content := range preview.Unpinned {
+						fmt.Printf("unpin\t%s\t%s\n", content.NetworkName, content.Hash)
+					}
+					for _, content := range preview.Retained {
+						fmt.Printf("retain\t%s\t%s\n", content.NetworkName, content.Hash)
+					}
+					if *dryRun {
+						return
+					}
+					key := erasureSigningKey()
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					auditor := newAuditor(db, "user erase")
+					// the certificate is the only record of what was erased, so
+					// its output is opened before anything is erased
+					out := os.Stdout
+					if *erasureOutFile != "" {
+						if out, err = os.OpenFile(*erasureOutFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640); err != nil {
+							log.Fatal(err)
+						}
+						defer out.Close()
+					}
+					// abort removes the unused output file when nothing was erased
+					abort := func(v interface{}) {
+						if out != os.Stdout {
+							out.Close()
+							os.Remove(*erasureOutFile)
+						}
+						log.Fatal(v)
+					}
+					if !confirm(fmt.Sprintf("permanently erase %s and unpin %v pins?", *user, len(preview.Unpinned))) {
+						abort("erasure cancelled")
+					}
+					cert, err := manager.Erase(ctx, *user, usermgmt.ErasureOptions{
+						Operator: *operator,
+						Reason:   *reason,
+						Unpinner: pinUtil,
+						Key:      key,
+					})
+					if err != nil {
+						abort(err)
+					}
+					if err := cert.WriteJSON(out); err != nil {
+						// the erasure can't be undone, so the certificate is not lost
+						log.Printf("failed to write erasure certificate: %s", err)
+						if err := cert.WriteJSON(os.Stdout); err != nil {
+							log.Fatal(err)
+						}
+					}
+					// personal data is deliberately not recorded
+					auditor.Pseudonymize(map[string]string{*user: cert.ReplacementUserName})
+					record(auditor, "", nil, map[string]interface{}{
+						"subject_hmac_sha256":   cert.SubjectHMAC,
+						"replacement_user_name": cert.ReplacementUserName,
+						"unpinned":              len(cert.Unpinned),
+						"unpin_failures":        len(cert.UnpinFailures),
+					})
+					for content, err := range cert.UnpinFailures {
+						log.Printf("failed to unpin %s: %s", content, err)
+					}
+					log.Printf("erased %s", *user)
+				},
+			},
+			"erasure-keygen": {
+				Blurb:       "generate an erasure signing key",
+				Description: "generate an ed25519 keypair to sign erasure certificates with, writing the private key to erasure.key and the public key to erasure.public.key. Existing files are not overwritten",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *erasureKey == "" || *erasurePubKey == "" {
+						log.Fatal("erasure.key and erasure.public.key flags must be specified")
+					}
+					pub, key, err := ed25519.GenerateKey(rand.Reader)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for path, encoded := range map[string]string{
+						*erasureKey:    hex.EncodeToString(key),
+						*erasurePubKey: hex.EncodeToString(pub),
+					} {
+						perm := os.FileMode(0644)
+						if path == *erasureKey {
+							perm = 0600
+						}
+						out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+						if err != nil {
+							log.Fatal(err)
+						}
+						if _, err := fmt.Fprintln(out, encoded); err != nil {
+							log.Fatal(err)
+						}
+						if err := out.Close(); err != nil {
+							log.Fatal(err)
+						}
+					}
+					log.Printf("wrote erasure signing key to %s and public key to %s", *erasureKey, *erasurePubKey)
+				},
+			},
+			"erasure-verify": {
+				Blurb:       "verify an erasure certificate",
+				Description: "verify the erasure certificate in erasure.out.file was signed with the private key of erasure.public.key, and has not been changed since",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *erasureOutFile == "" {
+						log.Fatal("erasure.out.file flag not specified")
+					}
+					data, err := ioutil.ReadFile(*erasureOutFile)
+					if err != nil {
+						log.Fatal(err)
+					}
+					var cert usermgmt.ErasureCertificate
+					if err := json.Unmarshal(data, &cert); err != nil {
+						log.Fatal(err)
+					}
+					if err := cert.Verify(erasureVerifyKey()); err != nil {
+						log.Fatal(err)
+					}
+					fmt.Println(cert.String())
+					log.Println("erasure certificate is valid")
+				},
+			},
+			"deletions": {
+				Blurb:         "manage scheduled user deletions",
+				ChildRequired: true,
+				Children: map[string]cmd.Cmd{
+					"list": {
+						Blurb:       "list pending deletions",
+						Description: "list the pending user deletions, soonest due first",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							reqs, err := usermgmt.NewUserManager(db).PendingDeletions()
+							if err != nil {
+								log.Fatal(err)
+							}
+							for _, req := range reqs {
+								fmt.Printf(
+									"%s\t%s\t%s\t%s\n",
+									req.DueAt.Format(time.RFC3339), req.UserName, req.Operator, req.Reason,
+								)
+							}
+						},
+					},
+					"cancel": {
+						Blurb:       "cancel a pending deletion",
+						Description: "cancel the pending deletion of user within its cancellation window, restoring the account to its state before the deletion was scheduled",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							if *user == "" {
+								log.Fatal("user flag not specified")
+							}
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							auditor := newAuditor(db, "user deletions cancel")
+							req, err := usermgmt.NewUserManager(db).CancelDeletion(*user, *operator, time.Now().UTC())
+							if err != nil {
+								log.Fatal(err)
+							}
+							record(auditor, deletionTarget(req.ID),
+								map[string]interface{}{"account_enabled": false, "deletion_due_at": req.DueAt},
+								map[string]interface{}{"account_enabled": req.AccountWasEnabled},
+							)
+							log.Printf("cancelled %s of %s", deletionTarget(req.ID), *user)
+						},
+					},
+					"run": {
+						Blurb:       "execute due deletions",
+						Description: "delete every user whose deletion is due. Use dry-run to list the due deletions without executing them",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							manager := usermgmt.NewUserManager(db)
+							if *dryRun {
+								reqs, err := manager.DueDeletions(time.Now().UTC())
+								if err != nil {
+									log.Fatal(err)
+								}
+								for _, req := range reqs {
+									fmt.Printf("would delete\t%s\tdue %s\n", req.UserName, req.DueAt.Format(time.RFC3339))
+								}
+								return
+							}
+							auditor := newAuditor(db, "user deletions run")
+							result, err := manager.ExecuteDueDeletions(time.Now().UTC())
+							if err != nil {
+								log.Fatal(err)
+							}
+							for username, err := range result.Failures {
+								log.Printf("failed to delete %s: %s", username, err)
+							}
+							recordDeletions(auditor, result)
+							log.Printf("deleted %v users", result.Deleted)
+							if len(result.Failures) > 0 {
+								log.Fatalf("failed to delete %v users", len(result.Failures))
+							}
+						},
+					},
+					"service": {
+						Blurb:       "run the deletion service",
+						Description: "regularly delete every user whose deletion is due, at user.deletion.frequency",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							auditor := newAuditor(db, "user deletions service")
+							totalDeleted, err := usermgmt.NewUserManager(db).DeletionService(
+								ctx, *deletionFreq, func(result *usermgmt.DeletionResult) {
+									recordDeletions(auditor, result)
+								},
+							)
+							if err != nil {
+								log.Fatal(err)
+							}
+							log.Printf("deleted %v users", totalDeleted)
+						},
+					},
+				},
+			},
+			"suspend": {
+				Blurb:       "suspend a user account",
+				Description: "disable login and API access of user, recording the operator and reason. Use user.freeze.gc to stop the pins of user being garbage collected until they are reactivated. The user is emailed unless user.notify is false",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag not specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					auditor := newAuditor(db, "user suspend")
+					s, err := suspension.NewManager(db).Suspend(*user, *reason, *operator, *userFreezeGC)
+					if err != nil {
+						log.Fatal(err)
+					}
+					record(auditor, *user,
+						map[string]interface{}{"account_enabled": true},
+						map[string]interface{}{"account_enabled": false, "freeze_gc": s.FreezeGC, "suspension": s.ID},
+					)
+					log.Printf("suspended %s", *user)
+					if *userNotify {
+						notifySuspension(&cfg, db, s, suspension.SuspendedSubject)
+					}
+				},
+			},
+			"reactivate": {
+				Blurb:       "reactivate a suspended user account",
+				Description: "restore login and API access of a suspended user, and resume garbage collection of their pins, recording the operator and reason. The user is emailed unless user.notify is false. Users scheduled for deletion are refused, use deletions cancel instead",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag not specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					auditor := newAuditor(db, "user reactivate")
+					s, err := suspension.NewManager(db).Reactivate(*user, *reason, *operator, time.Now().UTC())
+					if err != nil {
+						log.Fatal(err)
+					}
+					record(auditor, *user,
+						map[string]interface{}{"account_enabled": false, "freeze_gc": s.FreezeGC, "suspension": s.ID},
+						map[string]interface{}{"account_enabled": true},
+					)
+					log.Printf("reactivated %s", *user)
+					if *userNotify {
+						notifySuspension(&cfg, db, s, suspension.ReactivatedSubject)
+					}
+				},
+			},
+			"suspensions": {
+				Blurb:       "list the suspensions of a user",
+				Description: "list the suspensions and reactivations of user, oldest first",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag not specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					history, err := suspension.NewManager(db).History(*user)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, s := range history {
+						fmt.Printf(
+							"%s\tsuspended by %s\tfreeze gc %v\t%s\n",
+							s.CreatedAt.Format(time.RFC3339), s.Operator, s.FreezeGC, s.Reason,
+						)
+						if !s.Active() {
+							fmt.Printf(
+								"%s\treactivated by %s\t%s\n",
+								s.ReactivatedAt.Format(time.RFC3339), s.ReactivatedBy, s.ReactivationReason,
+							)
+						}
+					}
+				},
+			},
+			"verify-unverified": {
+				Blurb:       "verify unverified user accounts",
+				Description: "verify the email of all users, and upgrade users in the unverified tier to the free tier. Use dry-run to report the users that would be changed. Interrupted runs resume from the last processed batch unless restart is set",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					var auditor *audit.Auditor
+					if !*dryRun {
+						auditor = newAuditor(db, "user verify-unverified")
+					}
+					checkpoints, err := checkpoint.NewStore(db)
+					if err != nil {
+						log.Fatal(err)
+					}
+					result, err := useremailmigration.NewUserMigration(db).VerifyUsers(
+						useremailmigration.VerifyOptions{
+							DryRun:      *dryRun,
+							BatchSize:   *batchSize,
+							Checkpoints: checkpoints,
+							Restart:     *restart,
+						},
+					)
+					if err != nil {
+						log.Fatal(err)
+					}
+					verified, upgraded := "verified", "upgraded"
+					if *dryRun {
+						verified, upgraded = "would verify", "would upgrade"
+					}
+					for _, name := range result.Verified {
+						fmt.Printf("%s email\t%s\n", verified, name)
+					}
+					for _, name := range result.Upgraded {
+						fmt.Printf("%s tier\t%s\n", upgraded, name)
+					}
+					log.Printf(
+						"processed %v users, %v emails verified, %v tiers upgraded",
+						result.Processed, len(result.Verified), len(result.Upgraded),
+					)
+					for _, reason := range result.FailureReasons() {
+						log.Printf("%v failures: %s", len(result.Failures[reason]), reason)
+					}
+					if auditor != nil {
+						record(auditor, "", nil, map[string]interface{}{
+							"verified": result.Verified,
+							"upgraded": result.Upgraded,
+						})
+					}
+				},
+			},
+		},
+	},
+	"reset": {
+		Blurb:       "reset user account tier",
+		Description: "reset the account tier of a user to the free tier, recording the operator and reason",
+		Action: func(cfg config.TemporalConfig, flags map[string]string) {
+			// the bulk file lists its own tiers, which reset must not apply
+			if *bulkFile != "" {
+				log.Fatal("reset does not support bulk.file, use tier set with a file of free tier changes")
+			}
+			setTier(&cfg, "reset", models.Free.String())
+		},
+	},
+	"takedown": {
+		Blurb:         "take down abusive content",
+		Description:   "remove content from every account pinning it, and record it on the takedown blocklist so pin orphans does not repin it",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"run": {
+				Blurb:       "take down a hash",
+				Description: "remove every upload of pin.hash in every network, refunding according to refund.policy which defaults to none, unpin it, add it to the blocklist with reason and takedown.reference, and email the affected users unless takedown.notify is false. A preview is shown, and must be confirmed unless yes is set. Use dry-run to only show the preview",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *pinHash == "" {
+						log.Fatal("pin.hash flag not specified")
+					}
+					if *reason == "" {
+						log.Fatal("reason flag not specified")
+					}
+					policy, err := parseRefundPolicy(pin.RefundNone)
+					if err != nil {
+						log.Fatal(err)
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					takedowns := takedown.NewManager(db, pinUtil)
+					plan, err := takedowns.Plan(*pinHash, policy, time.Now().UTC())
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, removal := range plan.Removals {
+						fmt.Printf(
+							"%s\t%s\t%s refund %v\n",
+							removal.Upload.UserName, removal.Upload.NetworkName, removal.Policy, removal.Refund,
+						)
+					}
+					log.Printf(
+						"%v uploads of %v users, total %s refund of %v credits, unpinning from %s",
+						len(plan.Removals), len(plan.Users()), policy, pin.TotalRefund(plan.Removals),
+						strings.Join(plan.Networks(), ", "),
+					)
+					if *dryRun {
+						return
+					}
+					auditor := newAuditor(db, "takedown run")
+					if !confirm(fmt.Sprintf("take down %s?", plan.Hash)) {
+						log.Fatal("takedown cancelled")
+					}
+					result, err := takedowns.Apply(ctx, plan, takedown.Request{
+						Hash:      plan.Hash,
+						Reason:    *reason,
+						Reference: *takedownRef,
+						Operator:  *operator,
+						Notify:    *takedownNotify,
+					})
+					if err != nil {
+						log.Fatal(err)
+					}
+					var removed []string
+					for _, removal := range result.Removals {
+						upload := removal.Preview.Upload
+						if removal.Err != nil {
+							fmt.Printf("failed to remove\t%s\t%s\t%s\n", upload.UserName, upload.NetworkName, removal.Err)
+							continue
+						}
+						removed = append(removed, upload.UserName)
+						fmt.Printf("removed\t%s\t%s\trefunded %v\n", upload.UserName, upload.NetworkName, removal.Preview.Refund)
+					}
+					for network, err := range result.UnpinErrors {
+						fmt.Printf("failed to unpin\t%s\t%s\n", network, err)
+					}
+					for username, err := range result.NotifyErrors {
+						fmt.Printf("failed to notify\t%s\t%s\n", username, err)
+					}
+					record(auditor, plan.Hash,
+						map[string]interface{}{"blocked": false},
+						map[string]interface{}{
+							"blocked":       true,
+							"reference":     *takedownRef,
+							"refund_policy": policy,
+							"removed":       removed,
+							"unpinned":      result.Unpinned,
+							"notified":      result.Notified,
+						},
+					)
+					if result.Failed() {
+						log.Fatalf("takedown of %s was recorded, but not every step succeeded", plan.Hash)
+					}
+					log.Printf("took down %s", plan.Hash)
+				},
+			},
+			"list": {
+				Blurb:       "list the takedown blocklist",
+				Description: "list every hash which was taken down, oldest first",
 				Action: func(cfg config.TemporalConfig, flags map[string]string) {
 					db, err := newDB(&cfg, *dbNoSSL)
 					if err != nil {
 						log.Fatal(err)
 					}
-					userm := useremailmigration.NewUserMigration(db)
-					count, err := userm.VerifyUnverifiedUsers()
+					blocks, err := takedown.NewManager(db, nil).Blocklist()
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, block := range blocks {
+						fmt.Printf(
+							"%s\t%s\t%s\t%s\t%s\n",
+							block.CreatedAt.Format(time.RFC3339), block.Hash, block.Operator, block.Reference, block.Reason,
+						)
+					}
+				},
+			},
+			"unblock": {
+				Blurb:       "remove a hash from the blocklist",
+				Description: "remove pin.hash from the takedown blocklist, so pin orphans may repin it again. Removed uploads are not restored",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *pinHash == "" {
+						log.Fatal("pin.hash flag not specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
 					if err != nil {
 						log.Fatal(err)
 					}
-					log.Printf("verified %v users", count)
+					auditor := newAuditor(db, "takedown unblock")
+					if err := takedown.NewManager(db, nil).Unblock(*pinHash); err != nil {
+						log.Fatal(err)
+					}
+					record(auditor, *pinHash, map[string]interface{}{"blocked": true}, map[string]interface{}{"blocked": false})
+					log.Printf("unblocked %s", *pinHash)
 				},
 			},
 		},
 	},
-	"reset": {
-		Blurb: "reset user account tier",
+	"pin-remove": {
+		Blurb:       "manually remove a pin",
+		Description: "manually remove a pin and refund the storage cost according to refund.policy. A preview of the refund and usage change is shown, and must be confirmed unless yes is set. Use dry-run to only show the preview",
 		Action: func(cfg config.TemporalConfig, flags map[string]string) {
 			if *user == "" {
 				log.Fatal("user flag not specified")
 			}
+			policy, err := parseRefundPolicy(pin.RefundProrated)
+			if err != nil {
+				log.Fatal(err)
+			}
 			db, err := newDB(&cfg, *dbNoSSL)
 			if err != nil {
 				log.Fatal(err)
 			}
-			usage := models.NewUsageManager(db)
-			if err := usage.UpdateTier(*user, models.Free); err != nil {
+			pinUtil, err := newPinUtil(db, &cfg)
+			if err != nil {
 				log.Fatal(err)
 			}
-		},
-	},
-	"pin-remove": {
-		Blurb:       "manually remove a pin",
-		Description: "manually remove a pin and refund the storage cost",
-		Action: func(cfg config.TemporalConfig, flags map[string]string) {
-			if *user == "" {
-				log.Fatal("user flag not specified")
+			preview, err := pinUtil.PreviewRemoval(*user, *pinToRemove, *network, policy, time.Now().UTC())
+			if err != nil {
+				log.Fatal(err)
 			}
-			db, err := newDB(&cfg, *dbNoSSL)
+			fmt.Println(preview.String())
+			if *dryRun {
+				return
+			}
+			auditor := newAuditor(db, "pin-remove")
+			if !confirm("remove pin and issue refund?") {
+				log.Fatal("pin removal cancelled")
+			}
+			before, err := accountState(db, *user)
 			if err != nil {
 				log.Fatal(err)
 			}
-			if err := models.NewUploadManager(db).RemovePin(*user, *pinToRemove, "public"); err != nil {
+			if err := pinUtil.ApplyRemoval(preview, *operator); err != nil {
+				log.Fatal(err)
+			}
+			after, err := accountState(db, *user)
+			if err != nil {
 				log.Fatal(err)
 			}
+			before["hash"] = *pinToRemove
+			after["refund_policy"] = policy
+			after["refund"] = preview.Refund
+			record(auditor, *user, before, after)
 		},
 	},
 	"pin-expire-service": {
 		Blurb:       "runs pin garbage collection service",
-		Description: "regularly removes pins from the system, and saves the removes ones to disk. Note that this doesn't actually remove it from our servers",
+		Description: "regularly removes pins of network, or every network if network.all is set, from the system, and saves the removes ones to disk. Note that this doesn't actually remove it from our servers",
 		Action: func(cfg config.TemporalConfig, flags map[string]string) {
 			db, err := newDB(&cfg, *dbNoSSL)
 			if err != nil {
 				log.Fatal(err)
 			}
-			pinUtil, err := pin.NewPinUtil(db, &cfg)
+			pinUtil, err := newPinUtil(db, &cfg)
 			if err != nil {
 				log.Fatal(err)
 			}
+			auditor := newAuditor(db, "pin-expire-service")
 			totalRemoved, err := pinUtil.PinExpirationService(
-				ctx, *expireFrequency,
+				ctx, pinNetwork(), *expireFrequency, func(expired []models.Upload) {
+					record(auditor, "", nil, map[string]interface{}{"expired_upload_ids": uploadIDs(expired)})
+				},
 			)
 			if err != nil {
 				log.Fatal(err)
@@ -195,45 +1545,479 @@ var commands = map[string]cmd.Cmd{
 	},
 	"pin-notifiers": {
 		Blurb:       "pin expiration notifier",
-		Description: "warns users when their pins are reaching their expiration date",
+		Description: "warns users when their pins of network, or every network if network.all is set, are reaching their expiration date. Use dry-run to preview reminders without sending them, or notify.redirect to send every reminder to a single address",
 		Action: func(cfg config.TemporalConfig, flags map[string]string) {
+			// debug previously redirected reminders implicitly, refuse to
+			// run rather than unexpectedly notifying real users
+			redirect := notifyRedirectAddress()
+			if *debug && !*dryRun && redirect == "" {
+				log.Fatal("debug mode requires either dry-run or notify.redirect")
+			}
 			db, err := newDB(&cfg, *dbNoSSL)
 			if err != nil {
 				log.Fatal(err)
 			}
-			pinUtil, err := pin.NewPinUtil(db, &cfg)
+			pinUtil, err := newPinUtil(db, &cfg)
+			if err != nil {
+				log.Fatal(err)
+			}
+			messages, err := pinUtil.GetPinsToRemind(pinNetwork(), *notifyDays)
 			if err != nil {
 				log.Fatal(err)
 			}
-			messages, err := pinUtil.GetPinsToRemind(*notifyDays)
+			hooks, err := pinUtil.Webhooks()
 			if err != nil {
 				log.Fatal(err)
 			}
+			dispatcher := &pin.Dispatcher{
+				Mail:     pinUtil.Mail,
+				Webhooks: hooks,
+				Redirect: redirect,
+			}
+			if *dryRun {
+				dispatcher.DryRun = os.Stdout
+				if *notifyOutFile != "" {
+					out, err := os.Create(*notifyOutFile)
+					if err != nil {
+						log.Fatal(err)
+					}
+					defer out.Close()
+					dispatcher.DryRun = out
+				}
+			}
+			var sent int
 			for _, message := range messages {
-				email := ""
-				// enable debugging by sending messages to rtrade instead
-				// otherwise use the users email
-				if *debug {
-					email = *emailRecipient
-				} else {
-					email = message.EmailAddress
+				err := dispatcher.Notify(ctx, message)
+				if err == mail.ErrRecipientSuppressed {
+					log.Printf("skipping suppressed recipient %s", message.EmailAddress)
+					continue
 				}
-				_, err := pinUtil.Mail.SendEmail(
-					"Temporal: You Have Pins About To Expire",
-					message.Message,
-					"text/html",
-					message.UserName,
-					email,
-				)
 				if err != nil {
 					log.Printf(
-						"error: failed to send message to %s with err %s",
-						message.EmailAddress, err.Error(),
+						"error: failed to notify %s with err %s",
+						message.UserName, err.Error(),
 					)
 					continue
 				}
+				sent++
 			}
-
+			if *dryRun {
+				log.Printf("dry run: rendered %v of %v reminders", sent, len(messages))
+			} else {
+				log.Printf("sent %v of %v reminders", sent, len(messages))
+			}
+		},
+	},
+	"pin": {
+		Blurb:         "manage pins",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"extend": {
+				Blurb:       "extend the garbage collection date of pins",
+				Description: "extend the pins of network selected by any combination of user, pin.hash, pin.file, pin.older.than and pin.type by pin.months. The extension is charged in credits unless the account tier is not billed in credits, or pin.waive is set. Users without enough credits are not extended unless force is set. A reason is required. A preview of every extension and the total charge is shown, and must be confirmed unless yes is set. Use dry-run to only show the preview",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *reason == "" {
+						log.Fatal("reason flag not specified")
+					}
+					filter := pin.UploadFilter{
+						Network:   *network,
+						UserName:  *user,
+						OlderThan: *pinOlderThan,
+						Type:      *pinType,
+					}
+					if *pinHash != "" {
+						filter.Hashes = []string{*pinHash}
+					}
+					if *pinFile != "" {
+						file, err := os.Open(*pinFile)
+						if err != nil {
+							log.Fatal(err)
+						}
+						hashes, err := pin.ReadHashes(file)
+						file.Close()
+						if err != nil {
+							log.Fatal(err)
+						}
+						if len(hashes) == 0 {
+							log.Fatal("no hashes found in pin.file")
+						}
+						filter.Hashes = append(filter.Hashes, hashes...)
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					previews, err := pinUtil.PreviewExtensions(filter, *pinMonths, *pinWaive, time.Now().UTC())
+					if err != nil {
+						log.Fatal(err)
+					}
+					switch len(previews) {
+					case 0:
+						log.Println("no pins matched")
+						return
+					case 1:
+						fmt.Println(previews[0].String())
+					default:
+						for _, preview := range previews {
+							fmt.Printf(
+								"%s\t%s\t%s\t%s -> %s\tcharge %v\n",
+								preview.Upload.UserName, preview.Upload.Hash, preview.Tier,
+								preview.Upload.GarbageCollectDate.Format(time.RFC3339),
+								preview.GarbageCollectDate.Format(time.RFC3339), preview.Charge(),
+							)
+						}
+					}
+					log.Printf(
+						"%v pins extended by %v months, total charge of %v credits",
+						len(previews), *pinMonths, pin.TotalCharge(previews),
+					)
+					if *dryRun {
+						return
+					}
+					auditor := newAuditor(db, "pin extend")
+					if !confirm(fmt.Sprintf("extend %v pins and charge credits?", len(previews))) {
+						log.Fatal("pin extension cancelled")
+					}
+					var failed int
+					for _, result := range pinUtil.ApplyExtensions(previews, *operator, *reason, *force) {
+						upload := result.Preview.Upload
+						if result.Err != nil {
+							failed++
+							fmt.Printf("failed\t%s\t%s\t%s\n", upload.UserName, upload.Hash, result.Err)
+							continue
+						}
+						record(auditor, upload.UserName,
+							map[string]interface{}{"hash": upload.Hash, "network": upload.NetworkName, "garbage_collect_date": upload.GarbageCollectDate},
+							map[string]interface{}{"garbage_collect_date": result.Preview.GarbageCollectDate, "charge": result.Extension.Cost, "waived": result.Extension.Waived},
+						)
+						fmt.Printf("extended\t%s\t%s\tcharged %v\n", upload.UserName, upload.Hash, result.Extension.Cost)
+					}
+					if failed > 0 {
+						log.Fatalf("failed to extend %v of %v pins", failed, len(previews))
+					}
+					log.Printf("extended %v pins", len(previews))
+				},
+			},
+			"extensions": {
+				Blurb:       "list pin extensions",
+				Description: "list the pin extensions made to user, oldest first",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag not specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					exts, err := pinUtil.Extensions(*user)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, ext := range exts {
+						fmt.Printf(
+							"%s\t%s\t%s\t%v months\t%s -> %s\tcharged %v\twaived %v\t%s\t%s\n",
+							ext.CreatedAt.Format(time.RFC3339), ext.Hash, ext.NetworkName, ext.Months,
+							ext.GarbageCollectDateBefore.Format(time.RFC3339), ext.GarbageCollectDateAfter.Format(time.RFC3339),
+							ext.Cost, ext.Waived, ext.Operator, ext.Reason,
+						)
+					}
+				},
+			},
+			"report": {
+				Blurb:       "summarize pins and their expiry",
+				Description: "summarize the pins of network, or every network if network.all is set, grouped by report.by, with counts, total bytes, and the number of pins expired and expiring within 1, 7 and 30 days. Use user to only summarize the pins of a single user",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					by, err := pin.ParseReportDimensions(*reportBy)
+					if err != nil {
+						log.Fatal(err)
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					report, err := pinUtil.Report(pinNetwork(), *user, by, time.Now().UTC())
+					if err != nil {
+						log.Fatal(err)
+					}
+					if err := report.Write(os.Stdout, *reportFormat); err != nil {
+						log.Fatal(err)
+					}
+				},
+			},
+			"remove": {
+				Blurb:       "remove many pins at once",
+				Description: "remove the pins of network selected by any combination of user, pin.file, pin.older.than and pin.type, refunding according to refund.policy. A preview of every removal and the total refund is shown, and must be confirmed unless yes is set. Use dry-run to only show the preview",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					policy, err := parseRefundPolicy(pin.RefundProrated)
+					if err != nil {
+						log.Fatal(err)
+					}
+					filter := pin.UploadFilter{
+						Network:   *network,
+						UserName:  *user,
+						OlderThan: *pinOlderThan,
+						Type:      *pinType,
+					}
+					if *pinFile != "" {
+						file, err := os.Open(*pinFile)
+						if err != nil {
+							log.Fatal(err)
+						}
+						filter.Hashes, err = pin.ReadHashes(file)
+						file.Close()
+						if err != nil {
+							log.Fatal(err)
+						}
+						if len(filter.Hashes) == 0 {
+							log.Fatal("no hashes found in pin.file")
+						}
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					previews, err := pinUtil.PreviewRemovals(filter, policy, time.Now().UTC())
+					if err != nil {
+						log.Fatal(err)
+					}
+					if len(previews) == 0 {
+						log.Println("no pins matched")
+						return
+					}
+					users := make(map[string]bool)
+					for _, preview := range previews {
+						users[preview.Upload.UserName] = true
+						fmt.Printf(
+							"%s\t%s\t%s\t%s refund %v\tusage %v -> %v\n",
+							preview.Upload.UserName, preview.Upload.Hash, preview.Tier,
+							preview.Policy, preview.Refund, preview.UsageBefore, preview.UsageAfter,
+						)
+					}
+					log.Printf(
+						"%v pins of %v users, total %s refund of %v credits",
+						len(previews), len(users), policy, pin.TotalRefund(previews),
+					)
+					if *dryRun {
+						return
+					}
+					auditor := newAuditor(db, "pin remove")
+					if !confirm(fmt.Sprintf("remove %v pins and issue refunds?", len(previews))) {
+						log.Fatal("pin removal cancelled")
+					}
+					var failed int
+					for _, result := range pinUtil.ApplyRemovals(previews, *operator) {
+						upload := result.Preview.Upload
+						if result.Err != nil {
+							failed++
+							fmt.Printf("failed\t%s\t%s\t%s\n", upload.UserName, upload.Hash, result.Err)
+							continue
+						}
+						record(auditor, upload.UserName,
+							map[string]interface{}{"hash": upload.Hash, "network": upload.NetworkName, "current_data_used_bytes": result.Preview.UsageBefore},
+							map[string]interface{}{"refund_policy": policy, "refund": result.Preview.Refund, "current_data_used_bytes": result.Preview.UsageAfter},
+						)
+						fmt.Printf("removed\t%s\t%s\trefunded %v\n", upload.UserName, upload.Hash, result.Preview.Refund)
+					}
+					if failed > 0 {
+						log.Fatalf("failed to remove %v of %v pins", failed, len(previews))
+					}
+					log.Printf("removed %v pins", len(previews))
+				},
+			},
+			"orphans": {
+				Blurb:       "reconcile node pins with uploads",
+				Description: "lists content pinned on the node that no upload references, and uploads whose content is not pinned. Use orphans.unpin and orphans.repin to repair them, and dry-run to preview the repairs. Content is only unpinned once it has been found unreferenced by runs at least orphans.grace apart",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					pinUtil, err := newPinUtil(db, &cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					report, err := pinUtil.FindOrphans(ctx, *network)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, hash := range report.UnreferencedPins {
+						fmt.Printf("unreferenced pin\t%s\n", hash)
+					}
+					for _, upload := range report.MissingPins {
+						fmt.Printf("missing pin\t%v\t%s\t%s\n", upload.ID, upload.UserName, upload.Hash)
+					}
+					if report.Empty() {
+						log.Println("no orphans found")
+						return
+					}
+					var auditor *audit.Auditor
+					if (*orphansUnpin || *orphansRepin) && !*dryRun {
+						auditor = newAuditor(db, "pin orphans")
+					}
+					if *orphansUnpin {
+						now := time.Now().UTC()
+						var firstSeen map[string]time.Time
+						if *dryRun {
+							firstSeen, err = pinUtil.OrphanSightings(*network)
+						} else {
+							firstSeen, err = pinUtil.RecordOrphans(*network, report.UnreferencedPins, now)
+						}
+						if err != nil {
+							log.Fatal(err)
+						}
+						settled, recent := pin.SettledOrphans(report.UnreferencedPins, firstSeen, *orphansGrace, now)
+						for _, hash := range recent {
+							log.Printf("not unpinning %s, unreferenced for less than %s", hash, *orphansGrace)
+						}
+						var unpinned int
+						for _, hash := range settled {
+							if *dryRun {
+								log.Printf("would unpin %s", hash)
+								continue
+							}
+							if err := pinUtil.UnpinOrphan(ctx, *network, hash); err == pin.ErrOrphanReferenced {
+								log.Printf("not unpinning %s, it is now referenced", hash)
+								continue
+							} else if err != nil {
+								log.Println(err)
+								continue
+							}
+							record(auditor, hash,
+								map[string]interface{}{"network": *network, "pinned": true},
+								map[string]interface{}{"network": *network, "pinned": false},
+							)
+							unpinned++
+						}
+						log.Printf("unpinned %v of %v unreferenced pins", unpinned, len(report.UnreferencedPins))
+					}
+					if *orphansRepin {
+						takedowns := takedown.NewManager(db, pinUtil)
+						var repinned int
+						for _, upload := range report.MissingPins {
+							if *dryRun {
+								log.Printf("would repin %s for %s", upload.Hash, upload.UserName)
+								continue
+							}
+							if blocked, err := takedowns.IsBlocked(upload.Hash); err != nil {
+								log.Fatal(err)
+							} else if blocked {
+								log.Printf("not repinning %s for %s, it was taken down", upload.Hash, upload.UserName)
+								continue
+							}
+							if err := pinUtil.Repin(upload); err != nil {
+								log.Printf("failed to repin %s for %s: %s", upload.Hash, upload.UserName, err)
+								continue
+							}
+							record(auditor, upload.UserName,
+								map[string]interface{}{"hash": upload.Hash, "pinned": false},
+								map[string]interface{}{"hash": upload.Hash, "pinned": true},
+							)
+							repinned++
+						}
+						log.Printf("repinned %v of %v missing pins", repinned, len(report.MissingPins))
+					}
+				},
+			},
+			"webhook": {
+				Blurb:         "manage pin reminder webhooks",
+				Description:   "users with a registered webhook receive pin expiration reminders as a signed json payload posted to the webhook url, instead of by email",
+				ChildRequired: true,
+				Children: map[string]cmd.Cmd{
+					"set": {
+						Blurb:       "register a webhook for a user",
+						Description: "register webhook.url for a user, replacing any existing webhook. Prints the secret used to sign requests",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							if *user == "" {
+								log.Fatal("user flag is empty")
+							}
+							if *webhookURL == "" {
+								log.Fatal("webhook.url flag is empty")
+							}
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							pinUtil, err := newPinUtil(db, &cfg)
+							if err != nil {
+								log.Fatal(err)
+							}
+							auditor := newAuditor(db, "pin webhook set")
+							before, err := webhookState(pinUtil, *user)
+							if err != nil {
+								log.Fatal(err)
+							}
+							secret, err := pinUtil.SetWebhook(*user, *webhookURL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							// the signing secret is deliberately not recorded
+							record(auditor, *user, before, map[string]interface{}{"url": *webhookURL})
+							fmt.Printf("webhook registered, signing secret: %s\n", secret)
+						},
+					},
+					"remove": {
+						Blurb: "remove the webhook registered for a user",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							if *user == "" {
+								log.Fatal("user flag is empty")
+							}
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							pinUtil, err := newPinUtil(db, &cfg)
+							if err != nil {
+								log.Fatal(err)
+							}
+							auditor := newAuditor(db, "pin webhook remove")
+							before, err := webhookState(pinUtil, *user)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if err := pinUtil.RemoveWebhook(*user); err != nil {
+								log.Fatal(err)
+							}
+							record(auditor, *user, before, nil)
+						},
+					},
+					"list": {
+						Blurb: "list registered webhooks",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							pinUtil, err := newPinUtil(db, &cfg)
+							if err != nil {
+								log.Fatal(err)
+							}
+							hooks, err := pinUtil.Webhooks()
+							if err != nil {
+								log.Fatal(err)
+							}
+							for _, hook := range hooks {
+								fmt.Printf("%s\t%s\n", hook.UserName, hook.URL)
+							}
+						},
+					},
+				},
+			},
 		},
 	},
 	"gc": {
@@ -243,23 +2027,25 @@ var commands = map[string]cmd.Cmd{
 		Children: map[string]cmd.Cmd{
 			"run": cmd.Cmd{
 				Blurb:       "run a pin garbage collection",
-				Description: "parse uploads and collect expired pins",
+				Description: "parse uploads and collect expired pins of network, or every network if network.all is set",
 				Action: func(cfg config.TemporalConfig, flags map[string]string) {
 					db, err := newDB(&cfg, *dbNoSSL)
 					if err != nil {
 						log.Fatal(err)
 					}
-					pinUtil, err := pin.NewPinUtil(db, &cfg)
+					pinUtil, err := newPinUtil(db, &cfg)
 					if err != nil {
 						log.Fatal(err)
 					}
-					expiredPins, err := pinUtil.GetExpiredPins()
+					auditor := newAuditor(db, "gc run")
+					expiredPins, err := pinUtil.GetExpiredPins(pinNetwork())
 					if err != nil {
 						log.Fatal(err)
 					}
 					if err := pinUtil.ExpirePins(expiredPins); err != nil {
 						log.Fatal(err)
 					}
+					record(auditor, "", nil, map[string]interface{}{"expired_upload_ids": uploadIDs(expiredPins)})
 					var formattedOutput string
 					for _, pin := range expiredPins {
 						formattedOutput = fmt.Sprintf("%s\n%+v\n", formattedOutput, pin)
@@ -275,17 +2061,17 @@ var commands = map[string]cmd.Cmd{
 			},
 			"run-dry": {
 				Blurb:       "run a dry pin garbage collection",
-				Description: "runs a dry run of the garbage collection period",
+				Description: "runs a dry run of the garbage collection period of network, or every network if network.all is set",
 				Action: func(cfg config.TemporalConfig, flags map[string]string) {
 					db, err := newDB(&cfg, *dbNoSSL)
 					if err != nil {
 						log.Fatal(err)
 					}
-					pinUtil, err := pin.NewPinUtil(db, &cfg)
+					pinUtil, err := newPinUtil(db, &cfg)
 					if err != nil {
 						log.Fatal(err)
 					}
-					expiredPins, err := pinUtil.GetExpiredPins()
+					expiredPins, err := pinUtil.GetExpiredPins(pinNetwork())
 					if err != nil {
 						log.Fatal(err)
 					}
@@ -306,31 +2092,246 @@ var commands = map[string]cmd.Cmd{
 	},
 	"upgrade-tier": {
 		Blurb:       "upgrade account tier",
-		Description: "used to perform an account tier upgrade",
+		Description: "used to perform an account tier upgrade, recording the operator and reason. Use bulk.file to change many users from csv in the format username,tier,reason",
 		Action: func(cfg config.TemporalConfig, flags map[string]string) {
-			if *user == "" {
-				log.Fatal("user flag is empty")
-			}
-			db, err := newDB(&cfg, *dbNoSSL)
-			if err != nil {
-				log.Fatal(err)
-			}
-			usg := models.NewUsageManager(db)
-			switch models.DataUsageTier(*accountTier).PricePerGB() {
-			case 0.07, 0.05, 9999:
-				break
-			default:
-				log.Fatal("invalid account tier")
-			}
-			if err := usg.UpdateTier(*user, models.DataUsageTier(*accountTier)); err != nil {
-				log.Fatal("failed to upgrade tier", err)
-			}
+			setTier(&cfg, "upgrade-tier", *accountTier)
+		},
+	},
+	"tier": {
+		Blurb:         "manage account tiers",
+		Description:   "manage account tiers, every change is recorded with the operator and reason",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"set": {
+				Blurb:       "change the tier of a user",
+				Description: "change the tier of a user to account.tier. Changes to the current tier, or to the unverified tier, are refused. Use bulk.file to change many users from csv in the format username,tier,reason",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					setTier(&cfg, "tier set", *accountTier)
+				},
+			},
+			"show": {
+				Blurb:       "show the tier of a user",
+				Description: "show the current tier of a user, along with its limits",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag not specified")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					usg, err := tier.NewManager(db).Show(*user)
+					if err != nil {
+						log.Fatal(err)
+					}
+					fmt.Printf("user\t%s\n", usg.UserName)
+					fmt.Printf("tier\t%s\n", usg.Tier)
+					fmt.Printf("price per gb\t%v\n", usg.Tier.PricePerGB())
+					fmt.Printf("data used\t%v/%v bytes\n", usg.CurrentDataUsedBytes, usg.MonthlyDataLimitBytes)
+					fmt.Printf("keys\t%v/%v\n", usg.KeysCreated, usg.KeysAllowed)
+					fmt.Printf("pubsub messages\t%v/%v\n", usg.PubSubMessagesSent, usg.PubSubMessagesAllowed)
+					fmt.Printf("ipns records\t%v/%v\n", usg.IPNSRecordsPublished, usg.IPNSRecordsAllowed)
+				},
+			},
+			"history": {
+				Blurb:       "list tier changes",
+				Description: "list the tier changes of a user, or of every user if no user is specified",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					changes, err := tier.NewManager(db).History(*user)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, change := range changes {
+						fmt.Printf(
+							"%s\t%s\t%s -> %s\t%s\t%s\n",
+							change.CreatedAt.UTC().Format(time.RFC3339), change.UserName,
+							change.FromTier, change.ToTier, change.Operator, change.Reason,
+						)
+					}
+				},
+			},
+		},
+	},
+	"mail": {
+		Blurb:         "manage email delivery",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"broadcast": {
+				Blurb:       "email users selected by account criteria",
+				Description: "renders broadcast.template for every user matching the broadcast filters and emails it to them. Use dry-run to preview the recipients and rendered message",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *broadcastTemplate == "" {
+						log.Fatal("broadcast.template flag is empty")
+					}
+					if *broadcastSubject == "" {
+						log.Fatal("broadcast.subject flag is empty")
+					}
+					tmpl, err := template.ParseFiles(*broadcastTemplate)
+					if err != nil {
+						log.Fatal(err)
+					}
+					filter := mail.RecipientFilter{
+						EmailEnabled:     *broadcastEmailEnabled,
+						HasUploads:       *broadcastHasUploads,
+						MinDataUsedBytes: *broadcastMinUsage,
+					}
+					if *broadcastTiers != "" {
+						for _, name := range strings.Split(*broadcastTiers, ",") {
+							t, err := tier.Parse(name)
+							if err != nil {
+								log.Fatal(err)
+							}
+							filter.Tiers = append(filter.Tiers, t)
+						}
+					}
+					mm, err := newMailManager(&cfg)
+					if err != nil {
+						log.Fatal(err)
+					}
+					recipients, err := mm.FindRecipients(filter)
+					if err != nil {
+						log.Fatal(err)
+					}
+					if *dryRun {
+						deliverable, suppressed, err := mm.Deliverable(recipients)
+						if err != nil {
+							log.Fatal(err)
+						}
+						for _, r := range deliverable {
+							fmt.Printf("%s\t%s\t%s\t%v\n", r.UserName, r.EmailAddress, r.Tier, r.CurrentDataUsedBytes)
+						}
+						for _, r := range suppressed {
+							fmt.Printf("suppressed\t%s\t%s\n", r.UserName, r.EmailAddress)
+						}
+						if len(deliverable) > 0 {
+							preview, err := mail.RenderTemplate(tmpl, deliverable[0])
+							if err != nil {
+								log.Fatal(err)
+							}
+							fmt.Printf("\nSubject: %s\n\n%s\n", *broadcastSubject, preview)
+						}
+						log.Printf(
+							"dry run: broadcast would be sent to %v users, %v suppressed (send cap %v)",
+							len(deliverable), len(suppressed), *broadcastMax,
+						)
+						if err := mail.CheckSendCap(deliverable, *broadcastMax); err != nil {
+							log.Fatalf("dry run: broadcast would be refused: %s", err)
+						}
+						return
+					}
+					result, err := mm.Broadcast(*broadcastSubject, tmpl, recipients, *broadcastMax)
+					if err != nil {
+						log.Fatal(err)
+					}
+					log.Printf(
+						"broadcast sent to %v users, %v suppressed, %v failed",
+						result.Sent, result.Suppressed, result.Failed,
+					)
+				},
+			},
+			"suppression": {
+				Blurb:         "manage the email suppression list",
+				Description:   "manage addresses that will never receive email. Addresses of deleted accounts, and accounts with email disabled are always suppressed",
+				ChildRequired: true,
+				Children: map[string]cmd.Cmd{
+					"add": {
+						Blurb:       "suppress an email address",
+						Description: "suppress an email address, reason must be one of bounce, unsubscribe, blocklist",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							if *emailAddress == "" {
+								log.Fatal("email flag is empty")
+							}
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							auditor := newAuditor(db, "mail suppression add")
+							mm, err := mail.NewManager(&cfg, db)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if err := mm.Suppress(*emailAddress, *reason); err != nil {
+								log.Fatal(err)
+							}
+							record(auditor, *emailAddress, nil, map[string]interface{}{"suppressed": true, "reason": *reason})
+							log.Printf("suppressed %s", *emailAddress)
+						},
+					},
+					"remove": {
+						Blurb: "remove an email address from the suppression list",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							if *emailAddress == "" {
+								log.Fatal("email flag is empty")
+							}
+							db, err := newDB(&cfg, *dbNoSSL)
+							if err != nil {
+								log.Fatal(err)
+							}
+							auditor := newAuditor(db, "mail suppression remove")
+							mm, err := mail.NewManager(&cfg, db)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if err := mm.Unsuppress(*emailAddress); err != nil {
+								log.Fatal(err)
+							}
+							record(auditor, *emailAddress, map[string]interface{}{"suppressed": true}, nil)
+							log.Printf("unsuppressed %s", *emailAddress)
+						},
+					},
+					"list": {
+						Blurb: "list suppressed email addresses",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							mm, err := newMailManager(&cfg)
+							if err != nil {
+								log.Fatal(err)
+							}
+							sups, err := mm.Suppressions()
+							if err != nil {
+								log.Fatal(err)
+							}
+							for _, sup := range sups {
+								fmt.Printf("%s\t%s\t%s\n", sup.EmailAddress, sup.Reason, sup.CreatedAt.Format(time.RFC3339))
+							}
+						},
+					},
+					"check": {
+						Blurb: "check whether an email address is suppressed",
+						Action: func(cfg config.TemporalConfig, flags map[string]string) {
+							if *emailAddress == "" {
+								log.Fatal("email flag is empty")
+							}
+							mm, err := newMailManager(&cfg)
+							if err != nil {
+								log.Fatal(err)
+							}
+							suppressed, why, err := mm.IsSuppressed(*emailAddress)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if suppressed {
+								fmt.Printf("%s is suppressed: %s\n", *emailAddress, why)
+							} else {
+								fmt.Printf("%s is not suppressed\n", *emailAddress)
+							}
+						},
+					},
+				},
+			},
 		},
 	},
 	"add-credits": {
 		Blurb:       "add credits to an account",
-		Description: "used to increase the credits balance of an account",
+		Description: "used to change the credits balance of an account, recording the change in the credit ledger. Reason must be one of " + strings.Join(creditledger.Reasons, ", ") + ". Negative credits remove credits, force is required to leave a negative balance. Use bulk.file to adjust many users from csv in the format username,credits,reason[,note]",
 		Action: func(cfg config.TemporalConfig, flags map[string]string) {
+			if *bulkFile != "" {
+				adjustCredits(&cfg, "add-credits")
+				return
+			}
 			if *user == "" {
 				log.Fatal("user flag is empty")
 			}
@@ -341,12 +2342,70 @@ var commands = map[string]cmd.Cmd{
 			if err != nil {
 				log.Fatal(err)
 			}
-			um := models.NewUserManager(db)
-			_, err = um.AddCredits(*user, *credits)
+			auditor := newAuditor(db, "add-credits")
+			entry, err := creditledger.NewLedger(db).Adjust(creditledger.Adjustment{
+				UserName: *user,
+				Amount:   *credits,
+				Reason:   *reason,
+				Note:     *note,
+				Operator: *operator,
+				Force:    *force,
+			})
 			if err != nil {
 				log.Fatal(err)
 			}
-			log.Println("credits granted")
+			recordCreditEntry(auditor, entry)
+			log.Printf("credits adjusted by %v, balance is now %v", entry.Amount, entry.BalanceAfter)
+		},
+	},
+	"credits": {
+		Blurb:         "manage the credit ledger",
+		Description:   "every change made to credits by tutil is recorded in the credit ledger with a reason code and note",
+		ChildRequired: true,
+		Children: map[string]cmd.Cmd{
+			"list": {
+				Blurb: "list the credit ledger of a user",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *user == "" {
+						log.Fatal("user flag is empty")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					entries, err := creditledger.NewLedger(db).Entries(*user)
+					if err != nil {
+						log.Fatal(err)
+					}
+					for _, entry := range entries {
+						fmt.Printf(
+							"%v\t%s\t%+g\t%v -> %v\t%s\t%s\t%s\n",
+							entry.ID, entry.CreatedAt.UTC().Format(time.RFC3339), entry.Amount,
+							entry.BalanceBefore, entry.BalanceAfter, entry.Reason, entry.Operator, entry.Note,
+						)
+					}
+				},
+			},
+			"reverse": {
+				Blurb:       "reverse a credit ledger entry",
+				Description: "reverse credits.entry by adjusting the balance by the opposite amount. Entries can only be reversed once, and force is required to leave a negative balance",
+				Action: func(cfg config.TemporalConfig, flags map[string]string) {
+					if *creditsEntry == 0 {
+						log.Fatal("credits.entry flag is empty")
+					}
+					db, err := newDB(&cfg, *dbNoSSL)
+					if err != nil {
+						log.Fatal(err)
+					}
+					auditor := newAuditor(db, "credits reverse")
+					entry, err := creditledger.NewLedger(db).Reverse(*creditsEntry, *operator, *note, *force)
+					if err != nil {
+						log.Fatal(err)
+					}
+					recordCreditEntry(auditor, entry)
+					log.Printf("reversed entry %v, balance is now %v", *creditsEntry, entry.BalanceAfter)
+				},
+			},
 		},
 	},
 }
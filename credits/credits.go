@@ -0,0 +1,224 @@
+// Package credits provides a ledger of every change
+// made to the credit balance of an account
+package credits
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+)
+
+// Reason codes categorise why credits were changed
+const (
+	ReasonPromo        = "promo"
+	ReasonRefund       = "refund"
+	ReasonPayment      = "payment"
+	ReasonCompensation = "compensation"
+	ReasonCorrection   = "correction"
+	// ReasonExtension is used for charges for extending pins
+	ReasonExtension = "extension"
+	// ReasonReversal is used for entries reversing an earlier
+	// entry, and can not be used for adjustments
+	ReasonReversal = "reversal"
+)
+
+// Reasons are the reason codes that can be used for adjustments
+var Reasons = []string{
+	ReasonPromo,
+	ReasonRefund,
+	ReasonPayment,
+	ReasonCompensation,
+	ReasonCorrection,
+	ReasonExtension,
+}
+
+var (
+	// ErrZeroAmount is returned when adjusting credits by nothing
+	ErrZeroAmount = errors.New("credit adjustment amount must not be zero")
+	// ErrNegativeBalance is returned when an adjustment would leave a negative balance
+	ErrNegativeBalance = errors.New("credit adjustment would result in a negative balance, force is required")
+	// ErrAlreadyReversed is returned when reversing an entry more than once
+	ErrAlreadyReversed = errors.New("credit entry has already been reversed")
+	// ErrReverseReversal is returned when reversing a reversal
+	ErrReverseReversal = errors.New("reversal entries can not be reversed, make an adjustment instead")
+)
+
+// ValidateReason is used to check that a reason code can be used for an adjustment
+func ValidateReason(reason string) error {
+	for _, r := range Reasons {
+		if r == reason {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid reason %q, must be one of %s", reason, strings.Join(Reasons, ", "))
+}
+
+// Entry is a record of a change to the credit balance of an account
+type Entry struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255);index"`
+	// Amount is the signed change in credits
+	Amount        float64 `gorm:"type:float"`
+	BalanceBefore float64 `gorm:"type:float"`
+	BalanceAfter  float64 `gorm:"type:float"`
+	Reason        string  `gorm:"type:varchar(255)"`
+	Note          string  `gorm:"type:text"`
+	Operator      string  `gorm:"type:varchar(255)"`
+	// ReversalOf is the ID of the entry this entry reverses, if any
+	ReversalOf uint `gorm:"index"`
+}
+
+// TableName sets the table used to store the credit ledger
+func (Entry) TableName() string {
+	return "credit_ledger"
+}
+
+// Adjustment is a change to make to the credit balance of an account
+type Adjustment struct {
+	UserName string
+	// Amount is the signed change in credits, negative amounts remove credits
+	Amount   float64
+	Reason   string
+	Note     string
+	Operator string
+	// Force allows the adjustment to leave a negative balance
+	Force bool
+}
+
+// Ledger is used to change credit balances, recording every change
+type Ledger struct {
+	db *gorm.DB
+}
+
+// NewLedger instantiates the credit ledger
+func NewLedger(db *gorm.DB) *Ledger {
+	return &Ledger{db: db}
+}
+
+// Adjust is used to change the credit balance of an account. The
+// balance change and its ledger entry are made in a single transaction.
+func (l *Ledger) Adjust(adj Adjustment) (*Entry, error) {
+	if err := ValidateReason(adj.Reason); err != nil {
+		return nil, err
+	}
+	tx := l.db.Begin()
+	entry, err := adjust(tx, adj, 0)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return entry, tx.Commit().Error
+}
+
+// AdjustTx is used to change the credit balance of an account within an
+// existing transaction, so the change can be made atomically with others
+func AdjustTx(tx *gorm.DB, adj Adjustment) (*Entry, error) {
+	if err := ValidateReason(adj.Reason); err != nil {
+		return nil, err
+	}
+	return adjust(tx, adj, 0)
+}
+
+// AdjustAll is used to make many adjustments in a single
+// transaction. If any adjustment fails, none are made.
+func (l *Ledger) AdjustAll(adjs []Adjustment) ([]*Entry, error) {
+	for _, adj := range adjs {
+		if err := ValidateReason(adj.Reason); err != nil {
+			return nil, err
+		}
+	}
+	tx := l.db.Begin()
+	entries := make([]*Entry, 0, len(adjs))
+	for _, adj := range adjs {
+		entry, err := adjust(tx, adj, 0)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to adjust credits of %s: %s", adj.UserName, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, tx.Commit().Error
+}
+
+// Reverse is used to undo a ledger entry, by adjusting the balance by the
+// opposite of its amount. An entry can only be reversed once.
+func (l *Ledger) Reverse(id uint, operator, note string, force bool) (*Entry, error) {
+	tx := l.db.Begin()
+	entry, err := reverse(tx, id, operator, note, force)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return entry, tx.Commit().Error
+}
+
+// Entries is used to list the ledger entries of a user, oldest first
+func (l *Ledger) Entries(username string) ([]Entry, error) {
+	var entries []Entry
+	if err := l.db.Where("user_name = ?", username).Order("id").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func reverse(tx *gorm.DB, id uint, operator, note string, force bool) (*Entry, error) {
+	original := Entry{}
+	if err := tx.First(&original, id).Error; err != nil {
+		return nil, err
+	}
+	if original.Reason == ReasonReversal {
+		return nil, ErrReverseReversal
+	}
+	var reversals int
+	if err := tx.Model(&Entry{}).Where("reversal_of = ?", id).Count(&reversals).Error; err != nil {
+		return nil, err
+	}
+	if reversals > 0 {
+		return nil, ErrAlreadyReversed
+	}
+	return adjust(tx, Adjustment{
+		UserName: original.UserName,
+		Amount:   -original.Amount,
+		Reason:   ReasonReversal,
+		Note:     note,
+		Operator: operator,
+		Force:    force,
+	}, id)
+}
+
+func adjust(tx *gorm.DB, adj Adjustment, reversalOf uint) (*Entry, error) {
+	if adj.Amount == 0 {
+		return nil, ErrZeroAmount
+	}
+	// lock the user so concurrent adjustments can't read a stale balance
+	user := models.User{}
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+		"user_name = ?", adj.UserName,
+	).First(&user).Error; err != nil {
+		return nil, err
+	}
+	balance := user.Credits + adj.Amount
+	if balance < 0 && !adj.Force {
+		return nil, ErrNegativeBalance
+	}
+	if err := tx.Model(&user).UpdateColumn("credits", balance).Error; err != nil {
+		return nil, err
+	}
+	entry := &Entry{
+		UserName:      adj.UserName,
+		Amount:        adj.Amount,
+		BalanceBefore: user.Credits,
+		BalanceAfter:  balance,
+		Reason:        adj.Reason,
+		Note:          adj.Note,
+		Operator:      adj.Operator,
+		ReversalOf:    reversalOf,
+	}
+	if err := tx.Create(entry).Error; err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
@@ -0,0 +1,98 @@
+package credits
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestValidateReason(t *testing.T) {
+	for _, reason := range Reasons {
+		if err := ValidateReason(reason); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, reason := range []string{"", ReasonReversal, "gift"} {
+		if err := ValidateReason(reason); err == nil {
+			t.Fatalf("expected reason %q to be invalid", reason)
+		}
+	}
+}
+
+func TestLedger(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Entry{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	usr, err := models.NewUserManager(db).NewUserAccount("testledgeruser", "password123", "testledgeruser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&Entry{})
+	ledger := NewLedger(db)
+	promo, err := ledger.Adjust(Adjustment{
+		UserName: usr.UserName, Amount: 10, Reason: ReasonPromo, Note: "launch promo", Operator: "tester",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promo.BalanceBefore != usr.Credits || promo.BalanceAfter != usr.Credits+10 {
+		t.Fatalf("bad balances: %+v", promo)
+	}
+	// removing more credits than the balance requires force
+	if _, err := ledger.Adjust(Adjustment{
+		UserName: usr.UserName, Amount: -(promo.BalanceAfter + 1), Reason: ReasonCorrection, Operator: "tester",
+	}); err != ErrNegativeBalance {
+		t.Fatal("expected negative balance to be refused")
+	}
+	if _, err := ledger.Adjust(Adjustment{
+		UserName: usr.UserName, Amount: 0, Reason: ReasonCorrection, Operator: "tester",
+	}); err != ErrZeroAmount {
+		t.Fatal("expected zero amount to be refused")
+	}
+	reversal, err := ledger.Reverse(promo.ID, "tester", "promo issued in error", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reversal.Amount != -10 || reversal.ReversalOf != promo.ID || reversal.BalanceAfter != usr.Credits {
+		t.Fatalf("bad reversal: %+v", reversal)
+	}
+	if _, err := ledger.Reverse(promo.ID, "tester", "", false); err != ErrAlreadyReversed {
+		t.Fatal("expected second reversal to be refused")
+	}
+	if _, err := ledger.Reverse(reversal.ID, "tester", "", false); err != ErrReverseReversal {
+		t.Fatal("expected reversal of a reversal to be refused")
+	}
+	entries, err := ledger.Entries(usr.UserName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Reason != ReasonPromo || entries[1].Reason != ReasonReversal {
+		t.Fatalf("bad entries: %+v", entries)
+	}
+	if credits, err := models.NewUserManager(db).GetCreditsForUser(usr.UserName); err != nil {
+		t.Fatal(err)
+	} else if credits != usr.Credits {
+		t.Fatal("expected balance to be restored")
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
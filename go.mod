@@ -4,12 +4,15 @@ go 1.13
 
 require (
 	github.com/RTradeLtd/cmd/v2 v2.1.0
+	github.com/RTradeLtd/config v2.0.5+incompatible
 	github.com/RTradeLtd/config/v2 v2.1.5
 	github.com/RTradeLtd/database/v2 v2.7.5
-	github.com/RTradeLtd/go-ipfs-api v0.0.0-20190523020607-76503b15fe41 // indirect
+	github.com/RTradeLtd/go-ipfs-api v0.0.0-20190523020607-76503b15fe41
 	github.com/RTradeLtd/rtfs/v2 v2.1.2
+	github.com/c2h5oh/datasize v0.0.0-20171227191756-4eba002a5eae
 	github.com/ipfs/go-ds-badger v0.0.6 // indirect
 	github.com/jinzhu/gorm v1.9.8
+	github.com/lib/pq v1.3.0
 	github.com/libp2p/go-libp2p-core v0.0.3 // indirect
 	github.com/libp2p/go-libp2p-metrics v0.1.0 // indirect
 	github.com/libp2p/go-libp2p-peer v0.2.0 // indirect
@@ -0,0 +1,138 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+// RecipientFilter is used to select the users who receive a broadcast
+type RecipientFilter struct {
+	// Tiers restricts recipients to the given account tiers, if empty all tiers are selected
+	Tiers []models.DataUsageTier
+	// EmailEnabled restricts recipients to users with email enabled
+	EmailEnabled bool
+	// HasUploads restricts recipients to users with at least one upload
+	HasUploads bool
+	// MinDataUsedBytes restricts recipients to users whose current data usage is at least this value
+	MinDataUsedBytes uint64
+}
+
+// Recipient is a user selected to receive a broadcast. It is
+// also the data made available to broadcast templates
+type Recipient struct {
+	UserName             string
+	EmailAddress         string
+	Tier                 models.DataUsageTier
+	CurrentDataUsedBytes uint64
+}
+
+// BroadcastResult summarizes the outcome of a broadcast
+type BroadcastResult struct {
+	Sent       int
+	Suppressed int
+	Failed     int
+}
+
+// FindRecipients is used to select all users with an enabled account matching the filter
+func (mm *Manager) FindRecipients(filter RecipientFilter) ([]Recipient, error) {
+	query := mm.db.Table("users").Select(
+		"users.user_name, users.email_address, usages.tier, usages.current_data_used_bytes",
+	).Joins(
+		"JOIN usages ON usages.user_name = users.user_name AND usages.deleted_at IS NULL",
+	).Where(
+		"users.deleted_at IS NULL AND users.account_enabled = ?", true,
+	)
+	if len(filter.Tiers) > 0 {
+		query = query.Where("usages.tier IN (?)", filter.Tiers)
+	}
+	if filter.EmailEnabled {
+		query = query.Where("users.email_enabled = ?", true)
+	}
+	if filter.HasUploads {
+		query = query.Where(
+			"EXISTS (SELECT 1 FROM uploads WHERE uploads.user_name = users.user_name AND uploads.deleted_at IS NULL)",
+		)
+	}
+	if filter.MinDataUsedBytes > 0 {
+		query = query.Where("usages.current_data_used_bytes >= ?", filter.MinDataUsedBytes)
+	}
+	var recipients []Recipient
+	if err := query.Order("users.id").Scan(&recipients).Error; err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+// Deliverable is used to separate the recipients a broadcast would be sent
+// to from those who are suppressed, so a dry run reports an accurate count
+func (mm *Manager) Deliverable(recipients []Recipient) (deliverable, suppressed []Recipient, err error) {
+	for _, r := range recipients {
+		isSuppressed, _, err := mm.IsSuppressed(r.EmailAddress)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isSuppressed {
+			suppressed = append(suppressed, r)
+			continue
+		}
+		deliverable = append(deliverable, r)
+	}
+	return deliverable, suppressed, nil
+}
+
+// RenderTemplate is used to render a broadcast template for the given recipient
+func RenderTemplate(tmpl *template.Template, recipient Recipient) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, recipient); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// CheckSendCap is used to refuse a broadcast to more deliverable
+// recipients than maxRecipients, to guard against accidental mass mailings
+func CheckSendCap(deliverable []Recipient, maxRecipients int) error {
+	if len(deliverable) > maxRecipients {
+		return fmt.Errorf(
+			"%v deliverable recipients exceeds send cap of %v", len(deliverable), maxRecipients,
+		)
+	}
+	return nil
+}
+
+// Broadcast is used to send a templated message to all recipients. To guard
+// against accidental mass mailings, nothing is sent if the number of
+// deliverable recipients exceeds maxRecipients. Suppressed recipients are
+// skipped, and individual delivery failures are logged and counted.
+func (mm *Manager) Broadcast(subject string, tmpl *template.Template, recipients []Recipient, maxRecipients int) (BroadcastResult, error) {
+	var result BroadcastResult
+	deliverable, suppressed, err := mm.Deliverable(recipients)
+	if err != nil {
+		return result, err
+	}
+	if err := CheckSendCap(deliverable, maxRecipients); err != nil {
+		return result, err
+	}
+	result.Suppressed = len(suppressed)
+	for _, r := range deliverable {
+		content, err := RenderTemplate(tmpl, r)
+		if err != nil {
+			return result, err
+		}
+		if _, err := mm.Send(NewMessage(subject, content), r.UserName, r.EmailAddress); err != nil {
+			if err == ErrRecipientSuppressed {
+				result.Suppressed++
+				continue
+			}
+			log.Printf("failed to send broadcast to %s: %s", r.UserName, err.Error())
+			result.Failed++
+			continue
+		}
+		result.Sent++
+	}
+	return result, nil
+}
@@ -23,6 +23,7 @@ type Manager struct {
 	EmailAddress string `json:"email_address"` // EmailAddress is the address from which messages will be sent from
 	EmailName    string `json:"email_name"`    // EmailName is the name of the email address
 
+	db          *gorm.DB
 	userManager *models.UserManager
 
 	client Mailer
@@ -44,37 +45,63 @@ func NewManager(tCfg *config.TemporalConfig, db *gorm.DB) (*Manager, error) {
 		EmailName:    emailName,
 
 		client:      client,
+		db:          db,
 		userManager: um,
 	}, nil
 }
 
-// BulkSend is used to handle sending a single email, to multiple recipients
+// BulkSend is used to handle sending a single email, to multiple recipients.
+// Suppressed recipients are skipped.
 func (mm *Manager) BulkSend(subject, content, contentType string, recipientNames, recipientEmails []string) error {
 	if len(recipientNames) != len(recipientEmails) {
 		return errors.New("recipientNames and recipientEmails must be fo equal length")
 	}
 	for k, v := range recipientEmails {
 		if _, err := mm.SendEmail(subject, content, contentType, recipientNames[k], v); err != nil {
+			if err == ErrRecipientSuppressed {
+				continue
+			}
 			return err
 		}
 	}
 	return nil
 }
 
-// SendEmail is used to send an email to temporal users
+// SendEmail is used to send an email to temporal users.
+// If the recipient is suppressed, ErrRecipientSuppressed is returned
+// and no message is sent. Html content is sent alongside a plain
+// text alternative.
 func (mm *Manager) SendEmail(subject, content, contentType, recipientName, recipientEmail string) (int, error) {
-	mm.cmux.Lock()
-	if contentType == "" {
-		contentType = "text/html"
+	var msg *Message
+	switch contentType {
+	case "", "text/html":
+		msg = NewMessage(subject, content)
+	default:
+		msg = (&Message{Subject: subject}).AddContent(contentType, content)
 	}
+	return mm.Send(msg, recipientName, recipientEmail)
+}
 
+// Send is used to send a message, which may contain multiple content
+// parts and attachments, to temporal users. If the recipient is suppressed,
+// ErrRecipientSuppressed is returned and no message is sent.
+func (mm *Manager) Send(msg *Message, recipientName, recipientEmail string) (int, error) {
+	if err := msg.Validate(); err != nil {
+		return -1, err
+	}
+	suppressed, _, err := mm.IsSuppressed(recipientEmail)
+	if err != nil {
+		return -1, err
+	}
+	if suppressed {
+		return -1, ErrRecipientSuppressed
+	}
 	var (
-		from    = mail.NewEmail(mm.EmailName, mm.EmailAddress)
-		to      = mail.NewEmail(recipientName, recipientEmail)
-		message = mail.NewContent(contentType, content)
+		from = mail.NewEmail(mm.EmailName, mm.EmailAddress)
+		to   = mail.NewEmail(recipientName, recipientEmail)
 	)
-
-	response, err := mm.client.Send(mail.NewV3MailInit(from, subject, to, message))
+	mm.cmux.Lock()
+	response, err := mm.client.Send(msg.build(from, to))
 	mm.cmux.Unlock()
 	if err != nil {
 		return -1, err
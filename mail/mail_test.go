@@ -2,11 +2,13 @@ package mail_test
 
 import (
 	"fmt"
+	"html/template"
 	"os"
 	"testing"
 
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2"
+	"github.com/RTradeLtd/database/v2/models"
 	"github.com/RTradeLtd/tutil/mail"
 )
 
@@ -29,6 +31,9 @@ func TestMail(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := dbm.DB.AutoMigrate(&mail.Suppression{}).Error; err != nil {
+		t.Fatal(err)
+	}
 	if cfg.Sendgrid.APIKey == "" {
 		cfg.Sendgrid.APIKey = os.Getenv("SENDGRID_API_KEY")
 		cfg.Sendgrid.EmailAddress = "temporal@rtradetechnologies.com"
@@ -67,3 +72,169 @@ func TestMail(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestSuppression(t *testing.T) {
+	cfg, err := config.LoadConfig(testCfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbm, err := database.New(cfg, database.Options{
+		SSLModeDisable: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbm.DB.AutoMigrate(&mail.Suppression{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	mm, err := mail.NewManager(cfg, dbm.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.Suppress(testRecipientEmail2, "notareason"); err != mail.ErrInvalidReason {
+		t.Fatal("expected invalid reason error")
+	}
+	if err := mm.Suppress(testRecipientEmail2, mail.ReasonBounce); err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Where("email_address = ?", testRecipientEmail2).Delete(&mail.Suppression{})
+	if suppressed, reason, err := mm.IsSuppressed(testRecipientEmail2); err != nil {
+		t.Fatal(err)
+	} else if !suppressed || reason != mail.ReasonBounce {
+		t.Fatal("expected recipient to be suppressed due to bounce")
+	}
+	if _, err := mm.SendEmail(
+		"testEmail", "content", "", testRecipientName2, testRecipientEmail2,
+	); err != mail.ErrRecipientSuppressed {
+		t.Fatal("expected suppressed recipient error")
+	}
+	if _, err := mm.SendEmail(
+		"testEmail", "content", "", testRecipientName2, "abc@"+mail.DeletedUserDomain,
+	); err != mail.ErrRecipientSuppressed {
+		t.Fatal("expected suppressed recipient error for deleted user")
+	}
+	deliverable, suppressed, err := mm.Deliverable([]mail.Recipient{
+		{UserName: testRecipientName1, EmailAddress: testRecipientEmail1},
+		{UserName: testRecipientName2, EmailAddress: testRecipientEmail2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliverable) != 1 || len(suppressed) != 1 || suppressed[0].EmailAddress != testRecipientEmail2 {
+		t.Fatalf("expected only %s to be suppressed, got %+v", testRecipientEmail2, suppressed)
+	}
+	if err := mm.Unsuppress(testRecipientEmail2); err != nil {
+		t.Fatal(err)
+	}
+	if suppressed, _, err := mm.IsSuppressed(testRecipientEmail2); err != nil {
+		t.Fatal(err)
+	} else if suppressed {
+		t.Fatal("expected recipient to no longer be suppressed")
+	}
+	// suppressing a previously removed address should succeed
+	if err := mm.Suppress(testRecipientEmail2, mail.ReasonBlocklist); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsDeletedUserAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"abcdef@deleteduser.org", true},
+		{" ABCDEF@DeletedUser.org ", true},
+		{"user@example.org", false},
+		{"user@notdeleteduser.org", false},
+	}
+	for _, tt := range tests {
+		if got := mail.IsDeletedUserAddress(tt.address); got != tt.want {
+			t.Errorf("IsDeletedUserAddress(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"breaks", "<br>WowSuchEmail<br>WowSuchFormat", "WowSuchEmail\nWowSuchFormat"},
+		{"list", "hashes:<ul><li>hash1</li><li>hash2</li></ul>", "hashes:\n- hash1\n- hash2"},
+		{"entities", "<p>a &amp; b</p>", "a & b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mail.HTMLToText(tt.html); got != tt.want {
+				t.Errorf("HTMLToText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg := mail.NewMessage("subject", "<p>hello</p>")
+	if len(msg.Contents) != 2 {
+		t.Fatal("expected plain text and html content")
+	}
+	if msg.Contents[0].Type != "text/plain" || msg.Contents[0].Value != "hello" {
+		t.Fatal("bad plain text content")
+	}
+	msg.Attach("pins.csv", "text/csv", []byte("hash\n")).
+		AttachInline("logo", "logo.png", "image/png", []byte{0x89, 0x50})
+	if err := msg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Attach("", "text/csv", nil).Validate(); err == nil {
+		t.Fatal("expected error for attachment without filename")
+	}
+	if err := (&mail.Message{Subject: "empty"}).Validate(); err == nil {
+		t.Fatal("expected error for message without content")
+	}
+	large := mail.NewMessage("subject", "content").
+		Attach("large.bin", "application/octet-stream", make([]byte, mail.MaxMessageSize))
+	if err := large.Validate(); err == nil {
+		t.Fatal("expected error for oversized message")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	tmpl, err := template.New("broadcast").Parse(
+		"<p>Hello {{.UserName}}, your {{.Tier}} account uses {{.CurrentDataUsedBytes}} bytes</p>",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipients := []mail.Recipient{
+		{UserName: "<b>user1</b>", EmailAddress: testRecipientEmail1, Tier: models.Paid, CurrentDataUsedBytes: 10},
+		{UserName: "user2", EmailAddress: testRecipientEmail2, Tier: models.Free},
+	}
+	content, err := mail.RenderTemplate(tmpl, recipients[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "<p>Hello &lt;b&gt;user1&lt;/b&gt;, your paid account uses 10 bytes</p>" {
+		t.Fatalf("bad rendered template: %s", content)
+	}
+	mm, err := mail.NewManager(&config.TemporalConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mail.CheckSendCap(recipients, 1); err == nil {
+		t.Fatal("expected error when exceeding send cap")
+	}
+	if err := mail.CheckSendCap(recipients, 2); err != nil {
+		t.Fatal(err)
+	}
+	// suppressed recipients don't count towards the send cap
+	deleted := []mail.Recipient{
+		{UserName: "deleted1", EmailAddress: "deleted1@" + mail.DeletedUserDomain},
+		{UserName: "deleted2", EmailAddress: "deleted2@" + mail.DeletedUserDomain},
+	}
+	if result, err := mm.Broadcast("subject", tmpl, deleted, 1); err != nil {
+		t.Fatal(err)
+	} else if result.Suppressed != 2 || result.Sent != 0 {
+		t.Fatalf("expected every recipient to be suppressed, got %+v", result)
+	}
+}
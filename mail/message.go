@@ -0,0 +1,157 @@
+package mail
+
+import (
+	"encoding/base64"
+	"errors"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/sendgrid/sendgrid-go/helpers/mail"
+)
+
+// MaxMessageSize is the maximum combined size in bytes of
+// all content and attachments in a single message
+const MaxMessageSize = 30 * 1024 * 1024
+
+// Content is a single part of a message body
+type Content struct {
+	Type  string
+	Value string
+}
+
+// Attachment is a file attached to a message. If ContentID is set the
+// attachment is sent inline, and can be referenced from html content
+// with `<img src="cid:ContentID">`
+type Attachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+// Message is an email made up of one or more content parts, and optional attachments
+type Message struct {
+	Subject     string
+	Contents    []Content
+	Attachments []Attachment
+}
+
+// NewMessage is used to create a message with html content, and a plain text
+// alternative derived from the html. Sending both parts keeps mail clients
+// from flagging our messages as spam.
+func NewMessage(subject, htmlContent string) *Message {
+	return (&Message{Subject: subject}).
+		AddContent("text/plain", HTMLToText(htmlContent)).
+		AddContent("text/html", htmlContent)
+}
+
+// AddContent is used to add a content part to the message
+func (m *Message) AddContent(contentType, value string) *Message {
+	m.Contents = append(m.Contents, Content{Type: contentType, Value: value})
+	return m
+}
+
+// Attach is used to attach a file to the message
+func (m *Message) Attach(filename, contentType string, data []byte) *Message {
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Data:        data,
+	})
+	return m
+}
+
+// AttachInline is used to attach a file, such as an image, that is
+// displayed within the html content of the message
+func (m *Message) AttachInline(contentID, filename, contentType string, data []byte) *Message {
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		ContentID:   contentID,
+		Data:        data,
+	})
+	return m
+}
+
+// Validate is used to check that the message can be delivered
+func (m *Message) Validate() error {
+	if len(m.Contents) == 0 {
+		return errors.New("message has no content")
+	}
+	var size int
+	for _, c := range m.Contents {
+		if c.Type == "" {
+			return errors.New("message content is missing a content type")
+		}
+		size += len(c.Value)
+	}
+	for _, a := range m.Attachments {
+		if a.Filename == "" {
+			return errors.New("attachment is missing a filename")
+		}
+		if a.ContentType == "" {
+			return errors.New("attachment is missing a content type")
+		}
+		size += len(a.Data)
+	}
+	if size > MaxMessageSize {
+		return errors.New("message exceeds maximum size")
+	}
+	return nil
+}
+
+// build converts the message into a sendgrid message. Plain text content
+// is always placed first, as required by sendgrid.
+func (m *Message) build(from, to *mail.Email) *mail.SGMailV3 {
+	msg := mail.NewV3Mail()
+	msg.SetFrom(from)
+	msg.Subject = m.Subject
+	p := mail.NewPersonalization()
+	p.AddTos(to)
+	msg.AddPersonalizations(p)
+	for _, c := range m.Contents {
+		if c.Type == "text/plain" {
+			msg.AddContent(mail.NewContent(c.Type, c.Value))
+		}
+	}
+	for _, c := range m.Contents {
+		if c.Type != "text/plain" {
+			msg.AddContent(mail.NewContent(c.Type, c.Value))
+		}
+	}
+	for _, a := range m.Attachments {
+		att := mail.NewAttachment().
+			SetFilename(a.Filename).
+			SetType(a.ContentType).
+			SetContent(base64.StdEncoding.EncodeToString(a.Data))
+		if a.ContentID != "" {
+			att.SetDisposition("inline").SetContentID(a.ContentID)
+		} else {
+			att.SetDisposition("attachment")
+		}
+		msg.AddAttachment(att)
+	}
+	return msg
+}
+
+var (
+	htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</h[1-6]>|</tr>|</?[uo]l[^>]*>`)
+	htmlItems  = regexp.MustCompile(`(?i)<li[^>]*>`)
+	htmlTags   = regexp.MustCompile(`<[^>]*>`)
+	blankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// HTMLToText is used to derive a plain text alternative of html content
+func HTMLToText(content string) string {
+	text := htmlBreaks.ReplaceAllString(content, "\n")
+	text = htmlItems.ReplaceAllString(text, "- ")
+	text = htmlTags.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,142 @@
+package mail
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DeletedUserDomain is the domain assigned to accounts anonymized for GDPR compliance
+	DeletedUserDomain = "deleteduser.org"
+
+	// ReasonBounce indicates the recipient hard bounced a previous message
+	ReasonBounce = "bounce"
+	// ReasonUnsubscribe indicates the recipient asked to stop receiving email
+	ReasonUnsubscribe = "unsubscribe"
+	// ReasonBlocklist indicates the recipient was manually blocked by an operator
+	ReasonBlocklist = "blocklist"
+	// ReasonDeletedUser indicates the recipient belongs to a deleted account
+	ReasonDeletedUser = "deleted-user"
+	// ReasonDisabledUser indicates the recipient belongs to an account with
+	// either email or the account itself disabled
+	ReasonDisabledUser = "disabled-user"
+)
+
+var (
+	// ErrRecipientSuppressed is returned when attempting to email a suppressed recipient
+	ErrRecipientSuppressed = errors.New("recipient is on the suppression list")
+	// ErrInvalidReason is returned when suppressing with an unknown reason
+	ErrInvalidReason = errors.New("invalid suppression reason, must be one of bounce, unsubscribe, blocklist")
+)
+
+// Suppression is an email address we must never send messages to
+type Suppression struct {
+	gorm.Model
+	EmailAddress string `gorm:"type:varchar(255);unique"`
+	Reason       string `gorm:"type:varchar(255)"`
+}
+
+// Suppress is used to add an email address to the suppression list
+func (mm *Manager) Suppress(emailAddress, reason string) error {
+	switch reason {
+	case ReasonBounce, ReasonUnsubscribe, ReasonBlocklist:
+	default:
+		return ErrInvalidReason
+	}
+	emailAddress = normalizeAddress(emailAddress)
+	if emailAddress == "" {
+		return errors.New("email address is empty")
+	}
+	sup := Suppression{}
+	if err := mm.db.Unscoped().Where(
+		"email_address = ?", emailAddress,
+	).First(&sup).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return err
+	}
+	// re-use any previously removed entry to honor the unique constraint
+	sup.EmailAddress = emailAddress
+	sup.Reason = reason
+	sup.DeletedAt = nil
+	return mm.db.Unscoped().Save(&sup).Error
+}
+
+// Unsuppress is used to remove an email address from the suppression list
+func (mm *Manager) Unsuppress(emailAddress string) error {
+	check := mm.db.Where(
+		"email_address = ?", normalizeAddress(emailAddress),
+	).Delete(&Suppression{})
+	if check.Error != nil {
+		return check.Error
+	}
+	if check.RowsAffected == 0 {
+		return errors.New("email address is not suppressed")
+	}
+	return nil
+}
+
+// EraseSuppression is used to permanently delete the suppression of an
+// email address, including removed entries, such as when erasing the user
+// of the address. The number of entries deleted is returned
+func EraseSuppression(db *gorm.DB, emailAddress string) (int, error) {
+	emailAddress = normalizeAddress(emailAddress)
+	if emailAddress == "" {
+		return 0, nil
+	}
+	check := db.Unscoped().Where("email_address = ?", emailAddress).Delete(&Suppression{})
+	return int(check.RowsAffected), check.Error
+}
+
+// Suppressions returns all manually suppressed email addresses
+func (mm *Manager) Suppressions() ([]Suppression, error) {
+	var sups []Suppression
+	if err := mm.db.Order("created_at").Find(&sups).Error; err != nil {
+		return nil, err
+	}
+	return sups, nil
+}
+
+// IsSuppressed is used to check whether we are allowed to send email to the
+// given address. If the address is suppressed, the reason is returned.
+//
+// An address is suppressed if it belongs to an account deleted for GDPR
+// compliance, is on the suppression list, or belongs to an account which
+// has email or the account itself disabled.
+func (mm *Manager) IsSuppressed(emailAddress string) (bool, string, error) {
+	if IsDeletedUserAddress(emailAddress) {
+		return true, ReasonDeletedUser, nil
+	}
+	sup := Suppression{}
+	err := mm.db.Where("email_address = ?", normalizeAddress(emailAddress)).First(&sup).Error
+	switch err {
+	case nil:
+		return true, sup.Reason, nil
+	case gorm.ErrRecordNotFound:
+	default:
+		return false, "", err
+	}
+	// addresses without an account, such as operators, are allowed
+	user, err := mm.userManager.FindByEmail(strings.TrimSpace(emailAddress))
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		return false, "", nil
+	default:
+		return false, "", err
+	}
+	if !user.AccountEnabled || !user.EmailEnabled {
+		return true, ReasonDisabledUser, nil
+	}
+	return false, "", nil
+}
+
+// IsDeletedUserAddress returns whether the email address belongs
+// to an account that was anonymized for GDPR compliance
+func IsDeletedUserAddress(emailAddress string) bool {
+	return strings.HasSuffix(normalizeAddress(emailAddress), "@"+DeletedUserDomain)
+}
+
+func normalizeAddress(emailAddress string) string {
+	return strings.ToLower(strings.TrimSpace(emailAddress))
+}
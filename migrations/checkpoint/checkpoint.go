@@ -0,0 +1,126 @@
+// Package checkpoint provides persistent progress tracking for long running
+// migrations, allowing an interrupted migration to resume where it stopped
+package checkpoint
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrNoCheckpoints is returned when using checkpoints before the checkpoint table is created
+var ErrNoCheckpoints = errors.New("checkpoint table does not exist, run migrations up")
+
+// Checkpoint is the persisted progress of a long running migration
+type Checkpoint struct {
+	Name string `gorm:"primary_key;type:varchar(255)"`
+	// Cursor is the ID of the last processed record
+	Cursor    uint
+	UpdatedAt time.Time
+}
+
+// TableName sets the name of the checkpoint table
+func (Checkpoint) TableName() string {
+	return "tutil_migration_checkpoints"
+}
+
+// Store is used to persist checkpoints
+type Store struct {
+	db *gorm.DB
+}
+
+// NewStore is used to instantiate a checkpoint store
+func NewStore(db *gorm.DB) (*Store, error) {
+	if !db.HasTable(&Checkpoint{}) {
+		return nil, ErrNoCheckpoints
+	}
+	return &Store{db: db}, nil
+}
+
+// Load returns the cursor of the named checkpoint, or 0 if none exists
+func (s *Store) Load(name string) (uint, error) {
+	cp := Checkpoint{}
+	err := s.db.Where("name = ?", name).First(&cp).Error
+	switch err {
+	case nil:
+		return cp.Cursor, nil
+	case gorm.ErrRecordNotFound:
+		return 0, nil
+	default:
+		return 0, err
+	}
+}
+
+// Save is used to persist the cursor of the named checkpoint
+func (s *Store) Save(name string, cursor uint) error {
+	return s.db.Save(&Checkpoint{Name: name, Cursor: cursor}).Error
+}
+
+// Clear is used to remove the named checkpoint once a migration completes
+func (s *Store) Clear(name string) error {
+	return s.db.Where("name = ?", name).Delete(&Checkpoint{}).Error
+}
+
+// Progress tracks, and periodically logs, the progress of a migration
+type Progress struct {
+	Name      string
+	Total     int
+	Processed int
+	// Interval is the minimum time between progress logs
+	Interval time.Duration
+
+	start          time.Time
+	startProcessed int
+	lastLog        time.Time
+}
+
+// NewProgress is used to track the progress of a migration over total
+// records, of which processed have been handled by a previous run
+func NewProgress(name string, total, processed int) *Progress {
+	now := time.Now()
+	return &Progress{
+		Name:           name,
+		Total:          total,
+		Processed:      processed,
+		Interval:       time.Second * 10,
+		start:          now,
+		startProcessed: processed,
+		lastLog:        now,
+	}
+}
+
+// Add records n more processed records, logging progress if the interval elapsed
+func (p *Progress) Add(n int) {
+	p.Processed += n
+	if time.Since(p.lastLog) >= p.Interval || p.Processed >= p.Total {
+		p.lastLog = time.Now()
+		log.Println(p.String())
+	}
+}
+
+// ETA returns the estimated time remaining, based on
+// the rate of processing since the progress started
+func (p *Progress) ETA() time.Duration {
+	done := p.Processed - p.startProcessed
+	remaining := p.Total - p.Processed
+	if done <= 0 || remaining <= 0 {
+		return 0
+	}
+	perRecord := time.Since(p.start) / time.Duration(done)
+	return (perRecord * time.Duration(remaining)).Truncate(time.Second)
+}
+
+// String formats the progress for logging
+func (p *Progress) String() string {
+	var percent float64
+	if p.Total > 0 {
+		percent = float64(p.Processed) / float64(p.Total) * 100
+	}
+	return fmt.Sprintf(
+		"%s: processed %v/%v (%.1f%%), eta %s",
+		p.Name, p.Processed, p.Total, percent, p.ETA(),
+	)
+}
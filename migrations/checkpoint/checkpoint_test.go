@@ -0,0 +1,80 @@
+package checkpoint
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestProgress(t *testing.T) {
+	p := NewProgress("test", 100, 20)
+	p.Interval = time.Hour
+	if p.ETA() != 0 {
+		t.Fatal("expected no eta before processing")
+	}
+	// pretend the first 20 records of this run took 20 seconds
+	p.start = p.start.Add(-time.Second * 20)
+	p.Add(20)
+	if p.Processed != 40 {
+		t.Fatal("bad processed count")
+	}
+	if eta := p.ETA(); eta < time.Second*59 || eta > time.Second*61 {
+		t.Fatalf("bad eta: %s", eta)
+	}
+	if got := p.String(); got[:30] != "test: processed 40/100 (40.0%)" {
+		t.Fatalf("bad progress string: %s", got)
+	}
+}
+
+func TestStore(t *testing.T) {
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Checkpoint{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Clear("test-checkpoint")
+	if cursor, err := store.Load("test-checkpoint"); err != nil {
+		t.Fatal(err)
+	} else if cursor != 0 {
+		t.Fatal("expected empty checkpoint")
+	}
+	for _, want := range []uint{10, 20} {
+		if err := store.Save("test-checkpoint", want); err != nil {
+			t.Fatal(err)
+		}
+		if cursor, err := store.Load("test-checkpoint"); err != nil {
+			t.Fatal(err)
+		} else if cursor != want {
+			t.Fatalf("expected cursor %v, got %v", want, cursor)
+		}
+	}
+	if err := store.Clear("test-checkpoint"); err != nil {
+		t.Fatal(err)
+	}
+	if cursor, err := store.Load("test-checkpoint"); err != nil {
+		t.Fatal(err)
+	} else if cursor != 0 {
+		t.Fatal("expected cleared checkpoint")
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
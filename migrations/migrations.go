@@ -0,0 +1,218 @@
+// Package migrations provides versioned database migrations, tracking
+// which migrations have been applied in the tutil_migrations table
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Migration is a versioned change to the database
+type Migration struct {
+	// ID uniquely identifies the migration, migrations are applied in order of ID
+	ID          string
+	Description string
+	Up          func(db *gorm.DB) error
+	// Down reverts the migration, and is nil if the migration is irreversible
+	Down func(db *gorm.DB) error
+	// Baseline is whether the migration was applied to existing deployments
+	// before migrations were tracked. Baseline migrations are recorded as
+	// applied, without being run, when the tracking table is created.
+	Baseline bool
+}
+
+// Record is the row stored for every applied migration
+type Record struct {
+	ID        string `gorm:"primary_key;type:varchar(255)"`
+	AppliedAt time.Time
+}
+
+// TableName sets the name of the migration tracking table
+func (Record) TableName() string {
+	return "tutil_migrations"
+}
+
+// Status is the state of a single migration
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies and reverts migrations
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// New is used to instantiate a migrator for the given migrations,
+// creating the migration tracking table if needed. When the table is
+// created, baseline migrations are recorded as applied.
+func New(db *gorm.DB, migrations []Migration) (*Migrator, error) {
+	if err := validate(migrations); err != nil {
+		return nil, err
+	}
+	created := !db.HasTable(&Record{})
+	if err := db.AutoMigrate(&Record{}).Error; err != nil {
+		return nil, err
+	}
+	m := &Migrator{db: db, migrations: migrations}
+	if created {
+		for _, id := range baseline(migrations) {
+			if err := m.record(id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// Status returns the state of all migrations
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		rec, ok := applied[mig.ID]
+		statuses = append(statuses, Status{
+			Migration: mig,
+			Applied:   ok,
+			AppliedAt: rec.AppliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+// Up is used to apply all pending migrations up to and including target.
+// If target is empty all pending migrations are applied. The IDs of
+// applied migrations are returned.
+func (m *Migrator) Up(target string) ([]string, error) {
+	if target != "" {
+		if _, err := m.find(target); err != nil {
+			return nil, err
+		}
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var ran []string
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.ID]; !ok {
+			if err := mig.Up(m.db); err != nil {
+				return ran, fmt.Errorf("migration %s failed: %s", mig.ID, err.Error())
+			}
+			if err := m.record(mig.ID); err != nil {
+				return ran, err
+			}
+			ran = append(ran, mig.ID)
+		}
+		if mig.ID == target {
+			break
+		}
+	}
+	return ran, nil
+}
+
+// Down is used to revert the most recently applied migration. If id is
+// not empty, it must match the most recently applied migration. The ID
+// of the reverted migration is returned.
+func (m *Migrator) Down(id string) (string, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return "", err
+	}
+	var latest *Migration
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if _, ok := applied[m.migrations[i].ID]; ok {
+			latest = &m.migrations[i]
+			break
+		}
+	}
+	if latest == nil {
+		return "", errors.New("no migrations have been applied")
+	}
+	if id != "" && id != latest.ID {
+		return "", fmt.Errorf("only the latest applied migration %s can be reverted", latest.ID)
+	}
+	if latest.Down == nil {
+		return "", fmt.Errorf("migration %s is irreversible", latest.ID)
+	}
+	if err := latest.Down(m.db); err != nil {
+		return "", fmt.Errorf("reverting migration %s failed: %s", latest.ID, err.Error())
+	}
+	return latest.ID, m.db.Delete(&Record{ID: latest.ID}).Error
+}
+
+// Mark is used to record a migration as applied without running it.
+// This is intended for migrations applied before they were tracked.
+func (m *Migrator) Mark(id string) error {
+	if _, err := m.find(id); err != nil {
+		return err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	if _, ok := applied[id]; ok {
+		return fmt.Errorf("migration %s is already applied", id)
+	}
+	return m.record(id)
+}
+
+func (m *Migrator) find(id string) (*Migration, error) {
+	for i := range m.migrations {
+		if m.migrations[i].ID == id {
+			return &m.migrations[i], nil
+		}
+	}
+	return nil, fmt.Errorf("migration %s does not exist", id)
+}
+
+func (m *Migrator) applied() (map[string]Record, error) {
+	var records []Record
+	if err := m.db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[string]Record, len(records))
+	for _, rec := range records {
+		applied[rec.ID] = rec
+	}
+	return applied, nil
+}
+
+func (m *Migrator) record(id string) error {
+	return m.db.Create(&Record{ID: id, AppliedAt: time.Now().UTC()}).Error
+}
+
+// baseline returns the IDs of the baseline migrations
+func baseline(migrations []Migration) []string {
+	var ids []string
+	for _, mig := range migrations {
+		if mig.Baseline {
+			ids = append(ids, mig.ID)
+		}
+	}
+	return ids
+}
+
+// validate ensures migrations have unique IDs, are sorted, and can be applied
+func validate(migrations []Migration) error {
+	for i, mig := range migrations {
+		if mig.ID == "" {
+			return errors.New("migration is missing an id")
+		}
+		if mig.Up == nil {
+			return fmt.Errorf("migration %s has no up function", mig.ID)
+		}
+		if i > 0 && migrations[i-1].ID >= mig.ID {
+			return fmt.Errorf("migration %s is out of order or duplicated", mig.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/tutil/audit"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestValidate(t *testing.T) {
+	up := func(*gorm.DB) error { return nil }
+	tests := []struct {
+		name       string
+		migrations []Migration
+		wantErr    bool
+	}{
+		{"registry", All, false},
+		{"ordered", []Migration{{ID: "0001", Up: up}, {ID: "0002", Up: up}}, false},
+		{"missing id", []Migration{{Up: up}}, true},
+		{"missing up", []Migration{{ID: "0001"}}, true},
+		{"duplicate", []Migration{{ID: "0001", Up: up}, {ID: "0001", Up: up}}, true},
+		{"unordered", []Migration{{ID: "0002", Up: up}, {ID: "0001", Up: up}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validate(tt.migrations); (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	// the apr 17 verification must never be re-run by a first migrations up
+	if ids := baseline(All); len(ids) != 1 || ids[0] != "0001-verify-unverified-users" {
+		t.Fatalf("unexpected baseline migrations %v", ids)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ups, downs int
+	testMigrations := []Migration{
+		{
+			ID: "test-0001",
+			Up: func(*gorm.DB) error { ups++; return nil },
+		},
+		{
+			ID:   "test-0002",
+			Up:   func(*gorm.DB) error { ups++; return nil },
+			Down: func(*gorm.DB) error { downs++; return nil },
+		},
+		{
+			ID: "test-0003",
+			Up: func(*gorm.DB) error { return errors.New("failed") },
+		},
+	}
+	migrator, err := New(db, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Where("id LIKE ?", "test-%").Delete(&Record{})
+	if ran, err := migrator.Up("test-0002"); err != nil {
+		t.Fatal(err)
+	} else if len(ran) != 2 || ups != 2 {
+		t.Fatal("expected two migrations to be applied")
+	}
+	// applied migrations are not run again
+	if ran, err := migrator.Up("test-0002"); err != nil {
+		t.Fatal(err)
+	} else if len(ran) != 0 || ups != 2 {
+		t.Fatal("expected no migrations to be applied")
+	}
+	if _, err := migrator.Up(""); err == nil {
+		t.Fatal("expected failing migration to return an error")
+	}
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Applied || !statuses[1].Applied || statuses[2].Applied {
+		t.Fatalf("bad migration status: %+v", statuses)
+	}
+	if _, err := migrator.Down("test-0001"); err == nil {
+		t.Fatal("expected error reverting migration which is not the latest")
+	}
+	if id, err := migrator.Down(""); err != nil {
+		t.Fatal(err)
+	} else if id != "test-0002" || downs != 1 {
+		t.Fatal("expected test-0002 to be reverted")
+	}
+	if _, err := migrator.Down(""); err == nil {
+		t.Fatal("expected error reverting irreversible migration")
+	}
+	if err := migrator.Mark("test-0003"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Mark("test-0003"); err == nil {
+		t.Fatal("expected error marking applied migration")
+	}
+}
+
+func TestUpEmptySchema(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const schema = "tutil_empty_schema_test"
+	if err := db.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP SCHEMA " + schema + " CASCADE")
+	// a deployment which has never run tutil migrations has no audit log
+	empty, err := gorm.Open("postgres", fmt.Sprintf(
+		"host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable search_path=%s",
+		cfg.Database.Port, cfg.Database.Password, schema,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if _, err := audit.New(empty, "tester", "migrations up", nil); err != audit.ErrNoAuditLog {
+		t.Fatalf("expected ErrNoAuditLog, got %v", err)
+	}
+	migrator, err := New(empty, All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran, err := migrator.Up("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the baseline verification is recorded rather than run
+	if len(ran) != len(All)-1 {
+		t.Fatalf("expected every migration but the baseline to be applied, got %v", ran)
+	}
+	// the migrations are recorded once the audit log exists
+	if _, err := audit.New(empty, "tester", "migrations up", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
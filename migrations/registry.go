@@ -0,0 +1,80 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/RTradeLtd/tutil/audit"
+	"github.com/RTradeLtd/tutil/credits"
+	"github.com/RTradeLtd/tutil/mail"
+	"github.com/RTradeLtd/tutil/migrations/checkpoint"
+	"github.com/RTradeLtd/tutil/migrations/user"
+	"github.com/RTradeLtd/tutil/pin"
+	"github.com/RTradeLtd/tutil/suspension"
+	"github.com/RTradeLtd/tutil/takedown"
+	"github.com/RTradeLtd/tutil/tier"
+	usermgmt "github.com/RTradeLtd/tutil/user"
+	"github.com/jinzhu/gorm"
+)
+
+// All is every migration known to tutil, in the order they are applied.
+// New migrations must be appended with an ID greater than the last.
+var All = []Migration{
+	{
+		ID:          "0001-verify-unverified-users",
+		Description: "verify all unverified user accounts for apr 17 migration",
+		// run by hand on existing deployments before migrations were tracked
+		Baseline: true,
+		Up: func(db *gorm.DB) error {
+			// the checkpoint table is created by a later migration, without
+			// it an interrupted verification restarts from the beginning. The
+			// checkpoint is named after the migration, so it isn't resumed by
+			// the user verify-unverified command, nor resumes one of its runs
+			opts := user.VerifyOptions{Checkpoint: "0001-verify-unverified-users"}
+			if db.HasTable(&checkpoint.Checkpoint{}) {
+				checkpoints, err := checkpoint.NewStore(db)
+				if err != nil {
+					return err
+				}
+				opts.Checkpoints = checkpoints
+			}
+			result, err := user.NewUserMigration(db).VerifyUsers(opts)
+			if err != nil {
+				return err
+			}
+			log.Printf("verified %v users", result.Processed)
+			return nil
+		},
+	},
+	createTable("0002-create-suppressions", "create the email suppression list table", &mail.Suppression{}),
+	createTable("0003-create-webhooks", "create the pin reminder webhook table", &pin.Webhook{}),
+	createTable("0004-create-tier-changes", "create the account tier change history table", &tier.Change{}),
+	createTable("0005-create-credit-ledger", "create the credit ledger table", &credits.Entry{}),
+	createTable("0006-create-pin-extensions", "create the pin extension history table", &pin.Extension{}),
+	createTable("0007-create-takedown-blocklist", "create the takedown blocklist table", &takedown.Block{}),
+	createTable("0008-create-account-suspensions", "create the account suspension history table, required by garbage collection", &suspension.Suspension{}),
+	createTable("0009-create-user-deletion-requests", "create the scheduled user deletion table", &usermgmt.DeletionRequest{}),
+	createTable("0010-create-orphan-sightings", "create the table recording when unreferenced pins were first seen, required by pin orphans", &pin.OrphanSighting{}),
+	{
+		ID:          "0011-create-audit-log",
+		Description: "create the operator audit log table, required by every command making changes",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&audit.Entry{}).Error
+		},
+		// the audit log is append only, so is never dropped
+	},
+	createTable("0012-create-migration-checkpoints", "create the table used to resume interrupted migrations", &checkpoint.Checkpoint{}),
+}
+
+// createTable returns a migration creating the table of the given model
+func createTable(id, description string, model interface{}) Migration {
+	return Migration{
+		ID:          id,
+		Description: description,
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(model).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(model).Error
+		},
+	}
+}
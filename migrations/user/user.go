@@ -1,12 +1,30 @@
 package user
 
 import (
+	"errors"
 	"log"
+	"sort"
 
 	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/migrations/checkpoint"
 	"github.com/jinzhu/gorm"
 )
 
+const (
+	// DefaultBatchSize is the number of users processed per batch if none is specified
+	DefaultBatchSize = 100
+	// CheckpointName is the name of the checkpoint used to resume verification
+	// if none is specified, such as by the user verify-unverified command
+	CheckpointName = "verify-unverified-users"
+
+	// FailureInvalidToken indicates the email verification token could not be validated
+	FailureInvalidToken = "failed to validate email token"
+	// FailureMissingUsage indicates the user has no usage entry
+	FailureMissingUsage = "failed to find usage entry"
+	// FailureTierUpdate indicates the account tier could not be upgraded
+	FailureTierUpdate = "failed to update tier"
+)
+
 // User provides user migration utlities
 type User struct {
 	um *models.UserManager
@@ -21,37 +39,167 @@ func NewUserMigration(db *gorm.DB) *User {
 	}
 }
 
+// VerifyOptions configures how unverified users are verified
+type VerifyOptions struct {
+	// DryRun reports the changes that would be made without applying them
+	DryRun bool
+	// BatchSize is the number of users loaded into memory at once
+	BatchSize int
+	// Checkpoints, if set, persists the last processed user after every
+	// batch so an interrupted run resumes where it stopped. Checkpoints
+	// are not used during a dry run.
+	Checkpoints *checkpoint.Store
+	// Checkpoint is the name of the checkpoint, defaulting to CheckpointName.
+	// Verifications which must resume independently use different names.
+	Checkpoint string
+	// Restart ignores any existing checkpoint, processing all users
+	Restart bool
+}
+
+// VerifyResult summarizes the outcome of verifying unverified users
+type VerifyResult struct {
+	// Processed is the number of users processed without failure
+	Processed int
+	// Verified are the users whose email was, or would be, verified
+	Verified []string
+	// Upgraded are the users whose tier was, or would be, upgraded from unverified to free
+	Upgraded []string
+	// Failures are the users which failed to be processed, keyed by reason
+	Failures map[string][]string
+}
+
+func (r *VerifyResult) fail(reason, username string, err error) {
+	log.Printf("%s for user %s: %s", reason, username, err.Error())
+	r.Failures[reason] = append(r.Failures[reason], username)
+}
+
+// FailureReasons returns the reasons for failures in sorted order
+func (r *VerifyResult) FailureReasons() []string {
+	reasons := make([]string, 0, len(r.Failures))
+	for reason := range r.Failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
 // VerifyUnverifiedUsers is used to verify and upgrade all unverified users
 // it returns the number of verified users
 func (u *User) VerifyUnverifiedUsers() (int, error) {
-	users := []models.User{}
-	if err := u.um.DB.Model(&models.User{}).Find(&users).Error; err != nil {
+	result, err := u.VerifyUsers(VerifyOptions{})
+	if err != nil {
 		return 0, err
 	}
-	var count int
-	for _, user := range users {
-		if !user.EmailEnabled {
+	return result.Processed, nil
+}
+
+// VerifyUsers is used to verify the email of all users, and upgrade
+// users in the unverified tier to the free tier. Users are processed
+// in batches ordered by ID, so memory usage is bounded by the batch size.
+func (u *User) VerifyUsers(opts VerifyOptions) (*VerifyResult, error) {
+	if opts.BatchSize < 0 {
+		return nil, errors.New("batch size must not be negative")
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.Checkpoint == "" {
+		opts.Checkpoint = CheckpointName
+	}
+	result := &VerifyResult{Failures: make(map[string][]string)}
+	checkpoints := opts.Checkpoints
+	if opts.DryRun {
+		checkpoints = nil
+	}
+	var lastID uint
+	if checkpoints != nil && !opts.Restart {
+		cursor, err := checkpoints.Load(opts.Checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		if cursor > 0 {
+			log.Printf("resuming %s after user id %v", opts.Checkpoint, cursor)
+		}
+		lastID = cursor
+	}
+	progress, err := u.newProgress(opts.Checkpoint, lastID)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		users := []models.User{}
+		if err := u.um.DB.Model(&models.User{}).Where(
+			"id > ?", lastID,
+		).Order("id").Limit(opts.BatchSize).Find(&users).Error; err != nil {
+			return result, err
+		}
+		for _, user := range users {
+			u.verify(user, opts.DryRun, result)
+		}
+		progress.Add(len(users))
+		if len(users) < opts.BatchSize {
+			if checkpoints != nil {
+				return result, checkpoints.Clear(opts.Checkpoint)
+			}
+			return result, nil
+		}
+		lastID = users[len(users)-1].ID
+		if checkpoints != nil {
+			if err := checkpoints.Save(opts.Checkpoint, lastID); err != nil {
+				return result, err
+			}
+		}
+	}
+}
+
+// newProgress is used to track progress over all users, of
+// which those up to and including cursor are already processed
+func (u *User) newProgress(name string, cursor uint) (*checkpoint.Progress, error) {
+	var total, processed int
+	if err := u.um.DB.Model(&models.User{}).Count(&total).Error; err != nil {
+		return nil, err
+	}
+	if err := u.um.DB.Model(&models.User{}).Where(
+		"id <= ?", cursor,
+	).Count(&processed).Error; err != nil {
+		return nil, err
+	}
+	return checkpoint.NewProgress(name, total, processed), nil
+}
+
+// verify processes a single user, recording the outcome in result. A dry
+// run applies the same checks as a real run, except validating the email
+// verification token, which is read from the user being verified so only
+// fails if the user can't be updated.
+func (u *User) verify(user models.User, dryRun bool, result *VerifyResult) {
+	if !user.EmailEnabled {
+		if !dryRun {
 			if _, err := u.um.ValidateEmailVerificationToken(
 				user.UserName,
 				user.EmailVerificationToken,
 			); err != nil {
-				log.Println("failed to validate email token for user: ", user.UserName, err.Error())
-				continue
+				result.fail(FailureInvalidToken, user.UserName, err)
+				return
 			}
 		}
-		usg, err := u.us.FindByUserName(user.UserName)
-		if err != nil {
-			log.Println("failed to find usage entry for user: ", user.UserName, err.Error())
-			continue
-		}
-		if usg.Tier == models.Unverified {
+		result.Verified = append(result.Verified, user.UserName)
+	}
+	usg, err := u.us.FindByUserName(user.UserName)
+	if err != nil {
+		result.fail(FailureMissingUsage, user.UserName, err)
+		return
+	}
+	if usg.Tier == models.Unverified {
+		if !dryRun {
 			if err := u.us.UpdateTier(user.UserName, models.Free); err != nil {
-				log.Println("failed to update tier for user: ", user.UserName, err.Error())
-				continue
+				result.fail(FailureTierUpdate, user.UserName, err)
+				return
 			}
 		}
+		result.Upgraded = append(result.Upgraded, user.UserName)
+	}
+	if !dryRun {
 		log.Println("successfully validate email and upgraded tier for: ", user.UserName)
-		count++
 	}
-	return count, nil
+	result.Processed++
 }
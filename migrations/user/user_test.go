@@ -6,6 +6,7 @@ import (
 
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/migrations/checkpoint"
 	"github.com/jinzhu/gorm"
 )
 
@@ -49,6 +50,130 @@ func TestUserMigration(t *testing.T) {
 	}
 }
 
+func TestVerifyUsersDryRun(t *testing.T) {
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDBMigration(t, db)
+	userm := NewUserMigration(db)
+	usr, err := userm.um.NewUserAccount(
+		"testuser2forusermigration",
+		"password123",
+		"user2migration@example.org",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	result, err := userm.VerifyUsers(VerifyOptions{DryRun: true, BatchSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(result.Verified, usr.UserName) || !contains(result.Upgraded, usr.UserName) {
+		t.Fatal("expected user to be reported as verified and upgraded")
+	}
+	for _, usernames := range result.Failures {
+		if contains(usernames, usr.UserName) {
+			t.Fatal("expected user to pass the checks of a real run")
+		}
+	}
+	// a dry run must not modify the user
+	usg, err := userm.us.FindByUserName(usr.UserName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usg.Tier != models.Unverified {
+		t.Fatal("dry run upgraded user tier")
+	}
+	if _, err := userm.VerifyUsers(VerifyOptions{BatchSize: -1}); err == nil {
+		t.Fatal("expected error for negative batch size")
+	}
+}
+
+func TestVerifyUsersResume(t *testing.T) {
+	cfg, err := config.LoadConfig("../../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDBMigration(t, db)
+	if err := db.AutoMigrate(&checkpoint.Checkpoint{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	checkpoints, err := checkpoint.NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userm := NewUserMigration(db)
+	var users []*models.User
+	for _, username := range []string{"testuser3forusermigration", "testuser4forusermigration"} {
+		usr, err := userm.um.NewUserAccount(username, "password123", username+"@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Delete(usr)
+		defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+		users = append(users, usr)
+	}
+	const name = "test-verify-users-resume"
+	defer checkpoints.Clear(name)
+	// users up to the saved checkpoint were processed by an interrupted run
+	if err := checkpoints.Save(name, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	// checkpoints of other names are neither resumed nor cleared
+	if err := checkpoints.Save(CheckpointName, users[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoints.Clear(CheckpointName)
+	result, err := userm.VerifyUsers(VerifyOptions{BatchSize: 1, Checkpoints: checkpoints, Checkpoint: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contains(result.Verified, users[0].UserName) || !contains(result.Verified, users[1].UserName) {
+		t.Fatalf("expected only users after the checkpoint to be verified, got %v", result.Verified)
+	}
+	if cursor, err := checkpoints.Load(name); err != nil {
+		t.Fatal(err)
+	} else if cursor != 0 {
+		t.Fatal("expected checkpoint to be cleared once verification completes")
+	}
+	if cursor, err := checkpoints.Load(CheckpointName); err != nil {
+		t.Fatal(err)
+	} else if cursor != users[1].ID {
+		t.Fatal("expected checkpoint of another name to be unchanged")
+	}
+}
+
+func TestFailureReasons(t *testing.T) {
+	result := &VerifyResult{Failures: map[string][]string{
+		FailureTierUpdate:   {"user1"},
+		FailureInvalidToken: {"user2", "user3"},
+	}}
+	reasons := result.FailureReasons()
+	if len(reasons) != 2 || reasons[0] != FailureTierUpdate || reasons[1] != FailureInvalidToken {
+		t.Fatalf("bad failure reasons: %v", reasons)
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
 	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
 		cfg.Database.Port, cfg.Database.Password)
@@ -0,0 +1,264 @@
+package pin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/credits"
+	"github.com/c2h5oh/datasize"
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrInvalidMonths is returned when extending a pin by less than a month
+	ErrInvalidMonths = errors.New("pins must be extended by at least one month")
+	// ErrExtensionChanged is returned when applying an extension preview
+	// for an upload which has changed since the preview was made
+	ErrExtensionChanged = errors.New("upload changed since the extension was previewed, please preview again")
+	// ErrExtensionReasonRequired is returned when extending a pin without saying why
+	ErrExtensionReasonRequired = errors.New("reason is required to extend a pin")
+)
+
+// Extension is a record of a pin whose garbage collection date was extended
+type Extension struct {
+	gorm.Model
+	UserName    string `gorm:"type:varchar(255);index"`
+	Hash        string `gorm:"type:varchar(255);index"`
+	NetworkName string `gorm:"type:varchar(255)"`
+	Months      int
+	// GarbageCollectDateBefore and GarbageCollectDateAfter
+	// are the garbage collection dates of the upload
+	GarbageCollectDateBefore time.Time
+	GarbageCollectDateAfter  time.Time
+	// Cost is the credits charged, zero if the cost was waived
+	Cost     float64 `gorm:"type:float"`
+	Waived   bool
+	Operator string `gorm:"type:varchar(255)"`
+	Reason   string `gorm:"type:text"`
+	// CreditEntry is the ID of the credit ledger entry of the charge, if any
+	CreditEntry uint
+}
+
+// TableName sets the table used to store pin extensions
+func (Extension) TableName() string {
+	return "pin_extensions"
+}
+
+// ExtensionPreview is what will happen when extending a pin
+type ExtensionPreview struct {
+	Upload models.Upload
+	Tier   models.DataUsageTier
+	Months int
+	// GarbageCollectDate is the garbage collection date after the extension
+	GarbageCollectDate time.Time
+	// Cost is the credits the extension is worth
+	Cost float64
+	// Waived is whether the cost will not be charged, either
+	// because of the tier of the user or by the operator
+	Waived bool
+}
+
+// Charge returns the credits which will be charged for the extension
+func (p *ExtensionPreview) Charge() float64 {
+	if p.Waived {
+		return 0
+	}
+	return p.Cost
+}
+
+// String returns a human readable summary of the preview
+func (p *ExtensionPreview) String() string {
+	charge := fmt.Sprintf("charge of %v credits", p.Cost)
+	if p.Waived {
+		charge = fmt.Sprintf("waived charge of %v credits", p.Cost)
+	}
+	return fmt.Sprintf(
+		"user %s, hash %s, network %s\n"+
+			"tier %s, extended by %v months\n"+
+			"garbage collect date %s -> %s\n"+
+			"%s",
+		p.Upload.UserName, p.Upload.Hash, p.Upload.NetworkName,
+		p.Tier, p.Months,
+		p.Upload.GarbageCollectDate.Format(time.RFC3339), p.GarbageCollectDate.Format(time.RFC3339),
+		charge,
+	)
+}
+
+// ExtensionResult is the outcome of extending a single pin
+type ExtensionResult struct {
+	Preview   *ExtensionPreview
+	Extension *Extension
+	Err       error
+}
+
+// PreviewExtension is used to calculate the new garbage collection date
+// and cost of extending a pin by months, without making any changes.
+// The cost is waived for tiers which are not billed in credits, or if
+// waive is set.
+func (u *Util) PreviewExtension(username, hash, network string, months int, waive bool) (*ExtensionPreview, error) {
+	if months <= 0 {
+		return nil, ErrInvalidMonths
+	}
+	upload, err := u.UP.FindUploadByHashAndUserAndNetwork(username, hash, network)
+	if err != nil {
+		return nil, err
+	}
+	usg, err := u.US.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	return previewExtension(upload, usg.Tier, months, waive), nil
+}
+
+// PreviewExtensions is used to preview extending every upload selected by a filter
+func (u *Util) PreviewExtensions(filter UploadFilter, months int, waive bool, now time.Time) ([]*ExtensionPreview, error) {
+	if months <= 0 {
+		return nil, ErrInvalidMonths
+	}
+	uploads, err := u.FindUploads(filter, now)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		previews = make([]*ExtensionPreview, 0, len(uploads))
+		tiers    = make(map[string]models.DataUsageTier)
+	)
+	for i := range uploads {
+		upload := &uploads[i]
+		tier, ok := tiers[upload.UserName]
+		if !ok {
+			usg, err := u.US.FindByUserName(upload.UserName)
+			if err != nil {
+				return nil, err
+			}
+			tier = usg.Tier
+			tiers[upload.UserName] = tier
+		}
+		previews = append(previews, previewExtension(upload, tier, months, waive))
+	}
+	return previews, nil
+}
+
+func previewExtension(upload *models.Upload, tier models.DataUsageTier, months int, waive bool) *ExtensionPreview {
+	return &ExtensionPreview{
+		Upload:             *upload,
+		Tier:               tier,
+		Months:             months,
+		GarbageCollectDate: upload.GarbageCollectDate.AddDate(0, months, 0),
+		Cost:               extensionCost(upload, tier, months),
+		// only paid and partner accounts are charged for extensions
+		Waived: waive || !Billable(tier),
+	}
+}
+
+// extensionCost returns the cost of pinning an upload for
+// months more, in the same way Temporal charges for pins.
+// Extensions of accounts which are not billable cost nothing
+func extensionCost(upload *models.Upload, tier models.DataUsageTier, months int) float64 {
+	if !Billable(tier) {
+		return 0
+	}
+	sizeGigabytes := float64(upload.Size) / float64(datasize.GB.Bytes())
+	return sizeGigabytes * tier.PricePerGB() * float64(months)
+}
+
+// TotalCharge returns the total credits charged by extension previews
+func TotalCharge(previews []*ExtensionPreview) float64 {
+	var total float64
+	for _, preview := range previews {
+		total += preview.Charge()
+	}
+	return total
+}
+
+// ApplyExtension is used to extend the pin of a preview, charging the
+// previewed credits and recording the extension in a single transaction.
+// Unless force is set, users without enough credits are not extended.
+// If the upload changed since the preview was made, nothing is applied
+// and ErrExtensionChanged is returned.
+func (u *Util) ApplyExtension(preview *ExtensionPreview, operator, reason string, force bool) (*Extension, error) {
+	if reason == "" {
+		return nil, ErrExtensionReasonRequired
+	}
+	tx := u.UP.DB.Begin()
+	ext, err := applyExtension(tx, preview, operator, reason, force)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return ext, tx.Commit().Error
+}
+
+// ApplyExtensions is used to apply extension previews one at a time, so
+// that a failed extension does not prevent the others from being applied
+func (u *Util) ApplyExtensions(previews []*ExtensionPreview, operator, reason string, force bool) []ExtensionResult {
+	results := make([]ExtensionResult, 0, len(previews))
+	for _, preview := range previews {
+		ext, err := u.ApplyExtension(preview, operator, reason, force)
+		results = append(results, ExtensionResult{
+			Preview:   preview,
+			Extension: ext,
+			Err:       err,
+		})
+	}
+	return results
+}
+
+func applyExtension(tx *gorm.DB, preview *ExtensionPreview, operator, reason string, force bool) (*Extension, error) {
+	upload := preview.Upload
+	check := tx.Model(&upload).Where(
+		"garbage_collect_date = ?", upload.GarbageCollectDate,
+	).UpdateColumns(map[string]interface{}{
+		"garbage_collect_date": preview.GarbageCollectDate,
+		"hold_time_in_months":  upload.HoldTimeInMonths + int64(preview.Months),
+	})
+	if check.Error != nil {
+		return nil, check.Error
+	}
+	if check.RowsAffected == 0 {
+		return nil, ErrExtensionChanged
+	}
+	ext := &Extension{
+		UserName:                 upload.UserName,
+		Hash:                     upload.Hash,
+		NetworkName:              upload.NetworkName,
+		Months:                   preview.Months,
+		GarbageCollectDateBefore: upload.GarbageCollectDate,
+		GarbageCollectDateAfter:  preview.GarbageCollectDate,
+		Cost:                     preview.Charge(),
+		Waived:                   preview.Waived,
+		Operator:                 operator,
+		Reason:                   reason,
+	}
+	if charge := preview.Charge(); charge > 0 {
+		entry, err := credits.AdjustTx(tx, credits.Adjustment{
+			UserName: upload.UserName,
+			Amount:   -charge,
+			Reason:   credits.ReasonExtension,
+			Note: fmt.Sprintf(
+				"extension of %s on network %s by %v months", upload.Hash, upload.NetworkName, preview.Months,
+			),
+			Operator: operator,
+			Force:    force,
+		})
+		if err != nil {
+			return nil, err
+		}
+		ext.CreditEntry = entry.ID
+	}
+	if err := tx.Create(ext).Error; err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// Extensions is used to list the pin extensions of a user, oldest first
+func (u *Util) Extensions(username string) ([]Extension, error) {
+	var exts []Extension
+	if err := u.UP.DB.Where("user_name = ?", username).Order("id").Find(&exts).Error; err != nil {
+		return nil, err
+	}
+	return exts, nil
+}
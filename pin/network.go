@@ -0,0 +1,157 @@
+package pin
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	ipfsapi "github.com/RTradeLtd/go-ipfs-api"
+	"github.com/RTradeLtd/rtfs/v2"
+)
+
+const (
+	// PublicNetwork is the name of the public IPFS network
+	PublicNetwork = "public"
+	// delegatorTokenTTL is how long tokens used to access
+	// private networks through the Nexus delegator are valid
+	delegatorTokenTTL = time.Hour
+)
+
+// node is the IPFS API of a network
+type node struct {
+	network string
+	ipfs    rtfs.Manager
+	// token authorizes requests to private networks
+	token string
+	// expires is when the token expires, zero for the public network
+	expires time.Time
+}
+
+// request is used to make an IPFS API request which is not
+// supported by rtfs, authorized for private networks
+func (n *node) request(ctx context.Context, command string, opts map[string]string, args ...string) (*ipfsapi.Response, error) {
+	req := ipfsapi.NewRequest(ctx, n.ipfs.NodeAddress(), command, args...)
+	for k, v := range opts {
+		req.Opts[k] = v
+	}
+	if n.token != "" {
+		req.Headers["Authorization"] = "Bearer " + n.token
+	}
+	resp, err := req.Send(&http.Client{Timeout: time.Hour})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		resp.Close()
+		return nil, fmt.Errorf("%s failed on network %s: %s", command, n.network, resp.Error.Error())
+	}
+	return resp, nil
+}
+
+// isPublic returns whether the network name refers to the public network
+func isPublic(network string) bool {
+	return network == "" || network == PublicNetwork
+}
+
+// node returns the IPFS API of a network. Private networks are accessed
+// through the Nexus delegator, authorized as the service identity, which
+// must have been added to the users of the network.
+func (u *Util) node(network string) (*node, error) {
+	if isPublic(network) {
+		return &node{network: PublicNetwork, ipfs: u.ipfs}, nil
+	}
+	now := time.Now()
+	if n, ok := u.nodes[network]; ok && now.Add(time.Minute*5).Before(n.expires) {
+		return n, nil
+	}
+	if u.cfg == nil {
+		return nil, errors.New("private networks require a temporal configuration")
+	}
+	hn, err := u.HN.GetNetworkByName(network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find network %s: %s", network, err.Error())
+	}
+	if hn.Disabled || hn.Activated == nil {
+		return nil, fmt.Errorf("network %s is offline", network)
+	}
+	if u.Identity == "" {
+		return nil, errors.New("private networks require a service identity")
+	}
+	if !isNetworkUser(hn, u.Identity) {
+		return nil, fmt.Errorf("service identity %s is not a user of network %s", u.Identity, network)
+	}
+	expires := now.Add(delegatorTokenTTL)
+	token, err := delegatorToken(u.cfg.API.JWT.Key, u.cfg.API.JWT.Realm, u.Identity, now, expires)
+	if err != nil {
+		return nil, err
+	}
+	ipfs, err := rtfs.NewManager(
+		u.cfg.Nexus.Host+":"+u.cfg.Nexus.Delegator.Port+"/network/"+network,
+		token, time.Hour,
+	)
+	if err != nil {
+		return nil, err
+	}
+	n := &node{network: network, ipfs: ipfs, token: token, expires: expires}
+	u.nodes[network] = n
+	return n, nil
+}
+
+// Size returns the cumulative size of a hash, as reported
+// by the node of the network it is pinned on
+func (u *Util) Size(network, hash string) (int64, error) {
+	n, err := u.node(network)
+	if err != nil {
+		return 0, err
+	}
+	stats, err := n.ipfs.Stat(hash)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stats.CumulativeSize), nil
+}
+
+// isNetworkUser returns whether the user may access the network
+func isNetworkUser(hn *models.HostedNetwork, user string) bool {
+	for _, names := range [][]string{hn.Owners, hn.Users} {
+		for _, name := range names {
+			if name == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// delegatorToken returns a HS256 signed JWT, in the format issued by the
+// Temporal API, which the Nexus delegator accepts for the given user
+func delegatorToken(key, realm, user string, issued, expires time.Time) (string, error) {
+	if key == "" {
+		return "", errors.New("jwt key is not configured")
+	}
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"id":       user,
+		"realm":    realm,
+		"orig_iat": issued.Unix(),
+		"exp":      expires.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,320 @@
+package pin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/RTradeLtd/tutil/mail"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// SignatureHeader is the header containing the hex encoded
+	// HMAC-SHA256 signature of a webhook request
+	SignatureHeader = "X-Temporal-Signature"
+	// TimestampHeader is the header containing the unix timestamp
+	// at which a webhook request was signed
+	TimestampHeader = "X-Temporal-Timestamp"
+
+	// ReminderSubject is the subject of pin expiration reminder emails
+	ReminderSubject = "Temporal: You Have Pins About To Expire"
+)
+
+// Notifier is used to deliver pin expiration reminders to users
+type Notifier interface {
+	Notify(ctx context.Context, reminder ReminderMessage) error
+}
+
+// EmailNotifier delivers reminders by email, attaching
+// the expiring pins as csv
+type EmailNotifier struct {
+	Mail *mail.Manager
+}
+
+// Notify is used to email a reminder to the user
+func (en *EmailNotifier) Notify(ctx context.Context, reminder ReminderMessage) error {
+	expiring, err := reminder.CSV()
+	if err != nil {
+		return err
+	}
+	_, err = en.Mail.Send(
+		mail.NewMessage(ReminderSubject, reminder.Message).
+			Attach("expiring-pins.csv", "text/csv", expiring),
+		reminder.UserName,
+		reminder.EmailAddress,
+	)
+	return err
+}
+
+// WebhookPayload is the json body posted to webhooks
+type WebhookPayload struct {
+	UserName string       `json:"user_name"`
+	SentAt   time.Time    `json:"sent_at"`
+	Pins     []WebhookPin `json:"pins"`
+}
+
+// WebhookPin is a single expiring pin within a webhook payload
+type WebhookPin struct {
+	Hash               string    `json:"hash"`
+	NetworkName        string    `json:"network_name"`
+	Type               string    `json:"type"`
+	FileName           string    `json:"file_name,omitempty"`
+	HoldTimeInMonths   int64     `json:"hold_time_in_months"`
+	GarbageCollectDate time.Time `json:"garbage_collect_date"`
+}
+
+// NewWebhookPayload is used to create the webhook payload of a reminder
+func NewWebhookPayload(reminder ReminderMessage) WebhookPayload {
+	payload := WebhookPayload{
+		UserName: reminder.UserName,
+		SentAt:   time.Now().UTC(),
+		Pins:     make([]WebhookPin, 0, len(reminder.Uploads)),
+	}
+	for _, up := range reminder.Uploads {
+		payload.Pins = append(payload.Pins, WebhookPin{
+			Hash:               up.Hash,
+			NetworkName:        up.NetworkName,
+			Type:               up.Type,
+			FileName:           up.FileName,
+			HoldTimeInMonths:   up.HoldTimeInMonths,
+			GarbageCollectDate: up.GarbageCollectDate.UTC(),
+		})
+	}
+	return payload
+}
+
+// WebhookNotifier delivers reminders by posting a signed json
+// payload to a url, allowing users to automate pin extensions
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// NewWebhookNotifier is used to create a webhook notifier posting to url
+func NewWebhookNotifier(url, secret string) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+// Notify is used to post the reminder to the webhook url
+func (wn *WebhookNotifier) Notify(ctx context.Context, reminder ReminderMessage) error {
+	payload := NewWebhookPayload(reminder)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, wn.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(payload.SentAt.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(wn.Secret, timestamp, body))
+	resp, err := wn.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a webhook
+// request, computed over the timestamp, a period, and the body
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature is used to check the signature of a webhook request
+func VerifySignature(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+const (
+	// ChannelEmail indicates a reminder is delivered by email
+	ChannelEmail = "email"
+	// ChannelWebhook indicates a reminder is delivered by webhook
+	ChannelWebhook = "webhook"
+)
+
+// Route describes how a reminder is delivered
+type Route struct {
+	Channel   string
+	Recipient string
+}
+
+// Dispatcher is a Notifier which delivers each reminder through the webhook
+// registered by the user, or by email otherwise
+type Dispatcher struct {
+	Mail     *mail.Manager
+	Webhooks map[string]Webhook
+	// Redirect, if set, delivers every reminder by email to this address instead
+	Redirect string
+	// DryRun, if set, writes every reminder and its route to this writer
+	// instead of delivering it
+	DryRun io.Writer
+}
+
+// Route returns how the reminder will be delivered
+func (d *Dispatcher) Route(reminder ReminderMessage) Route {
+	if d.Redirect != "" {
+		return Route{Channel: ChannelEmail, Recipient: d.Redirect}
+	}
+	if hook, ok := d.Webhooks[reminder.UserName]; ok {
+		return Route{Channel: ChannelWebhook, Recipient: hook.URL}
+	}
+	return Route{Channel: ChannelEmail, Recipient: reminder.EmailAddress}
+}
+
+// Notify is used to deliver the reminder along its route
+func (d *Dispatcher) Notify(ctx context.Context, reminder ReminderMessage) error {
+	route := d.Route(reminder)
+	if d.DryRun != nil {
+		return d.writeDryRun(route, reminder)
+	}
+	if route.Channel == ChannelWebhook {
+		hook := d.Webhooks[reminder.UserName]
+		return NewWebhookNotifier(hook.URL, hook.Secret).Notify(ctx, reminder)
+	}
+	reminder.EmailAddress = route.Recipient
+	return (&EmailNotifier{Mail: d.Mail}).Notify(ctx, reminder)
+}
+
+func (d *Dispatcher) writeDryRun(route Route, reminder ReminderMessage) error {
+	var body string
+	switch route.Channel {
+	case ChannelWebhook:
+		out, err := json.MarshalIndent(NewWebhookPayload(reminder), "", "  ")
+		if err != nil {
+			return err
+		}
+		body = string(out)
+	default:
+		if d.Mail != nil {
+			suppressed, why, err := d.Mail.IsSuppressed(route.Recipient)
+			if err != nil {
+				return err
+			}
+			if suppressed {
+				route.Recipient = fmt.Sprintf("%s (suppressed: %s)", route.Recipient, why)
+			}
+		}
+		expiring, err := reminder.CSV()
+		if err != nil {
+			return err
+		}
+		body = fmt.Sprintf(
+			"Subject: %s\n\n%s\n\nAttachment expiring-pins.csv:\n%s",
+			ReminderSubject, mail.HTMLToText(reminder.Message), expiring,
+		)
+	}
+	_, err := fmt.Fprintf(
+		d.DryRun, "==> user %s via %s to %s\n%s\n\n",
+		reminder.UserName, route.Channel, route.Recipient, body,
+	)
+	return err
+}
+
+// Webhook is a url registered by a user to receive reminders
+// instead of email
+type Webhook struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255);unique"`
+	URL      string `gorm:"type:varchar(2048)"`
+	Secret   string `gorm:"type:varchar(255)"`
+}
+
+// SetWebhook is used to register a webhook for a user, replacing any existing one.
+// The secret used to sign requests is returned
+func (u *Util) SetWebhook(username, webhookURL string) (string, error) {
+	if err := validateWebhookURL(webhookURL); err != nil {
+		return "", err
+	}
+	if _, err := u.UM.FindByUserName(username); err != nil {
+		return "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	hook := Webhook{}
+	if err := u.UP.DB.Unscoped().Where(
+		"user_name = ?", username,
+	).First(&hook).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return "", err
+	}
+	hook.UserName = username
+	hook.URL = webhookURL
+	hook.Secret = hex.EncodeToString(secret)
+	hook.DeletedAt = nil
+	if err := u.UP.DB.Unscoped().Save(&hook).Error; err != nil {
+		return "", err
+	}
+	return hook.Secret, nil
+}
+
+// validateWebhookURL is used to check a webhook url is an absolute https url,
+// so reminders and their signatures are never sent in the clear
+func validateWebhookURL(webhookURL string) error {
+	if webhookURL == "" {
+		return errors.New("webhook url is empty")
+	}
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %s", err)
+	}
+	if parsed.Scheme != "https" {
+		return fmt.Errorf("invalid webhook url %q, must use https", webhookURL)
+	}
+	if parsed.Hostname() == "" {
+		return fmt.Errorf("invalid webhook url %q, must have a host", webhookURL)
+	}
+	return nil
+}
+
+// RemoveWebhook is used to remove the webhook registered for a user
+func (u *Util) RemoveWebhook(username string) error {
+	check := u.UP.DB.Where("user_name = ?", username).Delete(&Webhook{})
+	if check.Error != nil {
+		return check.Error
+	}
+	if check.RowsAffected == 0 {
+		return errors.New("user has no webhook registered")
+	}
+	return nil
+}
+
+// Webhooks returns all registered webhooks keyed by username
+func (u *Util) Webhooks() (map[string]Webhook, error) {
+	var hooks []Webhook
+	if err := u.UP.DB.Find(&hooks).Error; err != nil {
+		return nil, err
+	}
+	byUser := make(map[string]Webhook, len(hooks))
+	for _, hook := range hooks {
+		byUser[hook.UserName] = hook
+	}
+	return byUser, nil
+}
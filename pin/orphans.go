@@ -0,0 +1,289 @@
+package pin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+)
+
+// ErrOrphanReferenced is returned when unpinning an orphan which
+// became referenced since it was found, such as by a new upload
+var ErrOrphanReferenced = errors.New("pin is referenced, refusing to unpin")
+
+// OrphanSighting records when a pin was first found unreferenced. Temporal
+// pins content before recording the upload referencing it, so a pin is
+// only unpinned once it has remained unreferenced for a grace period.
+type OrphanSighting struct {
+	gorm.Model
+	NetworkName string `gorm:"type:varchar(255);unique_index:idx_orphan_sightings_network_hash"`
+	Hash        string `gorm:"type:varchar(255);unique_index:idx_orphan_sightings_network_hash"`
+	FirstSeenAt time.Time
+}
+
+// TableName sets the table used to store orphan sightings
+func (OrphanSighting) TableName() string {
+	return "orphan_sightings"
+}
+
+// OrphanReport is the outcome of reconciling the pins on
+// the IPFS node of a network against the uploads table
+type OrphanReport struct {
+	// UnreferencedPins are hashes recursively pinned on the node
+	// that no upload references, and are safe to unpin
+	UnreferencedPins []string
+	// MissingPins are uploads whose hash is not pinned on the node
+	MissingPins []models.Upload
+}
+
+// Empty returns whether the reconciliation found no orphans
+func (r *OrphanReport) Empty() bool {
+	return len(r.UnreferencedPins) == 0 && len(r.MissingPins) == 0
+}
+
+// FindOrphans is used to compare the recursive pins of the IPFS node of a
+// network against the uploads table. Uploads removed by garbage collection are
+// no longer considered references, so their content shows up as unreferenced.
+//
+// Hashes which are referenced outside of the uploads table, such as
+// customer objects, encrypted uploads and IPNS records, are never
+// reported as unreferenced.
+func (u *Util) FindOrphans(ctx context.Context, network string) (*OrphanReport, error) {
+	if isPublic(network) {
+		network = PublicNetwork
+	}
+	n, err := u.node(network)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := listPins(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	var uploads []models.Upload
+	if err := u.uploadsInNetwork(network).Order("id").Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+	referenced, err := u.referencedHashes()
+	if err != nil {
+		return nil, err
+	}
+	return reconcile(pins, uploads, referenced), nil
+}
+
+// externalReferences are the columns referencing pinned hashes outside
+// of the uploads table, named as gorm names the IPFSHash fields
+var externalReferences = []struct {
+	model  interface{}
+	column string
+}{
+	{&models.User{}, "customer_object_hash"},
+	{&models.EncryptedUpload{}, "ip_fs_hash"},
+	{&models.IPNS{}, "current_ip_fs_hash"},
+}
+
+// referencedHashes returns the hashes pinned on behalf
+// of users which are not tracked as uploads
+func (u *Util) referencedHashes() (map[string]bool, error) {
+	referenced := map[string]bool{models.EmptyCustomerObjectHash: true}
+	for _, query := range externalReferences {
+		// tables of Temporal features which were never deployed reference nothing
+		if !u.UP.DB.HasTable(query.model) {
+			continue
+		}
+		var hashes []string
+		if err := u.UP.DB.Model(query.model).Pluck(query.column, &hashes).Error; err != nil {
+			return nil, err
+		}
+		for _, hash := range hashes {
+			referenced[hash] = true
+		}
+	}
+	return referenced, nil
+}
+
+// reconcile compares node pins with uploads, ignoring
+// any hashes referenced outside of the uploads table
+func reconcile(pins map[string]bool, uploads []models.Upload, referenced map[string]bool) *OrphanReport {
+	report := &OrphanReport{}
+	uploaded := make(map[string]bool, len(uploads))
+	for _, upload := range uploads {
+		uploaded[upload.Hash] = true
+		if !pins[upload.Hash] {
+			report.MissingPins = append(report.MissingPins, upload)
+		}
+	}
+	for hash := range pins {
+		if !uploaded[hash] && !referenced[hash] {
+			report.UnreferencedPins = append(report.UnreferencedPins, hash)
+		}
+	}
+	sort.Strings(report.UnreferencedPins)
+	return report
+}
+
+// OrphanSightings returns when each unreferenced pin of a network was first seen
+func (u *Util) OrphanSightings(network string) (map[string]time.Time, error) {
+	if isPublic(network) {
+		network = PublicNetwork
+	}
+	var sightings []OrphanSighting
+	if err := u.UP.DB.Where("network_name = ?", network).Find(&sightings).Error; err != nil {
+		return nil, err
+	}
+	firstSeen := make(map[string]time.Time, len(sightings))
+	for _, sighting := range sightings {
+		firstSeen[sighting.Hash] = sighting.FirstSeenAt
+	}
+	return firstSeen, nil
+}
+
+// RecordOrphans is used to record the unreferenced pins of a network seen at
+// now, forgetting pins which are no longer unreferenced. When each pin was
+// first seen is returned.
+func (u *Util) RecordOrphans(network string, hashes []string, now time.Time) (map[string]time.Time, error) {
+	if isPublic(network) {
+		network = PublicNetwork
+	}
+	firstSeen, err := u.OrphanSightings(network)
+	if err != nil {
+		return nil, err
+	}
+	tx := u.UP.DB.Begin()
+	current := make(map[string]time.Time, len(hashes))
+	for _, hash := range hashes {
+		if seen, ok := firstSeen[hash]; ok {
+			current[hash] = seen
+			continue
+		}
+		if err := tx.Create(&OrphanSighting{
+			NetworkName: network,
+			Hash:        hash,
+			FirstSeenAt: now,
+		}).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		current[hash] = now
+	}
+	query := tx.Unscoped().Where("network_name = ?", network)
+	if len(hashes) > 0 {
+		query = query.Where("hash NOT IN (?)", hashes)
+	}
+	if err := query.Delete(&OrphanSighting{}).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return current, tx.Commit().Error
+}
+
+// SettledOrphans is used to split unreferenced pins into those which have
+// been unreferenced for at least the grace period, and those which have not
+func SettledOrphans(hashes []string, firstSeen map[string]time.Time, grace time.Duration, now time.Time) (settled, recent []string) {
+	for _, hash := range hashes {
+		seen, ok := firstSeen[hash]
+		if !ok || now.Sub(seen) < grace {
+			recent = append(recent, hash)
+			continue
+		}
+		settled = append(settled, hash)
+	}
+	return settled, recent
+}
+
+// UnpinOrphan is used to unpin an unreferenced pin, checking again that
+// nothing references it immediately before it is unpinned
+func (u *Util) UnpinOrphan(ctx context.Context, network, hash string) error {
+	if isPublic(network) {
+		network = PublicNetwork
+	}
+	if referenced, err := u.isReferenced(network, hash); err != nil {
+		return err
+	} else if referenced {
+		return ErrOrphanReferenced
+	}
+	if err := u.Unpin(ctx, network, hash); err != nil {
+		return err
+	}
+	return u.UP.DB.Unscoped().Where(
+		"network_name = ? AND hash = ?", network, hash,
+	).Delete(&OrphanSighting{}).Error
+}
+
+// isReferenced returns whether an upload of the network, or
+// any record outside of the uploads table, references hash
+func (u *Util) isReferenced(network, hash string) (bool, error) {
+	if hash == models.EmptyCustomerObjectHash {
+		return true, nil
+	}
+	var count int
+	if err := u.uploadsInNetwork(network).Where("hash = ?", hash).Count(&count).Error; err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+	for _, query := range externalReferences {
+		if !u.UP.DB.HasTable(query.model) {
+			continue
+		}
+		if err := u.UP.DB.Model(query.model).Where(
+			query.column+" = ?", hash,
+		).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Unpin is used to remove a recursive pin from the IPFS node of a network
+func (u *Util) Unpin(ctx context.Context, network, hash string) error {
+	n, err := u.node(network)
+	if err != nil {
+		return err
+	}
+	resp, err := n.request(ctx, "pin/rm", nil, hash)
+	if err != nil {
+		return err
+	}
+	return resp.Close()
+}
+
+// Repin is used to pin the content of an upload which
+// is missing from the IPFS node of its network
+func (u *Util) Repin(upload models.Upload) error {
+	n, err := u.node(upload.NetworkName)
+	if err != nil {
+		return err
+	}
+	return n.ipfs.Pin(upload.Hash)
+}
+
+// listPins returns the set of hashes recursively pinned on the node
+func listPins(ctx context.Context, n *node) (map[string]bool, error) {
+	resp, err := n.request(ctx, "pin/ls", map[string]string{"type": "recursive"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	var out struct {
+		Keys map[string]struct {
+			Type string
+		}
+	}
+	if err := json.NewDecoder(resp.Output).Decode(&out); err != nil {
+		return nil, err
+	}
+	pins := make(map[string]bool, len(out.Keys))
+	for hash := range out.Keys {
+		pins[hash] = true
+	}
+	return pins, nil
+}
@@ -1,7 +1,9 @@
 package pin
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +15,7 @@ import (
 	"github.com/RTradeLtd/database/v2/models"
 	"github.com/RTradeLtd/rtfs/v2"
 	"github.com/RTradeLtd/tutil/mail"
+	"github.com/RTradeLtd/tutil/suspension"
 	"github.com/jinzhu/gorm"
 )
 
@@ -21,8 +24,16 @@ type Util struct {
 	UM   *models.UserManager
 	UP   *models.UploadManager
 	US   *models.UsageManager
-	ipfs rtfs.Manager
+	HN   *models.HostedNetworkManager
 	Mail *mail.Manager
+	// Identity is the service account private networks are accessed
+	// as, it is never one of the customers using the network
+	Identity string
+	// ipfs is the node of the public network
+	ipfs rtfs.Manager
+	// nodes are the nodes of private networks
+	nodes map[string]*node
+	cfg   *config.TemporalConfig
 }
 
 // NewPinUtil is used to generate our pin related utilities
@@ -39,11 +50,14 @@ func NewPinUtil(db *gorm.DB, cfg *config.TemporalConfig) (*Util, error) {
 		return nil, err
 	}
 	return &Util{
-		UM:   models.NewUserManager(db),
-		UP:   models.NewUploadManager(db),
-		US:   models.NewUsageManager(db),
-		ipfs: ipfs,
-		Mail: manager,
+		UM:    models.NewUserManager(db),
+		UP:    models.NewUploadManager(db),
+		US:    models.NewUsageManager(db),
+		HN:    models.NewHostedNetworkManager(db),
+		Mail:  manager,
+		ipfs:  ipfs,
+		nodes: make(map[string]*node),
+		cfg:   cfg,
 	}, nil
 }
 
@@ -53,16 +67,62 @@ type ReminderMessage struct {
 	EmailAddress string
 	UserName     string
 	Message      string
+	Uploads      []models.Upload
+}
+
+// CSV returns the uploads about to expire formatted as csv,
+// suitable for attaching to the reminder email
+func (rm ReminderMessage) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write([]string{"hash", "network", "type", "file_name", "garbage_collect_date"}); err != nil {
+		return nil, err
+	}
+	for _, up := range rm.Uploads {
+		if err := w.Write([]string{
+			up.Hash,
+			up.NetworkName,
+			up.Type,
+			up.FileName,
+			up.GarbageCollectDate.UTC().Format(time.RFC3339),
+		}); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
 }
 
-// GetExpiredPins is used to retrieve all uploads/pins
-// that are currently expired and need to be removed
-func (u *Util) GetExpiredPins() ([]models.Upload, error) {
+// uploadsInNetwork returns a query for the uploads of a network,
+// or the uploads of every network if network is empty
+func (u *Util) uploadsInNetwork(network string) *gorm.DB {
+	query := u.UP.DB.Model(&models.Upload{})
+	switch {
+	case network == "":
+		return query
+	case isPublic(network):
+		return query.Where("network_name = ? OR network_name = ''", PublicNetwork)
+	default:
+		return query.Where("network_name = ?", network)
+	}
+}
+
+// GetExpiredPins is used to retrieve all uploads/pins in a network that
+// are currently expired and need to be removed. If network is empty,
+// expired pins of every network are returned. Pins of accounts suspended
+// with garbage collection frozen are never returned.
+func (u *Util) GetExpiredPins(network string) ([]models.Upload, error) {
 	uploads := []models.Upload{}
 	currentDate := time.Now()
-	if err := u.UP.DB.Model(&models.Upload{}).Where(
+	query := u.uploadsInNetwork(network).Where(
 		"garbage_collect_date < ?", currentDate,
-	).Find(&uploads).Error; err != nil {
+	)
+	// pins of suspended accounts may be frozen for an investigation,
+	// unless the migration recording suspensions was not applied yet
+	if u.UP.DB.HasTable(&suspension.Suspension{}) {
+		query = query.Where("user_name NOT IN (?)", suspension.Frozen(u.UP.DB))
+	}
+	if err := query.Find(&uploads).Error; err != nil {
 		return nil, err
 	}
 	if len(uploads) == 0 {
@@ -72,13 +132,22 @@ func (u *Util) GetExpiredPins() ([]models.Upload, error) {
 }
 
 // ExpirePins is used to remove all expired pins from
-// a users given uploads, as well as reducing their data usage
+// a users given uploads, as well as reducing their data usage.
+// The size of each upload is retrieved from the node of its network
 func (u *Util) ExpirePins(uploads []models.Upload) error {
 	for _, upload := range uploads {
 		// get variables needed for filtration
 		hash := upload.Hash
 		user := upload.UserName
-		stats, err := u.ipfs.Stat(hash)
+		n, err := u.node(upload.NetworkName)
+		if err != nil {
+			fmt.Printf(
+				"failed to connect to network for hash %s, user %s. error: %s",
+				hash, user, err.Error(),
+			)
+			continue
+		}
+		stats, err := n.ipfs.Stat(hash)
 		if err != nil {
 			fmt.Printf(
 				"failed to get object stats for hash %s, user %s. error: %s",
@@ -108,6 +177,7 @@ func (u *Util) ExpirePins(uploads []models.Upload) error {
 // GetPinsToRemind is used to get pins that are close to their gc date
 // these pins are then used to send an email reminder to the user to remind them
 // that they will need to extend the lifetime, otherwise their data will be removed.
+// Only pins of the given network are returned, or of every network if it is empty.
 //
 // the window is the time window we use to examine uploads for reminder. If you give todays date + 7 days
 // then we will search for all uploads that expire between now, and 7 days from now.
@@ -116,40 +186,45 @@ func (u *Util) ExpirePins(uploads []models.Upload) error {
 // if the same file is pinned by multiple users, we won't actually remove it from our system.
 // However in the event that the final user who is pinning the content lets the garbage collection date
 // expire, then and only then is the data removed from our system.
-func (u *Util) GetPinsToRemind(days int) ([]ReminderMessage, error) {
+func (u *Util) GetPinsToRemind(network string, days int) ([]ReminderMessage, error) {
 	uploads := []models.Upload{}
 	// calculate the time window
 	maxGCDate := time.Now().AddDate(0, 0, days)
 	// find all uploads within the garbage collect period
-	if err := u.UP.DB.Model(&models.Upload{}).Where(
+	if err := u.uploadsInNetwork(network).Where(
 		"garbage_collect_date BETWEEN ? AND ?",
 		time.Now(), maxGCDate,
 	).Find(&uploads).Error; err != nil {
 		return nil, err
 	}
-	// hashes will hold all hashes belonging to a give user
-	hashes := make(map[string][]string)
-	// iterate through all uploads to updated the hashes map
+	// expiring will hold all uploads belonging to a give user
+	expiring := make(map[string][]models.Upload)
+	// iterate through all uploads to updated the expiring map
 	for _, v := range uploads {
-		hashes[v.UserName] = append(hashes[v.UserName], v.Hash)
+		expiring[v.UserName] = append(expiring[v.UserName], v)
+	}
+	// users with a webhook are notified even if their email is disabled
+	hooks, err := u.Webhooks()
+	if err != nil {
+		return nil, err
 	}
 	// a single ReminderMessage will be used to send a single email
 	// while also containing all hashes that are going to expire
 	reminders := []ReminderMessage{}
-	for k, v := range hashes {
+	for k, v := range expiring {
 		user, err := u.UM.FindByUserName(k)
 		if err != nil {
 			return nil, err
 		}
 		// skip users that don't have their emails enabled
-		if !user.EmailEnabled {
+		if _, ok := hooks[k]; !ok && !user.EmailEnabled {
 			continue
 		}
 		var hashFormatted = `
 		<ul>
 		`
-		for _, h := range v {
-			hashFormatted = hashFormatted + fmt.Sprintf("<li>%s</li>", h)
+		for _, up := range v {
+			hashFormatted = hashFormatted + fmt.Sprintf("<li>%s</li>", up.Hash)
 		}
 		hashFormatted = hashFormatted + "</ul>"
 		message := fmt.Sprintf(
@@ -160,14 +235,17 @@ func (u *Util) GetPinsToRemind(days int) ([]ReminderMessage, error) {
 			EmailAddress: user.EmailAddress,
 			UserName:     user.UserName,
 			Message:      message,
+			Uploads:      v,
 		})
 	}
 	return reminders, nil
 }
 
 // PinExpirationService used to run at fixed intervals
-// automatically expiring pins and removing them from our system.
-func (u *Util) PinExpirationService(ctx context.Context, frequency time.Duration) (int, error) {
+// automatically expiring pins of a network and removing them from our system.
+// If network is empty, pins of every network are expired. If onExpire is set,
+// it is called with the pins expired by each run, such as to audit them
+func (u *Util) PinExpirationService(ctx context.Context, network string, frequency time.Duration, onExpire func([]models.Upload)) (int, error) {
 	var (
 		ticker       = time.NewTicker(frequency)
 		runs         = 0
@@ -177,7 +255,7 @@ func (u *Util) PinExpirationService(ctx context.Context, frequency time.Duration
 	for {
 		select {
 		case <-ticker.C:
-			expired, err := u.GetExpiredPins()
+			expired, err := u.GetExpiredPins(network)
 			if err != nil {
 				log.Println("failed to get expired pins: ", err.Error())
 				continue
@@ -187,6 +265,9 @@ func (u *Util) PinExpirationService(ctx context.Context, frequency time.Duration
 				continue
 			}
 			totalRemoved += len(expired)
+			if onExpire != nil {
+				onExpire(expired)
+			}
 			var formattedOutput string
 			for _, pin := range expired {
 				formattedOutput = fmt.Sprintf("%s\n%+v\n", formattedOutput, pin)
@@ -207,10 +288,12 @@ func (u *Util) PinExpirationService(ctx context.Context, frequency time.Duration
 	}
 }
 
-// RemoveAndRefund is used to remove a pin and partially refund
-func (u *Util) RemoveAndRefund(username, hash string) error {
-	if hash == "" {
-		return nil
+// RemoveAndRefund is used to remove a pin, refunding the user according
+// to the refund policy. The applied removal is returned
+func (u *Util) RemoveAndRefund(username, hash, network string, policy RefundPolicy, operator string) (*RemovalPreview, error) {
+	preview, err := u.PreviewRemoval(username, hash, network, policy, time.Now().UTC())
+	if err != nil {
+		return nil, err
 	}
-	return u.UP.RemovePin(username, hash, "public")
+	return preview, u.ApplyRemoval(preview, operator)
 }
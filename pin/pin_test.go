@@ -1,13 +1,27 @@
 package pin
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/RTradeLtd/config/v2"
 	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/credits"
+	"github.com/RTradeLtd/tutil/suspension"
+	"github.com/RTradeLtd/tutil/tier"
+	"github.com/c2h5oh/datasize"
 	"github.com/jinzhu/gorm"
 )
 
@@ -33,6 +47,21 @@ func TestMigration(t *testing.T) {
 	if err := db.AutoMigrate(&models.Usage{}).Error; err != nil {
 		t.Fatal(err)
 	}
+	if err := db.AutoMigrate(&Webhook{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&credits.Entry{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Extension{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&suspension.Suspension{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&OrphanSighting{}).Error; err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestPinExpirationService(t *testing.T) {
@@ -75,7 +104,7 @@ func TestPinExpirationService(t *testing.T) {
 	time.Sleep(time.Second * 2)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	if count, err := util.PinExpirationService(ctx, time.Second); err != nil {
+	if count, err := util.PinExpirationService(ctx, PublicNetwork, time.Second, nil); err != nil {
 		t.Fatal(err)
 	} else if count == 0 {
 		t.Fatal("no pins removed")
@@ -119,7 +148,7 @@ func Test_GetExpiredPins(t *testing.T) {
 		t.Fatal(err)
 	}
 	time.Sleep(time.Second * 1)
-	uploads, err := util.GetExpiredPins()
+	uploads, err := util.GetExpiredPins(PublicNetwork)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -171,9 +200,415 @@ func TestPinRemoval(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer util.UP.DB.Unscoped().Delete(upload1)
-	if err := util.RemoveAndRefund("testuser1", testCID); err != nil {
+	if _, err := util.RemoveAndRefund("testuser1", testCID, "public", RefundProrated, "tester"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemovalPreview(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util, err := NewPinUtil(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := util.UM.NewUserAccount("testrefunduser", "password123", "testrefunduser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.UM.DB.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&credits.Entry{})
+	if err := util.US.UpdateTier(usr.UserName, models.Paid); err != nil {
+		t.Fatal(err)
+	}
+	size := int64(datasize.GB.Bytes())
+	if err := util.US.UpdateDataUsage(usr.UserName, uint64(size)); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := util.UP.NewUpload(testCID, "file", models.UploadOptions{
+		NetworkName: "public", Username: usr.UserName, HoldTimeInMonths: 1, Size: size,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.UP.DB.Unscoped().Delete(upload)
+	now := time.Now().UTC()
+	full, err := util.PreviewRemoval(usr.UserName, testCID, "public", RefundFull, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prorated, err := util.PreviewRemoval(usr.UserName, testCID, "public", RefundProrated, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := util.PreviewRemoval(usr.UserName, testCID, "public", RefundNone, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(full.Refund > prorated.Refund && prorated.Refund > none.Refund && none.Refund == 0) {
+		t.Fatalf("bad refunds: full %v, prorated %v, none %v", full.Refund, prorated.Refund, none.Refund)
+	}
+	if full.UsageBefore != uint64(size) || full.UsageAfter != 0 {
+		t.Fatalf("bad usage change: %+v", full)
+	}
+	// previews are refused once the upload changes
+	if err := util.UP.ExtendGarbageCollectionPeriod(usr.UserName, testCID, "public", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.ApplyRemoval(prorated, "tester"); err != ErrRemovalChanged {
+		t.Fatal("expected stale preview to be refused")
+	}
+	applied, err := util.RemoveAndRefund(usr.UserName, testCID, "public", RefundProrated, "tester")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, err := util.UM.GetCreditsForUser(usr.UserName); err != nil {
+		t.Fatal(err)
+	} else if balance != usr.Credits+applied.Refund {
+		t.Fatalf("expected refund of %v to be issued", applied.Refund)
+	}
+	if usg, err := util.US.FindByUserName(usr.UserName); err != nil {
+		t.Fatal(err)
+	} else if usg.CurrentDataUsedBytes != 0 {
+		t.Fatal("expected data usage to be reduced")
+	}
+}
+
+func TestParseRefundPolicy(t *testing.T) {
+	for _, policy := range RefundPolicies {
+		if got, err := ParseRefundPolicy(string(policy)); err != nil || got != policy {
+			t.Fatalf("expected policy %s to be valid", policy)
+		}
+	}
+	if _, err := ParseRefundPolicy("double"); err == nil {
+		t.Fatal("expected invalid policy to be refused")
+	}
+}
+
+func TestReadHashes(t *testing.T) {
+	hashes, err := ReadHashes(strings.NewReader("# takedown list\nQmA\n\n  QmB  \n#QmC\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != 2 || hashes[0] != "QmA" || hashes[1] != "QmB" {
+		t.Fatalf("unexpected hashes %v", hashes)
+	}
+}
+
+func TestFindUploadsEmptyFilter(t *testing.T) {
+	u := &Util{}
+	if _, err := u.FindUploads(UploadFilter{Network: PublicNetwork}, time.Now()); err != ErrEmptyFilter {
+		t.Fatalf("expected ErrEmptyFilter, got %v", err)
+	}
+	if _, err := u.PreviewRemovals(UploadFilter{}, RefundNone, time.Now()); err != ErrEmptyFilter {
+		t.Fatalf("expected ErrEmptyFilter, got %v", err)
+	}
+}
+
+func TestTotalRefund(t *testing.T) {
+	previews := []*RemovalPreview{{Refund: 1.5}, {Refund: 0}, {Refund: 2}}
+	if got := TotalRefund(previews); got != 3.5 {
+		t.Fatalf("expected total refund of 3.5, got %v", got)
+	}
+}
+
+func TestApplyExtension(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util, err := NewPinUtil(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := util.UM.NewUserAccount("testextenduser", "password123", "testextenduser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.UM.DB.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&credits.Entry{})
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&Extension{})
+	if err := util.US.UpdateTier(usr.UserName, models.Paid); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := util.UP.NewUpload(testCID, "file", models.UploadOptions{
+		NetworkName: "public", Username: usr.UserName, HoldTimeInMonths: 1, Size: int64(datasize.GB.Bytes()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.UP.DB.Unscoped().Delete(upload)
+	preview, err := util.PreviewExtension(usr.UserName, testCID, "public", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := util.ApplyExtension(preview, "tester", "", false); err != ErrExtensionReasonRequired {
+		t.Fatal("expected extension without a reason to be refused")
+	}
+	// the user has no credits to pay for the extension
+	if _, err := util.ApplyExtension(preview, "tester", "failed payment", false); err != credits.ErrNegativeBalance {
+		t.Fatalf("expected extension to be refused, got %v", err)
+	}
+	ext, err := util.ApplyExtension(preview, "tester", "failed payment", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ext.Cost != preview.Cost || ext.CreditEntry == 0 {
+		t.Fatalf("expected extension to be charged: %+v", ext)
+	}
+	extended, err := util.UP.FindUploadByHashAndUserAndNetwork(usr.UserName, testCID, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !extended.GarbageCollectDate.Equal(preview.GarbageCollectDate) || extended.HoldTimeInMonths != 3 {
+		t.Fatalf("expected upload to be extended: %+v", extended)
+	}
+	if _, err := util.ApplyExtension(preview, "tester", "failed payment", true); err != ErrExtensionChanged {
+		t.Fatal("expected stale preview to be refused")
+	}
+	if exts, err := util.Extensions(usr.UserName); err != nil {
+		t.Fatal(err)
+	} else if len(exts) != 1 {
+		t.Fatalf("expected 1 extension, got %v", len(exts))
+	}
+}
+
+func TestPreviewExtension(t *testing.T) {
+	gcd := time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC)
+	upload := &models.Upload{Size: int64(datasize.GB.Bytes()) * 2, GarbageCollectDate: gcd}
+	type args struct {
+		tier   models.DataUsageTier
+		months int
+		waive  bool
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantCost   float64
+		wantCharge float64
+		wantWaived bool
+	}{
+		{"Paid", args{models.Paid, 3, false}, 2 * 0.07 * 3, 2 * 0.07 * 3, false},
+		{"Paid-Waived", args{models.Paid, 3, true}, 2 * 0.07 * 3, 0, true},
+		{"Partner", args{models.Partner, 1, false}, 2 * 0.05, 2 * 0.05, false},
+		{"Free", args{models.Free, 1, false}, 0, 0, true},
+		{"WhiteLabeled", args{models.WhiteLabeled, 1, false}, 0, 0, true},
+		{"Unverified", args{models.Unverified, 1, false}, 0, 0, true},
+	}
+	// every tier must be covered without a waiver
+	for _, tr := range tier.Tiers {
+		var covered bool
+		for _, tt := range tests {
+			covered = covered || (tt.args.tier == tr && !tt.args.waive)
+		}
+		if !covered {
+			t.Fatalf("no extension test for tier %s", tr)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preview := previewExtension(upload, tt.args.tier, tt.args.months, tt.args.waive)
+			if math.Abs(preview.Cost-tt.wantCost) > 1e-9 {
+				t.Fatalf("expected cost %v, got %v", tt.wantCost, preview.Cost)
+			}
+			if math.Abs(preview.Charge()-tt.wantCharge) > 1e-9 {
+				t.Fatalf("expected charge %v, got %v", tt.wantCharge, preview.Charge())
+			}
+			if preview.Waived != tt.wantWaived {
+				t.Fatalf("expected waived %v, got %v", tt.wantWaived, preview.Waived)
+			}
+			if want := gcd.AddDate(0, tt.args.months, 0); !preview.GarbageCollectDate.Equal(want) {
+				t.Fatalf("expected garbage collect date %s, got %s", want, preview.GarbageCollectDate)
+			}
+		})
+	}
+	if _, err := (&Util{}).PreviewExtensions(UploadFilter{UserName: "testuser"}, 0, false, time.Now()); err != ErrInvalidMonths {
+		t.Fatalf("expected ErrInvalidMonths, got %v", err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	by, err := ParseReportDimensions("tier, network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// groups as summarized by the database, in no particular order
+	report := newReport([]ReportGroup{
+		{Tier: "paid", Network: "public", Count: 3, Bytes: 60, Expired: 1, Expiring1: 1, Expiring7: 2, Expiring30: 2},
+		{Tier: "free", Network: "private", Count: 2, Bytes: 90, Expiring30: 1},
+	}, by, now)
+	want := []ReportGroup{
+		{Tier: "free", Network: "private", Count: 2, Bytes: 90, Expiring30: 1},
+		{Tier: "paid", Network: "public", Count: 3, Bytes: 60, Expired: 1, Expiring1: 1, Expiring7: 2, Expiring30: 2},
+	}
+	if len(report.Groups) != len(want) {
+		t.Fatalf("expected %v groups, got %+v", len(want), report.Groups)
+	}
+	for i := range want {
+		if report.Groups[i] != want[i] {
+			t.Fatalf("expected group %+v, got %+v", want[i], report.Groups[i])
+		}
+	}
+	if report.Total.Count != 5 || report.Total.Bytes != 150 || report.Total.Expired != 1 || report.Total.Expiring30 != 3 {
+		t.Fatalf("bad total %+v", report.Total)
+	}
+	var buf bytes.Buffer
+	if err := report.Write(&buf, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "tier,network,count,bytes,expired,expiring_1d,expiring_7d,expiring_30d\n" +
+		"free,private,2,90,0,0,0,1\n" +
+		"paid,public,3,60,1,1,2,2\n"
+	if buf.String() != wantCSV {
+		t.Fatalf("unexpected csv:\n%s", buf.String())
+	}
+	buf.Reset()
+	if err := report.Write(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Groups) != 2 || decoded.Total != report.Total {
+		t.Fatalf("unexpected json report %+v", decoded)
+	}
+	buf.Reset()
+	if err := report.Write(&buf, "table"); err != nil {
 		t.Fatal(err)
 	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[3], "total") {
+		t.Fatalf("unexpected table:\n%s", buf.String())
+	}
+	if err := report.Write(&buf, "xml"); err == nil {
+		t.Fatal("expected invalid format to be refused")
+	}
+	if _, err := ParseReportDimensions("user,size"); err == nil {
+		t.Fatal("expected invalid dimension to be refused")
+	}
+}
+
+func TestPinReport(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	util, err := NewPinUtil(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := util.UM.NewUserAccount("testreportuser", "password123", "testreportuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer util.UM.DB.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	if err := util.US.UpdateTier(usr.UserName, models.Paid); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for i, gcd := range []time.Time{now.Add(-time.Hour), now.Add(12 * time.Hour), now.AddDate(0, 2, 0)} {
+		upload, err := util.UP.NewUpload(testCID, "file", models.UploadOptions{
+			NetworkName: "public", Username: usr.UserName, HoldTimeInMonths: 1, Size: int64(10 * (i + 1)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer util.UP.DB.Unscoped().Delete(upload)
+		if err := db.Model(upload).UpdateColumn("garbage_collect_date", gcd).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := util.Report(PublicNetwork, usr.UserName, []string{ByUser, ByTier, ByNetwork}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReportGroup{
+		UserName: usr.UserName, Tier: "paid", Network: PublicNetwork,
+		Count: 3, Bytes: 60, Expired: 1, Expiring1: 1, Expiring7: 1, Expiring30: 1,
+	}
+	if len(report.Groups) != 1 || report.Groups[0] != want {
+		t.Fatalf("expected group %+v, got %+v", want, report.Groups)
+	}
+	if report.Total != (ReportGroup{Count: 3, Bytes: 60, Expired: 1, Expiring1: 1, Expiring7: 1, Expiring30: 1}) {
+		t.Fatalf("bad total %+v", report.Total)
+	}
+	// without dimensions every upload is a single group
+	report, err = util.Report(PublicNetwork, usr.UserName, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Groups) != 1 || report.Groups[0].Count != 3 {
+		t.Fatalf("unexpected groups %+v", report.Groups)
+	}
+	if _, err := util.Report(PublicNetwork, usr.UserName, []string{"size"}, now); err == nil {
+		t.Fatal("expected invalid dimension to be refused")
+	}
+}
+
+func TestFullRefund(t *testing.T) {
+	created := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	upload := &models.Upload{
+		Size:               int64(datasize.GB.Bytes()),
+		GarbageCollectDate: created.Add(time.Hour * 730 * 2),
+	}
+	upload.CreatedAt = created
+	// a month of the two month hold time has been used
+	now := created.Add(time.Hour * 730)
+	want := map[models.DataUsageTier]float64{
+		models.Unverified:   0,
+		models.Free:         0,
+		models.Paid:         0.07,
+		models.Partner:      0.05,
+		models.WhiteLabeled: 0,
+	}
+	for _, tr := range tier.Tiers {
+		t.Run(tr.String(), func(t *testing.T) {
+			expected, ok := want[tr]
+			if !ok {
+				t.Fatalf("no expected refund for tier %s", tr)
+			}
+			if got := fullRefund(upload, tr, now); got < expected-0.0001 || got > expected+0.0001 {
+				t.Fatalf("expected the remaining month of 1GB to refund %v, got %v", expected, got)
+			}
+			if got := fullRefund(upload, tr, upload.GarbageCollectDate.Add(time.Hour)); got != 0 {
+				t.Fatalf("expected no refund once expired, got %v", got)
+			}
+			if Billable(tr) != (expected > 0) {
+				t.Fatalf("expected billable to be %v", expected > 0)
+			}
+			if Billable(tr) {
+				return
+			}
+			// unbillable tiers are never refunded, by any policy
+			for _, policy := range RefundPolicies {
+				preview, err := (&Util{}).previewUpload(upload, tr, 0, policy, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if preview.Refund != 0 {
+					t.Fatalf("expected no %s refund, got %v", policy, preview.Refund)
+				}
+			}
+		})
+	}
 }
 
 func TestPin(t *testing.T) {
@@ -248,11 +683,286 @@ func TestPin(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer util.UP.DB.Unscoped().Delete(upload2)
-	msgs, err := util.GetPinsToRemind(60)
+	msgs, err := util.GetPinsToRemind("", 60)
 	if err != nil {
 		t.Fatal(err)
 	}
 	fmt.Println(msgs)
+	// uploads of other networks are not reminded of
+	msgs, err = util.GetPinsToRemind("myprivatenetwork", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		for _, up := range msg.Uploads {
+			if up.ID == upload1.ID || up.ID == upload2.ID {
+				t.Fatalf("upload %v of another network reminded of", up.ID)
+			}
+		}
+	}
+}
+
+func TestReminderMessageCSV(t *testing.T) {
+	gcd := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	msg := ReminderMessage{
+		UserName: "testuser",
+		Uploads: []models.Upload{
+			{Hash: testCID, NetworkName: "public", Type: "file", FileName: "a.txt", GarbageCollectDate: gcd},
+		},
+	}
+	out, err := msg.CSV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hash,network,type,file_name,garbage_collect_date\n" +
+		testCID + ",public,file,a.txt,2019-07-01T00:00:00Z\n"
+	if string(out) != want {
+		t.Fatalf("bad csv output: %q", string(out))
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	pins := map[string]bool{
+		testCID:                        true,
+		"QmUnreferenced":               true,
+		"QmCustomerObject":             true,
+		models.EmptyCustomerObjectHash: true,
+	}
+	uploads := []models.Upload{
+		{Hash: testCID, UserName: "testuser"},
+		{Hash: "QmNotPinned", UserName: "testuser"},
+	}
+	referenced := map[string]bool{
+		"QmCustomerObject":             true,
+		models.EmptyCustomerObjectHash: true,
+	}
+	report := reconcile(pins, uploads, referenced)
+	if len(report.UnreferencedPins) != 1 || report.UnreferencedPins[0] != "QmUnreferenced" {
+		t.Fatalf("bad unreferenced pins: %v", report.UnreferencedPins)
+	}
+	if len(report.MissingPins) != 1 || report.MissingPins[0].Hash != "QmNotPinned" {
+		t.Fatalf("bad missing pins: %v", report.MissingPins)
+	}
+	if report.Empty() {
+		t.Fatal("expected report to have orphans")
+	}
+	if !reconcile(pins, nil, pins).Empty() {
+		t.Fatal("expected referenced pins to not be orphans")
+	}
+}
+
+func TestReferencedHashes(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.EncryptedUpload{}, &models.IPNS{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	util, err := NewPinUtil(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		encryptedHash = "testorphanencryptedhash"
+		ipnsHash      = "testorphanipnshash"
+	)
+	encrypted := &models.EncryptedUpload{UserName: "testorphanuser", NetworkName: PublicNetwork, IPFSHash: encryptedHash}
+	if err := db.Create(encrypted).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(encrypted)
+	ipns := &models.IPNS{IPNSHash: "testorphanipnsentry", CurrentIPFSHash: ipnsHash, NetworkName: PublicNetwork, UserName: "testorphanuser"}
+	if err := db.Create(ipns).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(ipns)
+	referenced, err := util.referencedHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{encryptedHash, ipnsHash, models.EmptyCustomerObjectHash} {
+		if !referenced[hash] {
+			t.Fatalf("expected %s to be referenced", hash)
+		}
+		if ok, err := util.isReferenced(PublicNetwork, hash); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatalf("expected %s to be referenced when rechecked", hash)
+		}
+	}
+	if ok, err := util.isReferenced(PublicNetwork, "testorphanunreferencedhash"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected hash to be unreferenced")
+	}
+}
+
+func TestSettledOrphans(t *testing.T) {
+	now := time.Now()
+	firstSeen := map[string]time.Time{
+		"QmOld":    now.Add(-48 * time.Hour),
+		"QmRecent": now.Add(-time.Hour),
+	}
+	settled, recent := SettledOrphans([]string{"QmOld", "QmRecent", "QmNew"}, firstSeen, 24*time.Hour, now)
+	if len(settled) != 1 || settled[0] != "QmOld" {
+		t.Fatalf("bad settled orphans: %v", settled)
+	}
+	if len(recent) != 2 {
+		t.Fatalf("bad recent orphans: %v", recent)
+	}
+}
+
+func TestDelegatorToken(t *testing.T) {
+	issued := time.Unix(1561939200, 0)
+	token, err := delegatorToken("secret", "temporal", "testuser", issued, issued.Add(delegatorTokenTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("bad token: %s", token)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != parts[2] {
+		t.Fatal("bad token signature")
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(claims) != `{"exp":1561942800,"id":"testuser","orig_iat":1561939200,"realm":"temporal"}` {
+		t.Fatalf("bad claims: %s", claims)
+	}
+	if _, err := delegatorToken("", "temporal", "testuser", issued, issued); err == nil {
+		t.Fatal("expected missing key to be refused")
+	}
+}
+
+func TestIsNetworkUser(t *testing.T) {
+	hn := &models.HostedNetwork{Owners: []string{"customer"}, Users: []string{"tutil"}}
+	if !isNetworkUser(hn, "tutil") || !isNetworkUser(hn, "customer") {
+		t.Fatal("expected members of the network to be users")
+	}
+	if isNetworkUser(hn, "stranger") || isNetworkUser(hn, "") {
+		t.Fatal("expected non members not to be users")
+	}
+}
+
+func TestPublicNode(t *testing.T) {
+	util := &Util{nodes: make(map[string]*node)}
+	for _, network := range []string{"", PublicNetwork} {
+		n, err := util.node(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.network != PublicNetwork || n.token != "" {
+			t.Fatalf("bad public node: %+v", n)
+		}
+	}
+	if _, err := util.node("myprivatenetwork"); err == nil {
+		t.Fatal("expected private network without configuration to be refused")
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	const secret = "supersecret"
+	var received WebhookPayload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if !VerifySignature(secret, r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	reminder := ReminderMessage{
+		UserName: "testuser",
+		Uploads: []models.Upload{
+			{Hash: testCID, NetworkName: "public", Type: "file", HoldTimeInMonths: 1},
+		},
+	}
+	if err := NewWebhookNotifier(srv.URL, secret).Notify(context.Background(), reminder); err != nil {
+		t.Fatal(err)
+	}
+	if received.UserName != "testuser" || len(received.Pins) != 1 || received.Pins[0].Hash != testCID {
+		t.Fatalf("bad payload received: %+v", received)
+	}
+	// a bad secret results in the request being rejected
+	if err := NewWebhookNotifier(srv.URL, "badsecret").Notify(context.Background(), reminder); err == nil {
+		t.Fatal("expected error for rejected webhook")
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://example.org/hooks/temporal", false},
+		{"", true},
+		{"example.org", true},
+		{"http://example.org/hooks/temporal", true},
+		{"https://", true},
+		{"https:///hooks/temporal", true},
+		{"https://exa mple.org", true},
+	}
+	for _, tt := range tests {
+		if err := validateWebhookURL(tt.url); (err != nil) != tt.wantErr {
+			t.Errorf("validateWebhookURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDispatcherDryRun(t *testing.T) {
+	var out bytes.Buffer
+	d := &Dispatcher{
+		Webhooks: map[string]Webhook{"hookuser": {UserName: "hookuser", URL: "https://example.org/hook"}},
+		DryRun:   &out,
+	}
+	emailReminder := ReminderMessage{
+		UserName:     "emailuser",
+		EmailAddress: "emailuser@example.org",
+		Message:      "pins expiring <ul><li>" + testCID + "</li></ul>",
+		Uploads:      []models.Upload{{Hash: testCID, NetworkName: "public"}},
+	}
+	hookReminder := ReminderMessage{
+		UserName: "hookuser",
+		Uploads:  []models.Upload{{Hash: testCID, NetworkName: "public"}},
+	}
+	if route := d.Route(emailReminder); route.Channel != ChannelEmail || route.Recipient != "emailuser@example.org" {
+		t.Fatalf("bad email route: %+v", route)
+	}
+	if route := d.Route(hookReminder); route.Channel != ChannelWebhook || route.Recipient != "https://example.org/hook" {
+		t.Fatalf("bad webhook route: %+v", route)
+	}
+	for _, reminder := range []ReminderMessage{emailReminder, hookReminder} {
+		if err := d.Notify(context.Background(), reminder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(out.String(), "==> user emailuser via email to emailuser@example.org") ||
+		!strings.Contains(out.String(), "==> user hookuser via webhook to https://example.org/hook") ||
+		!strings.Contains(out.String(), "- "+testCID) {
+		t.Fatalf("bad dry run output: %s", out.String())
+	}
+	// redirect overrides every route
+	d.Redirect = "ops@example.org"
+	if route := d.Route(hookReminder); route.Channel != ChannelEmail || route.Recipient != "ops@example.org" {
+		t.Fatalf("bad redirected route: %+v", route)
+	}
 }
 
 func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
@@ -0,0 +1,191 @@
+package pin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/credits"
+	"github.com/c2h5oh/datasize"
+	"github.com/jinzhu/gorm"
+)
+
+// RefundPolicy governs how much is refunded when a pin is removed
+type RefundPolicy string
+
+const (
+	// RefundFull refunds the hold time remaining, without the buffer
+	RefundFull RefundPolicy = "full"
+	// RefundProrated refunds the hold time remaining, less a 72 hour
+	// buffer. This is the refund Temporal issues when users remove pins
+	RefundProrated RefundPolicy = "prorated"
+	// RefundNone removes the pin without a refund
+	RefundNone RefundPolicy = "none"
+)
+
+// RefundPolicies are the refund policies that can be used when removing pins
+var RefundPolicies = []RefundPolicy{RefundFull, RefundProrated, RefundNone}
+
+// Billable returns whether pins of a tier are charged for in credits, and so
+// are refunded credits when removed. Unverified and free accounts are never
+// charged, and white labeled accounts are billed separately. Tiers must be
+// checked with Billable rather than ZeroCreditRefunds, which does not cover
+// unverified accounts, whose price is a 9999 credit placeholder.
+func Billable(tier models.DataUsageTier) bool {
+	switch tier {
+	case models.Paid, models.Partner:
+		return true
+	default:
+		return false
+	}
+}
+
+// ErrRemovalChanged is returned when applying a removal preview
+// for an upload which has changed since the preview was made
+var ErrRemovalChanged = errors.New("upload changed since the removal was previewed, please preview again")
+
+// ParseRefundPolicy is used to validate a refund policy by name
+func ParseRefundPolicy(name string) (RefundPolicy, error) {
+	for _, policy := range RefundPolicies {
+		if string(policy) == name {
+			return policy, nil
+		}
+	}
+	names := make([]string, len(RefundPolicies))
+	for i, policy := range RefundPolicies {
+		names[i] = string(policy)
+	}
+	return "", fmt.Errorf("invalid refund policy %q, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// RemovalPreview is what will happen when removing a pin
+type RemovalPreview struct {
+	Upload models.Upload
+	Tier   models.DataUsageTier
+	Policy RefundPolicy
+	// HoldTimeRemaining is the time until the pin would have been garbage collected
+	HoldTimeRemaining time.Duration
+	// Refund is the credits which will be refunded
+	Refund float64
+	// UsageBefore and UsageAfter are the data usage of the user
+	// before and after the removal
+	UsageBefore uint64
+	UsageAfter  uint64
+}
+
+// String returns a human readable summary of the preview
+func (p *RemovalPreview) String() string {
+	return fmt.Sprintf(
+		"user %s, hash %s, network %s\n"+
+			"tier %s, hold time remaining %s\n"+
+			"%s refund of %v credits\n"+
+			"data usage %v -> %v bytes",
+		p.Upload.UserName, p.Upload.Hash, p.Upload.NetworkName,
+		p.Tier, p.HoldTimeRemaining.Truncate(time.Hour), p.Policy, p.Refund,
+		p.UsageBefore, p.UsageAfter,
+	)
+}
+
+// PreviewRemoval is used to calculate the refund and usage
+// change of removing a pin, without making any changes
+func (u *Util) PreviewRemoval(username, hash, network string, policy RefundPolicy, now time.Time) (*RemovalPreview, error) {
+	if _, err := ParseRefundPolicy(string(policy)); err != nil {
+		return nil, err
+	}
+	upload, err := u.UP.FindUploadByHashAndUserAndNetwork(username, hash, network)
+	if err != nil {
+		return nil, err
+	}
+	usg, err := u.US.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	return u.previewUpload(upload, usg.Tier, usg.CurrentDataUsedBytes, policy, now)
+}
+
+// previewUpload is used to preview the removal of an upload by a user
+// in the given tier, whose data usage before the removal is usage
+func (u *Util) previewUpload(upload *models.Upload, tier models.DataUsageTier, usage uint64, policy RefundPolicy, now time.Time) (*RemovalPreview, error) {
+	preview := &RemovalPreview{
+		Upload:      *upload,
+		Tier:        tier,
+		Policy:      policy,
+		UsageBefore: usage,
+	}
+	if remaining := upload.GarbageCollectDate.Sub(now); remaining > 0 {
+		preview.HoldTimeRemaining = remaining
+	}
+	if uint64(upload.Size) < usage {
+		preview.UsageAfter = usage - uint64(upload.Size)
+	}
+	if !Billable(tier) {
+		return preview, nil
+	}
+	switch policy {
+	case RefundProrated:
+		refund, err := u.UP.CalculateRefundCost(upload, now)
+		if err != nil {
+			return nil, err
+		}
+		preview.Refund = refund
+	case RefundFull:
+		preview.Refund = fullRefund(upload, tier, now)
+	}
+	return preview, nil
+}
+
+// fullRefund returns the cost of the hold time of an upload remaining at now
+func fullRefund(upload *models.Upload, tier models.DataUsageTier, now time.Time) float64 {
+	if !Billable(tier) {
+		return 0
+	}
+	hours := upload.GarbageCollectDate.Sub(now).Truncate(time.Hour).Hours()
+	if hours <= 0 {
+		return 0
+	}
+	sizeGigabytes := float64(upload.Size) / float64(datasize.GB.Bytes())
+	return sizeGigabytes * tier.PricePerGBPerHour() * hours
+}
+
+// ApplyRemoval is used to remove the pin of a preview, refunding the
+// previewed credits and reducing data usage in a single transaction.
+// Refunds are recorded in the credit ledger by the operator. If the upload
+// changed since the preview was made, nothing is applied and
+// ErrRemovalChanged is returned.
+func (u *Util) ApplyRemoval(preview *RemovalPreview, operator string) error {
+	tx := u.UP.DB.Begin()
+	if err := applyRemoval(tx, preview, operator); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func applyRemoval(tx *gorm.DB, preview *RemovalPreview, operator string) error {
+	upload := preview.Upload
+	check := tx.Where(
+		"garbage_collect_date = ? AND size = ?", upload.GarbageCollectDate, upload.Size,
+	).Delete(&upload)
+	if check.Error != nil {
+		return check.Error
+	}
+	if check.RowsAffected == 0 {
+		return ErrRemovalChanged
+	}
+	if preview.Refund > 0 {
+		if _, err := credits.AdjustTx(tx, credits.Adjustment{
+			UserName: upload.UserName,
+			Amount:   preview.Refund,
+			Reason:   credits.ReasonRefund,
+			Note: fmt.Sprintf(
+				"%s refund for removal of %s from network %s", preview.Policy, upload.Hash, upload.NetworkName,
+			),
+			Operator: operator,
+		}); err != nil {
+			return err
+		}
+	}
+	return models.NewUsageManager(tx).ReduceDataUsage(upload.UserName, uint64(upload.Size))
+}
@@ -0,0 +1,140 @@
+package pin
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+)
+
+// ErrEmptyFilter is returned when an upload filter would select every upload
+var ErrEmptyFilter = errors.New("upload filter must select by user, hashes, age or type")
+
+// UploadFilter selects uploads of a network to operate on. Every set
+// field must match, and at least one field other than network must be set
+type UploadFilter struct {
+	Network string
+	// AllNetworks selects uploads of every network, ignoring Network
+	AllNetworks bool
+	UserName    string
+	Hashes      []string
+	// OlderThan selects uploads created more than this long ago
+	OlderThan time.Duration
+	// Type selects uploads of an upload type, such as file or pin
+	Type string
+}
+
+func (f UploadFilter) empty() bool {
+	return f.UserName == "" && len(f.Hashes) == 0 && f.OlderThan <= 0 && f.Type == ""
+}
+
+// RemovalResult is the outcome of removing a single pin
+type RemovalResult struct {
+	Preview *RemovalPreview
+	Err     error
+}
+
+// ReadHashes is used to read a list of hashes, one per line. Blank
+// lines, and lines starting with # are ignored
+func ReadHashes(r io.Reader) ([]string, error) {
+	var hashes []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hashes = append(hashes, line)
+	}
+	return hashes, scanner.Err()
+}
+
+// FindUploads is used to find the uploads selected by a filter
+func (u *Util) FindUploads(filter UploadFilter, now time.Time) ([]models.Upload, error) {
+	if filter.empty() {
+		return nil, ErrEmptyFilter
+	}
+	network := filter.Network
+	if filter.AllNetworks {
+		network = ""
+	} else if isPublic(network) {
+		network = PublicNetwork
+	}
+	query := u.uploadsInNetwork(network)
+	if filter.UserName != "" {
+		query = query.Where("user_name = ?", filter.UserName)
+	}
+	if len(filter.Hashes) > 0 {
+		query = query.Where("hash IN (?)", filter.Hashes)
+	}
+	if filter.OlderThan > 0 {
+		query = query.Where("created_at < ?", now.Add(-filter.OlderThan))
+	}
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	var uploads []models.Upload
+	if err := query.Order("user_name, id").Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
+
+// PreviewRemovals is used to preview the removal of every upload selected
+// by a filter. The usage change of each preview accounts for the
+// previews of the same user before it.
+func (u *Util) PreviewRemovals(filter UploadFilter, policy RefundPolicy, now time.Time) ([]*RemovalPreview, error) {
+	if _, err := ParseRefundPolicy(string(policy)); err != nil {
+		return nil, err
+	}
+	uploads, err := u.FindUploads(filter, now)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		previews = make([]*RemovalPreview, 0, len(uploads))
+		usages   = make(map[string]*models.Usage)
+	)
+	for i := range uploads {
+		upload := &uploads[i]
+		usg, ok := usages[upload.UserName]
+		if !ok {
+			if usg, err = u.US.FindByUserName(upload.UserName); err != nil {
+				return nil, err
+			}
+			usages[upload.UserName] = usg
+		}
+		preview, err := u.previewUpload(upload, usg.Tier, usg.CurrentDataUsedBytes, policy, now)
+		if err != nil {
+			return nil, err
+		}
+		usg.CurrentDataUsedBytes = preview.UsageAfter
+		previews = append(previews, preview)
+	}
+	return previews, nil
+}
+
+// TotalRefund returns the total credits refunded by removal previews
+func TotalRefund(previews []*RemovalPreview) float64 {
+	var total float64
+	for _, preview := range previews {
+		total += preview.Refund
+	}
+	return total
+}
+
+// ApplyRemovals is used to apply removal previews one at a time, so
+// that a failed removal does not prevent the others from being applied
+func (u *Util) ApplyRemovals(previews []*RemovalPreview, operator string) []RemovalResult {
+	results := make([]RemovalResult, 0, len(previews))
+	for _, preview := range previews {
+		results = append(results, RemovalResult{
+			Preview: preview,
+			Err:     u.ApplyRemoval(preview, operator),
+		})
+	}
+	return results
+}
@@ -0,0 +1,262 @@
+package pin
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Report dimensions uploads can be grouped by
+const (
+	ByUser    = "user"
+	ByTier    = "tier"
+	ByType    = "type"
+	ByNetwork = "network"
+)
+
+// ReportDimensions are the dimensions uploads can be grouped by, in column order
+var ReportDimensions = []string{ByUser, ByTier, ByType, ByNetwork}
+
+// ReportFormats are the formats a report can be written in
+var ReportFormats = []string{"table", "csv", "json"}
+
+// ParseReportDimensions is used to validate a comma separated list of dimensions
+func ParseReportDimensions(list string) ([]string, error) {
+	var by []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		valid := false
+		for _, dim := range ReportDimensions {
+			if dim == name {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid dimension %q, must be one of %s", name, strings.Join(ReportDimensions, ", "))
+		}
+		by = append(by, name)
+	}
+	return by, nil
+}
+
+// ReportGroup summarizes the uploads sharing the same values for the
+// dimensions of a report. Dimensions not grouped by are empty.
+type ReportGroup struct {
+	UserName string `json:"user_name,omitempty"`
+	Tier     string `json:"tier,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Network  string `json:"network,omitempty"`
+	Count    int    `json:"count"`
+	Bytes    int64  `json:"bytes"`
+	// Expired are uploads past their garbage collection date
+	// which have not been garbage collected yet
+	Expired int `json:"expired"`
+	// Expiring1, Expiring7 and Expiring30 are uploads which
+	// expire within the next 1, 7 and 30 days
+	Expiring1  int `json:"expiring_1d"`
+	Expiring7  int `json:"expiring_7d"`
+	Expiring30 int `json:"expiring_30d"`
+}
+
+// Report is an inventory of uploads grouped by dimensions
+type Report struct {
+	GeneratedAt time.Time     `json:"generated_at"`
+	By          []string      `json:"by"`
+	Groups      []ReportGroup `json:"groups"`
+	Total       ReportGroup   `json:"total"`
+}
+
+// reportColumns are the expressions uploads are grouped by for each
+// dimension. Uploads of users without a usage record have no tier
+var reportColumns = map[string]string{
+	ByUser:    "uploads.user_name",
+	ByTier:    "COALESCE(usages.tier, '')",
+	ByType:    "uploads.type",
+	ByNetwork: "CASE WHEN uploads.network_name = '' THEN '" + PublicNetwork + "' ELSE uploads.network_name END",
+}
+
+// reportAliases are the ReportGroup columns each dimension is scanned into
+var reportAliases = map[string]string{
+	ByUser:    "user_name",
+	ByTier:    "tier",
+	ByType:    "type",
+	ByNetwork: "network",
+}
+
+// reportCounts counts the uploads of a group, and how many are expired
+// or expiring within 1, 7 and 30 days of the time given as arguments
+const reportCounts = `COUNT(*) AS count,
+	CAST(COALESCE(SUM(uploads.size), 0) AS BIGINT) AS bytes,
+	COALESCE(SUM(CASE WHEN uploads.garbage_collect_date < ? THEN 1 ELSE 0 END), 0) AS expired,
+	COALESCE(SUM(CASE WHEN uploads.garbage_collect_date >= ? AND uploads.garbage_collect_date <= ? THEN 1 ELSE 0 END), 0) AS expiring1,
+	COALESCE(SUM(CASE WHEN uploads.garbage_collect_date >= ? AND uploads.garbage_collect_date <= ? THEN 1 ELSE 0 END), 0) AS expiring7,
+	COALESCE(SUM(CASE WHEN uploads.garbage_collect_date >= ? AND uploads.garbage_collect_date <= ? THEN 1 ELSE 0 END), 0) AS expiring30`
+
+// Report is used to summarize the uploads of network, or every network
+// if network is empty, grouped by the given dimensions. If username is
+// set, only the uploads of that user are included. Uploads are summarized
+// by the database, so they are never loaded.
+func (u *Util) Report(network, username string, by []string, now time.Time) (*Report, error) {
+	query := u.uploadsInNetwork(network).Joins(
+		"LEFT JOIN usages ON usages.user_name = uploads.user_name AND usages.deleted_at IS NULL",
+	)
+	if username != "" {
+		query = query.Where("uploads.user_name = ?", username)
+	}
+	var (
+		columns = make([]string, 0, len(by)+1)
+		groupBy = make([]string, 0, len(by))
+	)
+	for _, dim := range by {
+		column, ok := reportColumns[dim]
+		if !ok {
+			return nil, fmt.Errorf("invalid dimension %q, must be one of %s", dim, strings.Join(ReportDimensions, ", "))
+		}
+		columns = append(columns, column+" AS "+reportAliases[dim])
+		groupBy = append(groupBy, column)
+	}
+	columns = append(columns, reportCounts)
+	query = query.Select(
+		strings.Join(columns, ", "), now,
+		now, now.Add(24*time.Hour),
+		now, now.AddDate(0, 0, 7),
+		now, now.AddDate(0, 0, 30),
+	)
+	if len(groupBy) > 0 {
+		query = query.Group(strings.Join(groupBy, ", "))
+	}
+	var groups []ReportGroup
+	if err := query.Scan(&groups).Error; err != nil {
+		return nil, err
+	}
+	return newReport(groups, by, now), nil
+}
+
+// newReport totals the groups of a report, sorted by dimension values
+func newReport(groups []ReportGroup, by []string, now time.Time) *Report {
+	report := &Report{GeneratedAt: now, By: by, Groups: []ReportGroup{}}
+	for _, group := range groups {
+		// without dimensions an empty inventory is a single empty group
+		if group.Count == 0 {
+			continue
+		}
+		report.Groups = append(report.Groups, group)
+		report.Total.Count += group.Count
+		report.Total.Bytes += group.Bytes
+		report.Total.Expired += group.Expired
+		report.Total.Expiring1 += group.Expiring1
+		report.Total.Expiring7 += group.Expiring7
+		report.Total.Expiring30 += group.Expiring30
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		a, b := report.Groups[i].values(by), report.Groups[j].values(by)
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return report
+}
+
+// values returns the values of the dimensions of the group
+func (g *ReportGroup) values(by []string) []string {
+	values := make([]string, len(by))
+	for i, dim := range by {
+		switch dim {
+		case ByUser:
+			values[i] = g.UserName
+		case ByTier:
+			values[i] = g.Tier
+		case ByType:
+			values[i] = g.Type
+		case ByNetwork:
+			values[i] = g.Network
+		}
+	}
+	return values
+}
+
+// counts returns the counts of the group, formatted for output
+func (g *ReportGroup) counts() []string {
+	return []string{
+		strconv.Itoa(g.Count),
+		strconv.FormatInt(g.Bytes, 10),
+		strconv.Itoa(g.Expired),
+		strconv.Itoa(g.Expiring1),
+		strconv.Itoa(g.Expiring7),
+		strconv.Itoa(g.Expiring30),
+	}
+}
+
+func (r *Report) header() []string {
+	return append(append([]string{}, r.By...), "count", "bytes", "expired", "expiring_1d", "expiring_7d", "expiring_30d")
+}
+
+// Write is used to write the report in one of ReportFormats
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "table":
+		return r.WriteTable(w)
+	case "csv":
+		return r.WriteCSV(w)
+	case "json":
+		return r.WriteJSON(w)
+	default:
+		return fmt.Errorf("invalid format %q, must be one of %s", format, strings.Join(ReportFormats, ", "))
+	}
+}
+
+// WriteTable is used to write the report as an aligned table, followed by a total
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(r.header(), "\t"))
+	for _, group := range r.Groups {
+		values := group.values(r.By)
+		for i, value := range values {
+			if value == "" {
+				values[i] = "-"
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(append(values, group.counts()...), "\t"))
+	}
+	total := make([]string, len(r.By))
+	if len(total) > 0 {
+		total[0] = "total"
+	}
+	fmt.Fprintln(tw, strings.Join(append(total, r.Total.counts()...), "\t"))
+	return tw.Flush()
+}
+
+// WriteCSV is used to write the report as csv, without the total
+func (r *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(r.header()); err != nil {
+		return err
+	}
+	for _, group := range r.Groups {
+		if err := cw.Write(append(group.values(r.By), group.counts()...)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON is used to write the report as indented json
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,246 @@
+// Package suspension provides reversible suspension of user accounts,
+// recording a history of every suspension and reactivation
+package suspension
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// SuspendedSubject is the subject of emails notifying users of a suspension
+	SuspendedSubject = "Temporal: Your Account Has Been Suspended"
+	// ReactivatedSubject is the subject of emails notifying users of a reactivation
+	ReactivatedSubject = "Temporal: Your Account Has Been Reactivated"
+)
+
+var (
+	// ErrAlreadySuspended is returned when suspending a suspended account
+	ErrAlreadySuspended = errors.New("account is already suspended")
+	// ErrNotSuspended is returned when reactivating an account which is not suspended
+	ErrNotSuspended = errors.New("account is not suspended")
+	// ErrAccountDisabled is returned when suspending an account which
+	// was disabled by other means, such as deletion
+	ErrAccountDisabled = errors.New("account is disabled but not suspended, refusing to suspend")
+	// ErrOperatorRequired is returned when a change does not say who made it
+	ErrOperatorRequired = errors.New("operator is required to suspend or reactivate an account")
+	// ErrDeletionPending is returned when reactivating an account which is
+	// scheduled for deletion, as the deletion must be cancelled instead
+	ErrDeletionPending = errors.New("account is scheduled for deletion, cancel the deletion instead of reactivating it")
+	// ErrReasonRequired is returned when a change does not say why it was made
+	ErrReasonRequired = errors.New("reason is required to suspend or reactivate an account")
+)
+
+// Suspension is a record of an account being suspended, and reactivated
+type Suspension struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255);index"`
+	Reason   string `gorm:"type:text"`
+	Operator string `gorm:"type:varchar(255)"`
+	// FreezeGC is whether the pins of the account are not
+	// garbage collected while the account is suspended
+	FreezeGC bool
+	// ReactivatedAt is nil while the account is suspended
+	ReactivatedAt      *time.Time
+	ReactivatedBy      string `gorm:"type:varchar(255)"`
+	ReactivationReason string `gorm:"type:text"`
+}
+
+// TableName sets the table used to store suspensions
+func (Suspension) TableName() string {
+	return "account_suspensions"
+}
+
+// Active returns whether the suspension has not been reactivated
+func (s *Suspension) Active() bool {
+	return s.ReactivatedAt == nil
+}
+
+// Manager is used to suspend and reactivate accounts
+type Manager struct {
+	db *gorm.DB
+}
+
+// NewManager instantiates the suspension manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{db: db}
+}
+
+// Suspend is used to disable login and API access of an account, which
+// Temporal refuses for disabled accounts. If freezeGC is set, the pins
+// of the account are not garbage collected until it is reactivated.
+func (m *Manager) Suspend(username, reason, operator string, freezeGC bool) (*Suspension, error) {
+	if err := validate(reason, operator); err != nil {
+		return nil, err
+	}
+	tx := m.db.Begin()
+	s, err := suspend(tx, username, reason, operator, freezeGC)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return s, tx.Commit().Error
+}
+
+// Reactivate is used to restore login and API access of a suspended
+// account, and resume garbage collection of its pins. Accounts which
+// are scheduled for deletion are not reactivated.
+func (m *Manager) Reactivate(username, reason, operator string, now time.Time) (*Suspension, error) {
+	if err := validate(reason, operator); err != nil {
+		return nil, err
+	}
+	tx := m.db.Begin()
+	s, err := reactivate(tx, username, reason, operator, now)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return s, tx.Commit().Error
+}
+
+// Active returns the active suspension of an account,
+// or ErrNotSuspended if the account is not suspended
+func (m *Manager) Active(username string) (*Suspension, error) {
+	return active(m.db, username)
+}
+
+// History is used to list the suspensions of an account, oldest first
+func (m *Manager) History(username string) ([]Suspension, error) {
+	var suspensions []Suspension
+	if err := m.db.Where("user_name = ?", username).Order("id").Find(&suspensions).Error; err != nil {
+		return nil, err
+	}
+	return suspensions, nil
+}
+
+// Frozen returns a subquery of the users whose pins must not be garbage collected
+func Frozen(db *gorm.DB) interface{} {
+	return db.Model(&Suspension{}).Select("user_name").Where(
+		"freeze_gc = ? AND reactivated_at IS NULL", true,
+	).QueryExpr()
+}
+
+// Notice returns the html body of the email notifying a user of a
+// suspension, or of a reactivation if the suspension is not active
+func Notice(s *Suspension) string {
+	if s.Active() {
+		return fmt.Sprintf(
+			"Your Temporal account %s has been suspended, and you will not be able to login or use the API until it is reactivated.<br>Reason: %s",
+			html.EscapeString(s.UserName), html.EscapeString(s.Reason),
+		)
+	}
+	return fmt.Sprintf(
+		"Your Temporal account %s has been reactivated, and you are able to login and use the API again.<br>Reason: %s",
+		html.EscapeString(s.UserName), html.EscapeString(s.ReactivationReason),
+	)
+}
+
+func validate(reason, operator string) error {
+	if operator == "" {
+		return ErrOperatorRequired
+	}
+	if reason == "" {
+		return ErrReasonRequired
+	}
+	return nil
+}
+
+func suspend(tx *gorm.DB, username, reason, operator string, freezeGC bool) (*Suspension, error) {
+	user, err := lockUser(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := active(tx, username); err == nil {
+		return nil, ErrAlreadySuspended
+	} else if err != ErrNotSuspended {
+		return nil, err
+	}
+	if !user.AccountEnabled {
+		return nil, ErrAccountDisabled
+	}
+	if err := tx.Model(user).UpdateColumn("account_enabled", false).Error; err != nil {
+		return nil, err
+	}
+	s := &Suspension{
+		UserName: username,
+		Reason:   reason,
+		Operator: operator,
+		FreezeGC: freezeGC,
+	}
+	if err := tx.Create(s).Error; err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func reactivate(tx *gorm.DB, username, reason, operator string, now time.Time) (*Suspension, error) {
+	user, err := lockUser(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	s, err := active(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	if pending, err := deletionPending(tx, username); err != nil {
+		return nil, err
+	} else if pending {
+		return nil, ErrDeletionPending
+	}
+	if err := tx.Model(user).UpdateColumn("account_enabled", true).Error; err != nil {
+		return nil, err
+	}
+	s.ReactivatedAt = &now
+	s.ReactivatedBy = operator
+	s.ReactivationReason = reason
+	if err := tx.Save(s).Error; err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// lockUser finds a user, locking it so concurrent changes can't read a stale state
+func lockUser(tx *gorm.DB, username string) (*models.User, error) {
+	user := &models.User{}
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+		"user_name = ?", username,
+	).First(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// deletionRequests is the table the user package stores scheduled
+// deletions in, which can't be imported here as it imports suspensions
+const deletionRequests = "user_deletion_requests"
+
+// deletionPending returns whether the account is scheduled for deletion
+func deletionPending(db *gorm.DB, username string) (bool, error) {
+	if !db.HasTable(deletionRequests) {
+		return false, nil
+	}
+	var count int
+	if err := db.Table(deletionRequests).Where(
+		"user_name = ? AND cancelled_at IS NULL AND completed_at IS NULL AND deleted_at IS NULL", username,
+	).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func active(db *gorm.DB, username string) (*Suspension, error) {
+	s := &Suspension{}
+	err := db.Where("user_name = ? AND reactivated_at IS NULL", username).Last(s).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrNotSuspended
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
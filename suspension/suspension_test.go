@@ -0,0 +1,125 @@
+package suspension
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestValidate(t *testing.T) {
+	m := NewManager(nil)
+	if _, err := m.Suspend("testuser", "fraud", "", false); err != ErrOperatorRequired {
+		t.Fatalf("expected ErrOperatorRequired, got %v", err)
+	}
+	if _, err := m.Suspend("testuser", "", "tester", false); err != ErrReasonRequired {
+		t.Fatalf("expected ErrReasonRequired, got %v", err)
+	}
+	if _, err := m.Reactivate("testuser", "", "tester", time.Now()); err != ErrReasonRequired {
+		t.Fatalf("expected ErrReasonRequired, got %v", err)
+	}
+}
+
+func TestNotice(t *testing.T) {
+	s := &Suspension{UserName: "testuser", Reason: "chargeback <investigation>"}
+	if notice := Notice(s); !strings.Contains(notice, "suspended") || !strings.Contains(notice, "chargeback &lt;investigation&gt;") {
+		t.Fatalf("unexpected suspension notice: %s", notice)
+	}
+	now := time.Now()
+	s.ReactivatedAt = &now
+	s.ReactivationReason = "resolved"
+	if notice := Notice(s); !strings.Contains(notice, "reactivated") || !strings.Contains(notice, "resolved") {
+		t.Fatalf("unexpected reactivation notice: %s", notice)
+	}
+}
+
+func TestManager(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Suspension{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	usr, err := models.NewUserManager(db).NewUserAccount("testsuspenduser", "password123", "testsuspenduser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&models.Usage{})
+	defer db.Unscoped().Where("user_name = ?", usr.UserName).Delete(&Suspension{})
+	m := NewManager(db)
+	if _, err := m.Reactivate(usr.UserName, "resolved", "tester", time.Now()); err != ErrNotSuspended {
+		t.Fatalf("expected ErrNotSuspended, got %v", err)
+	}
+	if _, err := m.Suspend(usr.UserName, "chargeback", "tester", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Suspend(usr.UserName, "chargeback", "tester", true); err != ErrAlreadySuspended {
+		t.Fatalf("expected ErrAlreadySuspended, got %v", err)
+	}
+	if enabled, err := accountEnabled(db, usr.UserName); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Fatal("expected account to be disabled")
+	}
+	var frozen []string
+	if err := db.Model(&models.User{}).Where(
+		"user_name IN (?)", Frozen(db),
+	).Pluck("user_name", &frozen).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(frozen) != 1 || frozen[0] != usr.UserName {
+		t.Fatalf("expected garbage collection of %s to be frozen, got %v", usr.UserName, frozen)
+	}
+	s, err := m.Reactivate(usr.UserName, "resolved", "tester", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Active() || s.ReactivatedBy != "tester" {
+		t.Fatalf("unexpected reactivation %+v", s)
+	}
+	if enabled, err := accountEnabled(db, usr.UserName); err != nil {
+		t.Fatal(err)
+	} else if !enabled {
+		t.Fatal("expected account to be enabled")
+	}
+	history, err := m.History(usr.UserName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("expected 1 suspension, got %v", len(history))
+	}
+	// accounts disabled by other means are not suspended
+	if err := db.Model(usr).UpdateColumn("account_enabled", false).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Suspend(usr.UserName, "chargeback", "tester", false); err != ErrAccountDisabled {
+		t.Fatalf("expected ErrAccountDisabled, got %v", err)
+	}
+}
+
+func accountEnabled(db *gorm.DB, username string) (bool, error) {
+	usr, err := models.NewUserManager(db).FindByUserName(username)
+	if err != nil {
+		return false, err
+	}
+	return usr.AccountEnabled, nil
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
@@ -0,0 +1,299 @@
+// Package takedown provides removal of abusive content from every
+// account pinning it, and a blocklist of content which was taken down
+package takedown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/tutil/mail"
+	"github.com/RTradeLtd/tutil/pin"
+	"github.com/jinzhu/gorm"
+)
+
+// NoticeSubject is the subject of emails notifying users of a takedown
+const NoticeSubject = "Temporal: Content Removed From Your Account"
+
+var (
+	// ErrHashRequired is returned when taking down content without a hash
+	ErrHashRequired = errors.New("hash is required for a takedown")
+	// ErrReasonRequired is returned when taking down content without saying why
+	ErrReasonRequired = errors.New("reason is required for a takedown")
+	// ErrNotBlocked is returned when unblocking a hash which is not blocked
+	ErrNotBlocked = errors.New("hash is not on the blocklist")
+)
+
+// Block is a hash which was taken down. The blocklist is only enforced
+// by pin orphans, which does not repin blocked content; Temporal itself
+// does not read it, so users are able to pin blocked content again
+type Block struct {
+	gorm.Model
+	Hash string `gorm:"type:varchar(255);unique"`
+	// Reason is why the content was taken down
+	Reason string `gorm:"type:text"`
+	// Reference identifies the request the takedown was made
+	// for, such as the case number of a DMCA notice
+	Reference string `gorm:"type:varchar(255)"`
+	Operator  string `gorm:"type:varchar(255)"`
+}
+
+// TableName sets the table used to store the blocklist
+func (Block) TableName() string {
+	return "takedown_blocklist"
+}
+
+// Request is a takedown to perform
+type Request struct {
+	Hash      string
+	Reason    string
+	Reference string
+	Operator  string
+	// Notify is whether to email the users whose uploads were removed
+	Notify bool
+}
+
+// Plan is what will happen when taking down a hash
+type Plan struct {
+	Hash   string
+	Policy pin.RefundPolicy
+	// Removals are the uploads of the hash, in every network
+	Removals []*pin.RemovalPreview
+}
+
+// Networks returns the networks the hash will be unpinned from, which is
+// the networks of its uploads, or the public network if there are none
+func (p *Plan) Networks() []string {
+	seen := make(map[string]bool)
+	for _, removal := range p.Removals {
+		network := removal.Upload.NetworkName
+		if network == "" {
+			network = pin.PublicNetwork
+		}
+		seen[network] = true
+	}
+	if len(seen) == 0 {
+		return []string{pin.PublicNetwork}
+	}
+	networks := make([]string, 0, len(seen))
+	for network := range seen {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// Users returns the users whose uploads will be removed
+func (p *Plan) Users() []string {
+	seen := make(map[string]bool)
+	var users []string
+	for _, removal := range p.Removals {
+		if !seen[removal.Upload.UserName] {
+			seen[removal.Upload.UserName] = true
+			users = append(users, removal.Upload.UserName)
+		}
+	}
+	return users
+}
+
+// Result is the outcome of a takedown. Failures of individual steps are
+// recorded rather than stopping the takedown, so that as much of the
+// content is removed as possible.
+type Result struct {
+	Block    *Block
+	Removals []pin.RemovalResult
+	// Unpinned are the networks the hash was unpinned from
+	Unpinned []string
+	// UnpinErrors are the errors unpinning from each network
+	UnpinErrors map[string]error
+	// Notified are the users emailed about the takedown
+	Notified []string
+	// NotifyErrors are the errors notifying each user
+	NotifyErrors map[string]error
+}
+
+// Failed returns whether any step of the takedown failed
+func (r *Result) Failed() bool {
+	for _, removal := range r.Removals {
+		if removal.Err != nil {
+			return true
+		}
+	}
+	return len(r.UnpinErrors) > 0 || len(r.NotifyErrors) > 0
+}
+
+// Manager is used to take down content
+type Manager struct {
+	db   *gorm.DB
+	pins *pin.Util
+}
+
+// NewManager instantiates a takedown manager
+func NewManager(db *gorm.DB, pins *pin.Util) *Manager {
+	return &Manager{db: db, pins: pins}
+}
+
+// Plan is used to preview taking down a hash, finding the uploads
+// of every user in every network which reference it
+func (m *Manager) Plan(hash string, policy pin.RefundPolicy, now time.Time) (*Plan, error) {
+	if hash == "" {
+		return nil, ErrHashRequired
+	}
+	removals, err := m.pins.PreviewRemovals(pin.UploadFilter{
+		AllNetworks: true,
+		Hashes:      []string{hash},
+	}, policy, now)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{Hash: hash, Policy: policy, Removals: removals}, nil
+}
+
+// Apply is used to take down the hash of a plan. The hash is added to the
+// blocklist first, so the takedown is recorded even if later steps fail.
+// Uploads are then removed and refunded according to the plan, the hash is
+// unpinned from every network, and affected users are notified.
+func (m *Manager) Apply(ctx context.Context, plan *Plan, req Request) (*Result, error) {
+	if req.Reason == "" {
+		return nil, ErrReasonRequired
+	}
+	if req.Hash != plan.Hash {
+		return nil, fmt.Errorf("takedown of %s does not match plan for %s", req.Hash, plan.Hash)
+	}
+	block, err := m.Block(req)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{
+		Block:        block,
+		Removals:     m.pins.ApplyRemovals(plan.Removals, req.Operator),
+		UnpinErrors:  make(map[string]error),
+		NotifyErrors: make(map[string]error),
+	}
+	for _, network := range plan.Networks() {
+		if err := m.pins.Unpin(ctx, network, plan.Hash); err != nil {
+			result.UnpinErrors[network] = err
+			continue
+		}
+		result.Unpinned = append(result.Unpinned, network)
+	}
+	if !req.Notify {
+		return result, nil
+	}
+	removed := make(map[string][]pin.RemovalResult)
+	var users []string
+	for _, removal := range result.Removals {
+		if removal.Err != nil {
+			continue
+		}
+		username := removal.Preview.Upload.UserName
+		if _, ok := removed[username]; !ok {
+			users = append(users, username)
+		}
+		removed[username] = append(removed[username], removal)
+	}
+	for _, username := range users {
+		if err := m.notify(username, req, removed[username]); err != nil {
+			result.NotifyErrors[username] = err
+			continue
+		}
+		result.Notified = append(result.Notified, username)
+	}
+	return result, nil
+}
+
+// notify is used to email a user about the removal of their uploads
+func (m *Manager) notify(username string, req Request, removals []pin.RemovalResult) error {
+	user, err := m.pins.UM.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	_, err = m.pins.Mail.Send(
+		mail.NewMessage(NoticeSubject, Notice(req, removals)), user.UserName, user.EmailAddress,
+	)
+	return err
+}
+
+// Notice returns the html body of the email notifying a user of a takedown
+func Notice(req Request, removals []pin.RemovalResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b,
+		"The following content has been removed from your account: %s<br>",
+		html.EscapeString(req.Reason),
+	)
+	if req.Reference != "" {
+		fmt.Fprintf(&b, "Reference: %s<br>", html.EscapeString(req.Reference))
+	}
+	b.WriteString("<ul>")
+	for _, removal := range removals {
+		upload := removal.Preview.Upload
+		fmt.Fprintf(&b, "<li>%s on network %s", html.EscapeString(upload.Hash), html.EscapeString(upload.NetworkName))
+		if removal.Preview.Refund > 0 {
+			fmt.Fprintf(&b, ", refunded %v credits", removal.Preview.Refund)
+		}
+		b.WriteString("</li>")
+	}
+	b.WriteString("</ul>")
+	return b.String()
+}
+
+// Block is used to add a hash to the blocklist, replacing any existing entry
+func (m *Manager) Block(req Request) (*Block, error) {
+	if req.Hash == "" {
+		return nil, ErrHashRequired
+	}
+	if req.Reason == "" {
+		return nil, ErrReasonRequired
+	}
+	block := &Block{}
+	if err := m.db.Unscoped().Where(
+		"hash = ?", req.Hash,
+	).First(block).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	// re-use any previously removed entry to honor the unique constraint
+	block.Hash = req.Hash
+	block.Reason = req.Reason
+	block.Reference = req.Reference
+	block.Operator = req.Operator
+	block.DeletedAt = nil
+	if err := m.db.Unscoped().Save(block).Error; err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Unblock is used to remove a hash from the blocklist. Content
+// which was taken down is not restored.
+func (m *Manager) Unblock(hash string) error {
+	check := m.db.Where("hash = ?", hash).Delete(&Block{})
+	if check.Error != nil {
+		return check.Error
+	}
+	if check.RowsAffected == 0 {
+		return ErrNotBlocked
+	}
+	return nil
+}
+
+// IsBlocked returns whether a hash is on the blocklist
+func (m *Manager) IsBlocked(hash string) (bool, error) {
+	var count int
+	if err := m.db.Model(&Block{}).Where("hash = ?", hash).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Blocklist returns every blocked hash, oldest first
+func (m *Manager) Blocklist() ([]Block, error) {
+	var blocks []Block
+	if err := m.db.Order("id").Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
@@ -0,0 +1,143 @@
+package takedown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/pin"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+const testHash = "QmS4ustL54uo8FzR9455qaxZwuMiUhyvMcX9Ba8nUH4uVv"
+
+func TestPlan(t *testing.T) {
+	plan := &Plan{Hash: testHash}
+	if got := plan.Networks(); !reflect.DeepEqual(got, []string{pin.PublicNetwork}) {
+		t.Fatalf("expected plans without uploads to unpin from the public network, got %v", got)
+	}
+	for _, upload := range []models.Upload{
+		{UserName: "b", NetworkName: "private"},
+		{UserName: "a", NetworkName: ""},
+		{UserName: "b", NetworkName: pin.PublicNetwork},
+	} {
+		plan.Removals = append(plan.Removals, &pin.RemovalPreview{Upload: upload})
+	}
+	if got := plan.Networks(); !reflect.DeepEqual(got, []string{"private", pin.PublicNetwork}) {
+		t.Fatalf("unexpected networks %v", got)
+	}
+	if got := plan.Users(); !reflect.DeepEqual(got, []string{"b", "a"}) {
+		t.Fatalf("unexpected users %v", got)
+	}
+	m := NewManager(nil, nil)
+	if _, err := m.Plan("", pin.RefundNone, time.Now()); err != ErrHashRequired {
+		t.Fatalf("expected ErrHashRequired, got %v", err)
+	}
+	if _, err := m.Apply(context.Background(), plan, Request{Hash: testHash}); err != ErrReasonRequired {
+		t.Fatalf("expected ErrReasonRequired, got %v", err)
+	}
+	if _, err := m.Apply(context.Background(), plan, Request{Hash: "QmOther", Reason: "dmca"}); err == nil {
+		t.Fatal("expected a request not matching the plan to be refused")
+	}
+}
+
+func TestResultFailed(t *testing.T) {
+	result := &Result{
+		Removals:     []pin.RemovalResult{{Preview: &pin.RemovalPreview{}}},
+		UnpinErrors:  map[string]error{},
+		NotifyErrors: map[string]error{},
+	}
+	if result.Failed() {
+		t.Fatal("expected result to succeed")
+	}
+	result.NotifyErrors["a"] = errors.New("suppressed")
+	if !result.Failed() {
+		t.Fatal("expected notify errors to fail the result")
+	}
+	result.NotifyErrors = map[string]error{}
+	result.Removals = append(result.Removals, pin.RemovalResult{Err: pin.ErrRemovalChanged})
+	if !result.Failed() {
+		t.Fatal("expected removal errors to fail the result")
+	}
+}
+
+func TestNotice(t *testing.T) {
+	notice := Notice(Request{Reason: "copyright <infringement>", Reference: "DMCA-42"}, []pin.RemovalResult{
+		{Preview: &pin.RemovalPreview{Upload: models.Upload{Hash: testHash, NetworkName: "public"}, Refund: 0.5}},
+	})
+	for _, want := range []string{"copyright &lt;infringement&gt;", "DMCA-42", testHash, "refunded 0.5 credits"} {
+		if !strings.Contains(notice, want) {
+			t.Fatalf("expected notice to contain %q: %s", want, notice)
+		}
+	}
+	// the blocklist does not stop the content from being pinned again
+	if strings.Contains(notice, "no longer be pinned") {
+		t.Fatalf("notice promises the content can not be pinned: %s", notice)
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Block{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Where("hash = ?", testHash).Delete(&Block{})
+	m := NewManager(db, nil)
+	if _, err := m.Block(Request{Hash: testHash}); err != ErrReasonRequired {
+		t.Fatalf("expected ErrReasonRequired, got %v", err)
+	}
+	if _, err := m.Block(Request{Hash: testHash, Reason: "dmca", Operator: "tester"}); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, err := m.IsBlocked(testHash); err != nil {
+		t.Fatal(err)
+	} else if !blocked {
+		t.Fatal("expected hash to be blocked")
+	}
+	if err := m.Unblock(testHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unblock(testHash); err != ErrNotBlocked {
+		t.Fatalf("expected ErrNotBlocked, got %v", err)
+	}
+	// blocking again re-uses the removed entry
+	block, err := m.Block(Request{Hash: testHash, Reason: "abuse", Reference: "ticket-1", Operator: "tester"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Reason != "abuse" || block.Reference != "ticket-1" {
+		t.Fatalf("unexpected block %+v", block)
+	}
+	blocks, err := m.Blocklist()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, b := range blocks {
+		found = found || b.Hash == testHash
+	}
+	if !found {
+		t.Fatal("expected hash to be on the blocklist")
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
@@ -0,0 +1,182 @@
+// Package tier provides account tier management, recording
+// a history of every manual tier change
+package tier
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+)
+
+// Tiers are the account tiers known to Temporal
+var Tiers = []models.DataUsageTier{
+	models.Unverified,
+	models.Free,
+	models.Paid,
+	models.Partner,
+	models.WhiteLabeled,
+}
+
+var (
+	// ErrNoChange is returned when changing a user to their current tier
+	ErrNoChange = errors.New("user is already in the requested tier")
+	// ErrUnverifiedTier is returned when changing a user to the unverified tier,
+	// which is only assigned by Temporal until the user verifies their email
+	ErrUnverifiedTier = errors.New("users can not be manually changed to the unverified tier")
+	// ErrOperatorRequired is returned when a tier change does not say who made it
+	ErrOperatorRequired = errors.New("operator is required to change a tier")
+	// ErrReasonRequired is returned when a tier change does not say why it was made
+	ErrReasonRequired = errors.New("reason is required to change a tier")
+)
+
+// Parse is used to validate a tier by name
+func Parse(name string) (models.DataUsageTier, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, tier := range Tiers {
+		if tier.String() == name {
+			return tier, nil
+		}
+	}
+	names := make([]string, len(Tiers))
+	for i, tier := range Tiers {
+		names[i] = tier.String()
+	}
+	return "", fmt.Errorf("invalid tier %q, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// ValidateTransition is used to check whether a user may be changed between tiers
+func ValidateTransition(from, to models.DataUsageTier) error {
+	if from == to {
+		return ErrNoChange
+	}
+	if to == models.Unverified {
+		return ErrUnverifiedTier
+	}
+	return nil
+}
+
+// Change is a record of a manual tier change
+type Change struct {
+	gorm.Model
+	UserName string               `gorm:"type:varchar(255);index"`
+	FromTier models.DataUsageTier `gorm:"type:varchar(255)"`
+	ToTier   models.DataUsageTier `gorm:"type:varchar(255)"`
+	Operator string               `gorm:"type:varchar(255)"`
+	Reason   string               `gorm:"type:text"`
+}
+
+// TableName sets the table used to store tier changes
+func (Change) TableName() string {
+	return "tier_changes"
+}
+
+// Manager is used to change account tiers
+type Manager struct {
+	db *gorm.DB
+	us *models.UsageManager
+}
+
+// NewManager instantiates the tier manager
+func NewManager(db *gorm.DB) *Manager {
+	return &Manager{db: db, us: models.NewUsageManager(db)}
+}
+
+// Show is used to retrieve the usage of a user, including their current tier
+func (m *Manager) Show(username string) (*models.Usage, error) {
+	return m.us.FindByUserName(username)
+}
+
+// Set is used to change the tier of a user, recording who made
+// the change and why. The change and its record are made in a
+// single transaction.
+func (m *Manager) Set(username string, tier models.DataUsageTier, operator, reason string) (*Change, error) {
+	if operator == "" {
+		return nil, ErrOperatorRequired
+	}
+	if reason == "" {
+		return nil, ErrReasonRequired
+	}
+	if _, err := Parse(tier.String()); err != nil {
+		return nil, err
+	}
+	tx := m.db.Begin()
+	change, err := set(tx, username, tier, operator, reason)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return change, tx.Commit().Error
+}
+
+// Request is a tier change to make
+type Request struct {
+	UserName string
+	Tier     models.DataUsageTier
+	Reason   string
+}
+
+// SetAll is used to make many tier changes in a single
+// transaction. If any change fails, none are made.
+func (m *Manager) SetAll(reqs []Request, operator string) ([]*Change, error) {
+	if operator == "" {
+		return nil, ErrOperatorRequired
+	}
+	for _, req := range reqs {
+		if req.Reason == "" {
+			return nil, ErrReasonRequired
+		}
+	}
+	tx := m.db.Begin()
+	changes := make([]*Change, 0, len(reqs))
+	for _, req := range reqs {
+		change, err := set(tx, req.UserName, req.Tier, operator, req.Reason)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("failed to change tier of %s: %s", req.UserName, err.Error())
+		}
+		changes = append(changes, change)
+	}
+	return changes, tx.Commit().Error
+}
+
+func set(tx *gorm.DB, username string, tier models.DataUsageTier, operator, reason string) (*Change, error) {
+	us := models.NewUsageManager(tx)
+	usg, err := us.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateTransition(usg.Tier, tier); err != nil {
+		return nil, err
+	}
+	if err := us.UpdateTier(username, tier); err != nil {
+		return nil, err
+	}
+	change := &Change{
+		UserName: username,
+		FromTier: usg.Tier,
+		ToTier:   tier,
+		Operator: operator,
+		Reason:   reason,
+	}
+	if err := tx.Create(change).Error; err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// History is used to retrieve the tier changes of a user, oldest
+// first. If username is empty, the changes of every user are returned
+func (m *Manager) History(username string) ([]Change, error) {
+	query := m.db.Order("id")
+	if username != "" {
+		query = query.Where("user_name = ?", username)
+	}
+	var changes []Change
+	if err := query.Find(&changes).Error; err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -0,0 +1,111 @@
+package tier
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    models.DataUsageTier
+		wantErr bool
+	}{
+		{"paid", models.Paid, false},
+		{" White-Labeled ", models.WhiteLabeled, false},
+		{"gold", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTransition(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to models.DataUsageTier
+		wantErr  error
+	}{
+		{"upgrade", models.Free, models.Paid, nil},
+		{"verify", models.Unverified, models.Free, nil},
+		{"no-op", models.Paid, models.Paid, ErrNoChange},
+		{"unverify", models.Free, models.Unverified, ErrUnverifiedTier},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateTransition(tt.from, tt.to); err != tt.wantErr {
+				t.Fatalf("ValidateTransition() err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestManager(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Change{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	manager := NewManager(db)
+	usg, err := manager.us.NewUsageEntry("testtieruser", models.Free)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usg)
+	defer db.Unscoped().Where("user_name = ?", "testtieruser").Delete(&Change{})
+	if _, err := manager.Set("testtieruser", models.Paid, "", "upgrade"); err != ErrOperatorRequired {
+		t.Fatal("expected operator to be required")
+	}
+	if _, err := manager.Set("testtieruser", models.Paid, "tester", ""); err != ErrReasonRequired {
+		t.Fatal("expected reason to be required")
+	}
+	if _, err := manager.Set("testtieruser", models.Free, "tester", "no-op"); err != ErrNoChange {
+		t.Fatal("expected no-op change to be refused")
+	}
+	change, err := manager.Set("testtieruser", models.Paid, "tester", "upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.FromTier != models.Free || change.ToTier != models.Paid {
+		t.Fatalf("bad change: %+v", change)
+	}
+	if usg, err := manager.Show("testtieruser"); err != nil {
+		t.Fatal(err)
+	} else if usg.Tier != models.Paid {
+		t.Fatal("tier was not changed")
+	}
+	history, err := manager.History("testtieruser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Operator != "tester" || history[0].Reason != "upgrade" {
+		t.Fatalf("bad history: %+v", history)
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
@@ -0,0 +1,154 @@
+// Package usage provides utilities to repair the data usage of accounts
+package usage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/pin"
+	"github.com/jinzhu/gorm"
+)
+
+// ErrUsageChanged is returned when applying a diff to usage
+// which has changed since the diff was calculated
+var ErrUsageChanged = errors.New("usage changed since it was calculated, please recalculate")
+
+// Diff is the difference between the recorded data
+// usage of a user, and the usage derived from their uploads
+type Diff struct {
+	UserName string
+	// Recorded is the data usage currently recorded for the user
+	Recorded uint64
+	// Computed is the total size of the user's uploads
+	Computed uint64
+	// Uploads is the number of uploads the user has
+	Uploads int
+	// FetchedSizes are the sizes of uploads, keyed by upload ID, which were
+	// not cached on the upload and were retrieved from the IPFS node of
+	// their network instead
+	FetchedSizes map[uint]int64
+}
+
+// Changed returns whether the recorded usage differs from the computed usage
+func (d *Diff) Changed() bool {
+	return d.Recorded != d.Computed
+}
+
+// Delta returns the signed change in bytes from recorded to computed usage
+func (d *Diff) Delta() string {
+	if d.Computed >= d.Recorded {
+		return fmt.Sprintf("+%v", d.Computed-d.Recorded)
+	}
+	return fmt.Sprintf("-%v", d.Recorded-d.Computed)
+}
+
+// Recalculator is used to re-derive data usage from uploads
+type Recalculator struct {
+	db   *gorm.DB
+	us   *models.UsageManager
+	up   *models.UploadManager
+	pins *pin.Util
+}
+
+// NewRecalculator instantiates the usage recalculator, which
+// uses the pin utilities to reach the node of each upload's network
+func NewRecalculator(db *gorm.DB, pins *pin.Util) *Recalculator {
+	return &Recalculator{
+		db:   db,
+		us:   models.NewUsageManager(db),
+		up:   models.NewUploadManager(db),
+		pins: pins,
+	}
+}
+
+// Calculate is used to derive the data usage of a user from their uploads.
+// The size cached on each upload is used, falling back to the cumulative
+// size reported by the node of their network for uploads without a cached size.
+func (r *Recalculator) Calculate(username string) (*Diff, error) {
+	usg, err := r.us.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := r.up.GetUploadsForUser(username)
+	if err != nil {
+		return nil, err
+	}
+	diff := &Diff{
+		UserName:     username,
+		Recorded:     usg.CurrentDataUsedBytes,
+		Uploads:      len(uploads),
+		FetchedSizes: make(map[uint]int64),
+	}
+	for _, upload := range uploads {
+		size := upload.Size
+		if size <= 0 {
+			fetched, err := r.pins.Size(upload.NetworkName, upload.Hash)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"failed to get object stats for hash %s on network %s: %s",
+					upload.Hash, upload.NetworkName, err.Error(),
+				)
+			}
+			size = fetched
+			diff.FetchedSizes[upload.ID] = size
+		}
+		diff.Computed += uint64(size)
+	}
+	return diff, nil
+}
+
+// CalculateAll is used to derive the data usage of every user with a usage entry
+func (r *Recalculator) CalculateAll() ([]*Diff, error) {
+	var usernames []string
+	if err := r.db.Model(&models.Usage{}).Order("user_name").Pluck("user_name", &usernames).Error; err != nil {
+		return nil, err
+	}
+	diffs := make([]*Diff, 0, len(usernames))
+	for _, username := range usernames {
+		diff, err := r.Calculate(username)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// Apply is used to set the data usage of users to their computed usage, and
+// cache any sizes retrieved from IPFS on their uploads, in a single transaction.
+// If any usage changed since it was calculated, nothing is applied and
+// ErrUsageChanged is returned.
+func (r *Recalculator) Apply(diffs []*Diff) error {
+	tx := r.db.Begin()
+	if err := apply(tx, diffs); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func apply(tx *gorm.DB, diffs []*Diff) error {
+	for _, diff := range diffs {
+		for id, size := range diff.FetchedSizes {
+			if err := tx.Model(&models.Upload{}).Where(
+				"id = ?", id,
+			).UpdateColumn("size", size).Error; err != nil {
+				return err
+			}
+		}
+		if !diff.Changed() {
+			continue
+		}
+		check := tx.Model(&models.Usage{}).Where(
+			"user_name = ? AND current_data_used_bytes = ?", diff.UserName, diff.Recorded,
+		).UpdateColumn("current_data_used_bytes", diff.Computed)
+		if check.Error != nil {
+			return check.Error
+		}
+		if check.RowsAffected == 0 {
+			return ErrUsageChanged
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package usage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/pin"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+const (
+	testCID = "QmS4ustL54uo8FzR9455qaxZwuMiUhyvMcX9Ba8nUH4uVv"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		diff        Diff
+		wantChanged bool
+		wantDelta   string
+	}{
+		{"unchanged", Diff{Recorded: 10, Computed: 10}, false, "+0"},
+		{"increase", Diff{Recorded: 10, Computed: 15}, true, "+5"},
+		{"decrease", Diff{Recorded: 15, Computed: 10}, true, "-5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.diff.Changed(); got != tt.wantChanged {
+				t.Errorf("Changed() = %v, want %v", got, tt.wantChanged)
+			}
+			if got := tt.diff.Delta(); got != tt.wantDelta {
+				t.Errorf("Delta() = %v, want %v", got, tt.wantDelta)
+			}
+		})
+	}
+}
+
+func TestRecalculate(t *testing.T) {
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins, err := pin.NewPinUtil(db, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recalc := NewRecalculator(db, pins)
+	usg, err := recalc.us.NewUsageEntry("testusagerecalc", models.Paid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usg)
+	if err := recalc.us.UpdateDataUsage("testusagerecalc", 1); err != nil {
+		t.Fatal(err)
+	}
+	// an upload without a cached size is sized using ipfs
+	upload, err := recalc.up.NewUpload(testCID, "file", models.UploadOptions{
+		Username: "testusagerecalc", NetworkName: "public", HoldTimeInMonths: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(upload)
+	size, err := pins.Size("public", testCID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := recalc.Calculate("testusagerecalc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Recorded != 1 || diff.Computed != uint64(size) {
+		t.Fatalf("bad diff: %+v", diff)
+	}
+	if diff.FetchedSizes[upload.ID] != size {
+		t.Fatal("expected upload size to be fetched from ipfs")
+	}
+	// applying a stale diff fails
+	stale := *diff
+	stale.Recorded = 2
+	if err := recalc.Apply([]*Diff{&stale}); err != ErrUsageChanged {
+		t.Fatal("expected usage changed error")
+	}
+	if err := recalc.Apply([]*Diff{diff}); err != nil {
+		t.Fatal(err)
+	}
+	if usg, err := recalc.us.FindByUserName("testusagerecalc"); err != nil {
+		t.Fatal(err)
+	} else if usg.CurrentDataUsedBytes != diff.Computed {
+		t.Fatal("usage was not updated")
+	}
+	if diff, err := recalc.Calculate("testusagerecalc"); err != nil {
+		t.Fatal(err)
+	} else if diff.Changed() || len(diff.FetchedSizes) != 0 {
+		t.Fatal("expected usage to be consistent with cached upload size")
+	}
+}
+
+func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
+	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
+		cfg.Database.Port, cfg.Database.Password)
+
+	return gorm.Open("postgres", dbConnURL)
+}
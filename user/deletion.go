@@ -0,0 +1,291 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/jinzhu/gorm"
+)
+
+var (
+	// ErrDeletionPending is returned when scheduling the deletion
+	// of a user whose deletion is already scheduled
+	ErrDeletionPending = errors.New("user deletion is already scheduled")
+	// ErrNoDeletionPending is returned when cancelling the deletion
+	// of a user whose deletion is not scheduled
+	ErrNoDeletionPending = errors.New("user deletion is not scheduled")
+	// ErrWindowClosed is returned when cancelling a deletion which is due
+	ErrWindowClosed = errors.New("cancellation window has closed, the deletion is due")
+	// ErrOperatorRequired is returned when a deletion or erasure does not say who made it
+	ErrOperatorRequired = errors.New("operator is required to schedule, cancel or erase a deletion")
+)
+
+// DeletionRequest is a deletion of a user scheduled for a later date, giving
+// the user a window in which the deletion can be cancelled. The account is
+// disabled while the deletion is pending.
+type DeletionRequest struct {
+	gorm.Model
+	// UserName is replaced by the randomly generated
+	// username of the deleted user once completed
+	UserName string `gorm:"type:varchar(255);index"`
+	Operator string `gorm:"type:varchar(255)"`
+	Reason   string `gorm:"type:text"`
+	// DueAt is when the deletion will be executed, and
+	// the cancellation window closes
+	DueAt time.Time
+	// AccountWasEnabled is whether the account was enabled before
+	// the deletion was scheduled, restored if it is cancelled
+	AccountWasEnabled bool
+	CancelledAt       *time.Time
+	CancelledBy       string `gorm:"type:varchar(255)"`
+	CompletedAt       *time.Time
+}
+
+// TableName sets the table used to store deletion requests
+func (DeletionRequest) TableName() string {
+	return "user_deletion_requests"
+}
+
+// Pending returns whether the deletion has been neither cancelled nor completed
+func (r *DeletionRequest) Pending() bool {
+	return r.CancelledAt == nil && r.CompletedAt == nil
+}
+
+// DeletionResult is the outcome of executing due deletions
+type DeletionResult struct {
+	Deleted int
+	// Completed are the IDs of the executed deletion requests, which
+	// identify a deletion without the username of the deleted user
+	Completed []uint
+	// Failures are the errors deleting each user
+	Failures map[string]error
+}
+
+// ParseWindow is used to parse a cancellation window, which is either
+// a number of days such as 30d, or a duration such as 720h
+func ParseWindow(window string) (time.Duration, error) {
+	var (
+		d   time.Duration
+		err error
+	)
+	if days := strings.TrimSuffix(window, "d"); days != window {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(window)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid window %q, must be a number of days such as 30d, or a duration", window)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid window %q, must be positive", window)
+	}
+	return d, nil
+}
+
+// ScheduleDeletion is used to schedule the deletion of a user after the
+// window has passed, disabling their account until the deletion is either
+// executed or cancelled
+func (u *User) ScheduleDeletion(username, reason, operator string, window time.Duration, now time.Time) (*DeletionRequest, error) {
+	if operator == "" {
+		return nil, ErrOperatorRequired
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid window %s, must be positive", window)
+	}
+	tx := u.um.DB.Begin()
+	req, err := scheduleDeletion(tx, username, reason, operator, now.Add(window))
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return req, tx.Commit().Error
+}
+
+// CancelDeletion is used to cancel the pending deletion of a user within
+// the cancellation window, restoring their account to its prior state
+func (u *User) CancelDeletion(username, operator string, now time.Time) (*DeletionRequest, error) {
+	if operator == "" {
+		return nil, ErrOperatorRequired
+	}
+	tx := u.um.DB.Begin()
+	req, err := cancelDeletion(tx, username, operator, now)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return req, tx.Commit().Error
+}
+
+// PendingDeletions returns the pending deletions, soonest due first
+func (u *User) PendingDeletions() ([]DeletionRequest, error) {
+	var reqs []DeletionRequest
+	if err := u.um.DB.Where(
+		"cancelled_at IS NULL AND completed_at IS NULL",
+	).Order("due_at").Find(&reqs).Error; err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// DueDeletions returns the pending deletions which are due
+func (u *User) DueDeletions(now time.Time) ([]DeletionRequest, error) {
+	var reqs []DeletionRequest
+	if err := u.um.DB.Where(
+		"cancelled_at IS NULL AND completed_at IS NULL AND due_at <= ?", now,
+	).Order("due_at").Find(&reqs).Error; err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// ExecuteDueDeletions is used to delete every user whose deletion is due.
+// Each user is deleted in its own transaction, so that a failed deletion
+// does not prevent the others.
+func (u *User) ExecuteDueDeletions(now time.Time) (*DeletionResult, error) {
+	reqs, err := u.DueDeletions(now)
+	if err != nil {
+		return nil, err
+	}
+	result := &DeletionResult{Failures: make(map[string]error)}
+	for _, req := range reqs {
+		if err := u.executeDeletion(req, now); err != nil {
+			result.Failures[req.UserName] = err
+			continue
+		}
+		result.Deleted++
+		result.Completed = append(result.Completed, req.ID)
+	}
+	return result, nil
+}
+
+// DeletionService is used to regularly execute due deletions until the context
+// is cancelled. If onDelete is set, it is called with the result of each run
+// which deleted a user, such as to audit the deletions
+func (u *User) DeletionService(ctx context.Context, frequency time.Duration, onDelete func(*DeletionResult)) (int, error) {
+	var (
+		ticker       = time.NewTicker(frequency)
+		totalDeleted = 0
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			result, err := u.ExecuteDueDeletions(time.Now().UTC())
+			if err != nil {
+				log.Println("failed to get due deletions: ", err.Error())
+				continue
+			}
+			for username, err := range result.Failures {
+				log.Printf("failed to delete %s: %s", username, err)
+			}
+			totalDeleted += result.Deleted
+			if onDelete != nil && result.Deleted > 0 {
+				onDelete(result)
+			}
+		case <-ctx.Done():
+			return totalDeleted, nil
+		}
+	}
+}
+
+func (u *User) executeDeletion(req DeletionRequest, now time.Time) error {
+	tx := u.um.DB.Begin()
+	newUsername, err := NewUserManager(tx).delete(req.UserName)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(&req).UpdateColumns(map[string]interface{}{
+		"user_name":    newUsername,
+		"completed_at": now,
+	}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func scheduleDeletion(tx *gorm.DB, username, reason, operator string, due time.Time) (*DeletionRequest, error) {
+	user := &models.User{}
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+		"user_name = ?", username,
+	).First(user).Error; err != nil {
+		return nil, err
+	}
+	if _, err := pendingDeletion(tx, username); err == nil {
+		return nil, ErrDeletionPending
+	} else if err != ErrNoDeletionPending {
+		return nil, err
+	}
+	if err := tx.Model(user).UpdateColumn("account_enabled", false).Error; err != nil {
+		return nil, err
+	}
+	req := &DeletionRequest{
+		UserName:          username,
+		Operator:          operator,
+		Reason:            reason,
+		DueAt:             due,
+		AccountWasEnabled: user.AccountEnabled,
+	}
+	if err := tx.Create(req).Error; err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func cancelDeletion(tx *gorm.DB, username, operator string, now time.Time) (*DeletionRequest, error) {
+	req, err := pendingDeletion(tx, username)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(req.DueAt) {
+		return nil, ErrWindowClosed
+	}
+	if err := tx.Model(&models.User{}).Where(
+		"user_name = ?", username,
+	).UpdateColumn("account_enabled", req.AccountWasEnabled).Error; err != nil {
+		return nil, err
+	}
+	req.CancelledAt = &now
+	req.CancelledBy = operator
+	if err := tx.Save(req).Error; err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// completeDeletion is used to complete a pending deletion request of a user
+// deleted without it, replacing the username as executing the request would
+func completeDeletion(tx *gorm.DB, username, newUsername string, now time.Time) error {
+	if !tx.HasTable(&DeletionRequest{}) {
+		return nil
+	}
+	return tx.Model(&DeletionRequest{}).Where(
+		"user_name = ? AND cancelled_at IS NULL AND completed_at IS NULL", username,
+	).UpdateColumns(map[string]interface{}{
+		"user_name":    newUsername,
+		"completed_at": now,
+	}).Error
+}
+
+func pendingDeletion(db *gorm.DB, username string) (*DeletionRequest, error) {
+	req := &DeletionRequest{}
+	err := db.Where(
+		"user_name = ? AND cancelled_at IS NULL AND completed_at IS NULL", username,
+	).Last(req).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrNoDeletionPending
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
@@ -0,0 +1,471 @@
+package user
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/audit"
+	"github.com/RTradeLtd/tutil/credits"
+	"github.com/RTradeLtd/tutil/mail"
+	"github.com/RTradeLtd/tutil/pin"
+	"github.com/RTradeLtd/tutil/suspension"
+	"github.com/RTradeLtd/tutil/tier"
+	"github.com/RTradeLtd/tutil/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrSigningKeyRequired is returned when signing or verifying
+	// an erasure certificate without a valid ed25519 key
+	ErrSigningKeyRequired = errors.New("ed25519 signing key is required for erasure certificates")
+	// ErrInvalidSignature is returned when an erasure certificate was
+	// not signed by the key, or was changed after it was signed
+	ErrInvalidSignature = errors.New("erasure certificate signature is invalid")
+)
+
+// Unpinner is used to remove content from the IPFS node of a network
+type Unpinner interface {
+	Unpin(ctx context.Context, network, hash string) error
+}
+
+// ErasureOptions configures a complete erasure of a user
+type ErasureOptions struct {
+	Operator string
+	Reason   string
+	// Unpinner removes content no other user references
+	Unpinner Unpinner
+	// Key signs the erasure certificate, and keys the hash of the subject
+	Key ed25519.PrivateKey
+}
+
+// ErasedContent is content which belonged to an erased user
+type ErasedContent struct {
+	Hash        string `json:"hash"`
+	NetworkName string `json:"network_name"`
+}
+
+// ErasureCertificate lists everything removed when erasing a user. The user
+// is identified only by the HMAC-SHA256 of their username, keyed by the signing
+// key, so the certificate holds no personal data, and can only be matched to a
+// user by the holder of the signing key. It is verified with the public key.
+type ErasureCertificate struct {
+	SubjectHMAC string `json:"subject_hmac_sha256"`
+	// ReplacementUserName is the randomly generated username
+	// which replaced the username of the user in retained records
+	ReplacementUserName string    `json:"replacement_user_name"`
+	Operator            string    `json:"operator"`
+	Reason              string    `json:"reason"`
+	ErasedAt            time.Time `json:"erased_at"`
+	// ClearedFields are the personal fields cleared from the user account
+	ClearedFields []string `json:"cleared_fields"`
+	// RevokedCredentials are the credentials which can no longer be used
+	RevokedCredentials []string `json:"revoked_credentials"`
+	// DeletedRecords are the number of records deleted from each table
+	DeletedRecords map[string]int `json:"deleted_records"`
+	// PseudonymizedRecords are the number of records retained in each
+	// table, such as for accounting, with the username replaced
+	PseudonymizedRecords map[string]int `json:"pseudonymized_records"`
+	// Unpinned is content no other user references, removed from its network
+	Unpinned []ErasedContent `json:"unpinned"`
+	// Retained is content which other users reference, left pinned
+	Retained []ErasedContent `json:"retained"`
+	// UnpinFailures is content which could not be unpinned, and must be
+	// unpinned manually, such as with pin orphans
+	UnpinFailures map[string]string `json:"unpin_failures"`
+	Signature     string            `json:"signature,omitempty"`
+}
+
+// payload returns the certificate without its signature, which is signed
+func (c *ErasureCertificate) payload() ([]byte, error) {
+	unsigned := *c
+	unsigned.Signature = ""
+	return json.Marshal(unsigned)
+}
+
+// Sign is used to sign the certificate with the ed25519 private key
+func (c *ErasureCertificate) Sign(key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return ErrSigningKeyRequired
+	}
+	payload, err := c.payload()
+	if err != nil {
+		return err
+	}
+	c.Signature = hex.EncodeToString(ed25519.Sign(key, payload))
+	return nil
+}
+
+// Verify is used to check that the certificate was signed with the private
+// key of the ed25519 public key, and has not been changed since
+func (c *ErasureCertificate) Verify(key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return ErrSigningKeyRequired
+	}
+	payload, err := c.payload()
+	if err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(key, payload, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// MatchesSubject returns whether the certificate is of the erasure of
+// username, which requires the private key the certificate was signed with
+func (c *ErasureCertificate) MatchesSubject(username string, key ed25519.PrivateKey) bool {
+	subject, err := hex.DecodeString(c.SubjectHMAC)
+	return err == nil && hmac.Equal(subject, subjectHMAC(username, key))
+}
+
+// subjectHMAC returns the HMAC-SHA256 identifying an erased user. The key
+// is derived from the signing key, so the certificate can only be matched
+// to a user by the holder of the signing key
+func subjectHMAC(username string, key ed25519.PrivateKey) []byte {
+	derived := sha256.Sum256(append([]byte("erasure subject:"), key.Seed()...))
+	mac := hmac.New(sha256.New, derived[:])
+	mac.Write([]byte(username))
+	return mac.Sum(nil)
+}
+
+// ParseErasureKey is used to parse a hex encoded ed25519 private key
+func ParseErasureKey(encoded string) (ed25519.PrivateKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid erasure key: %s", err)
+	}
+	// seeds are refused, as they can't be told apart from public keys
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, ErrSigningKeyRequired
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// ParseErasurePublicKey is used to parse a hex encoded ed25519 public key
+func ParseErasurePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid erasure public key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, ErrSigningKeyRequired
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// erasedFields are the personal fields of a user account cleared by erasure
+var erasedFields = []string{
+	"user_name",
+	"email_address",
+	"hashed_password",
+	"email_verification_token",
+	"customer_object_hash",
+	"organization",
+	"ipfs_key_names",
+	"ipfs_key_ids",
+	"ipfs_network_names",
+}
+
+// erasedTables are tables whose records of a user are deleted by erasure
+var erasedTables = []interface{}{
+	&models.Upload{},
+	&models.EncryptedUpload{},
+	&models.IPNS{},
+	&models.Record{},
+	&models.Zone{},
+	&pin.Webhook{},
+}
+
+// pseudonymizedTables are tables whose records of a user are retained
+// by erasure, with the username replaced
+var pseudonymizedTables = []interface{}{
+	&models.Usage{},
+	&models.Payments{},
+	&credits.Entry{},
+	&tier.Change{},
+	&suspension.Suspension{},
+	&pin.Extension{},
+	&DeletionRequest{},
+}
+
+// PreviewErasure is used to find the content erasing a user would unpin
+// and retain, without making any changes. The certificate is not signed,
+// and has no subject.
+func (u *User) PreviewErasure(username string) (*ErasureCertificate, error) {
+	usr, err := u.um.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	cert := newCertificate()
+	if cert.Unpinned, cert.Retained, err = erasedContent(u.um.DB, usr); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// Erase is used to completely erase a user for GDPR compliance. In addition
+// to Delete, every personal field of the account is cleared, credentials are
+// revoked, and the content of the user is removed, unpinning content which no
+// other user references. Records which must be retained have the username
+// replaced, including the targets, arguments, and before and after values of
+// the audit log, which is retained as a record of the changes made to the user.
+// A signed certificate of everything erased is returned.
+//
+// Database changes are made in a single transaction before any content is
+// unpinned, so content which fails to unpin is listed in the certificate
+// rather than aborting the erasure.
+func (u *User) Erase(ctx context.Context, username string, opts ErasureOptions) (*ErasureCertificate, error) {
+	if opts.Operator == "" {
+		return nil, ErrOperatorRequired
+	}
+	if len(opts.Key) != ed25519.PrivateKeySize {
+		return nil, ErrSigningKeyRequired
+	}
+	if opts.Unpinner == nil {
+		return nil, errors.New("unpinner is required to erase a user")
+	}
+	tx := u.um.DB.Begin()
+	cert, err := erase(tx, username, opts)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	unpinned := cert.Unpinned
+	cert.Unpinned = nil
+	for _, content := range unpinned {
+		if err := opts.Unpinner.Unpin(ctx, content.NetworkName, content.Hash); err != nil {
+			cert.UnpinFailures[content.NetworkName+"/"+content.Hash] = err.Error()
+			continue
+		}
+		cert.Unpinned = append(cert.Unpinned, content)
+	}
+	if err := cert.Sign(opts.Key); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// newCertificate returns an unsigned certificate without a subject. IPFS keys
+// are not listed as revoked, as they are not removed from the keystore, only
+// their names and IDs are cleared from the account
+func newCertificate() *ErasureCertificate {
+	return &ErasureCertificate{
+		ClearedFields:        erasedFields,
+		RevokedCredentials:   []string{"password", "email verification token", "api tokens"},
+		DeletedRecords:       make(map[string]int),
+		PseudonymizedRecords: make(map[string]int),
+		Unpinned:             []ErasedContent{},
+		Retained:             []ErasedContent{},
+		UnpinFailures:        make(map[string]string),
+	}
+}
+
+func erase(tx *gorm.DB, username string, opts ErasureOptions) (*ErasureCertificate, error) {
+	usr := &models.User{}
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+		"user_name = ?", username,
+	).First(usr).Error; err != nil {
+		return nil, err
+	}
+	cert := newCertificate()
+	cert.SubjectHMAC = hex.EncodeToString(subjectHMAC(usr.UserName, opts.Key))
+	cert.Operator = opts.Operator
+	cert.Reason = opts.Reason
+	cert.ErasedAt = time.Now().UTC()
+	var err error
+	if cert.Unpinned, cert.Retained, err = erasedContent(tx, usr); err != nil {
+		return nil, err
+	}
+	newUsername := utils.NewRandomString(200)
+	cert.ReplacementUserName = newUsername
+	for _, model := range erasedTables {
+		if !tx.HasTable(model) {
+			continue
+		}
+		check := tx.Unscoped().Where("user_name = ?", username).Delete(model)
+		if check.Error != nil {
+			return nil, check.Error
+		}
+		cert.DeletedRecords[tx.NewScope(model).TableName()] = int(check.RowsAffected)
+	}
+	// a pending deletion of the user is completed by the erasure
+	if tx.HasTable(&DeletionRequest{}) {
+		if err := tx.Model(&DeletionRequest{}).Where(
+			"user_name = ? AND cancelled_at IS NULL AND completed_at IS NULL", username,
+		).UpdateColumn("completed_at", cert.ErasedAt).Error; err != nil {
+			return nil, err
+		}
+	}
+	for _, model := range pseudonymizedTables {
+		if !tx.HasTable(model) {
+			continue
+		}
+		check := tx.Unscoped().Model(model).Where(
+			"user_name = ?", username,
+		).UpdateColumn("user_name", newUsername)
+		if check.Error != nil {
+			return nil, check.Error
+		}
+		cert.PseudonymizedRecords[tx.NewScope(model).TableName()] = int(check.RowsAffected)
+	}
+	// suppressions are of the email address rather than the username
+	if tx.HasTable(&mail.Suppression{}) {
+		deleted, err := mail.EraseSuppression(tx, usr.EmailAddress)
+		if err != nil {
+			return nil, err
+		}
+		cert.DeletedRecords[tx.NewScope(&mail.Suppression{}).TableName()] = deleted
+	}
+	newEmailAddress := newUsername + "@deleteduser.org"
+	if tx.HasTable(&audit.Entry{}) {
+		changed, err := audit.Pseudonymize(tx, map[string]string{
+			username:         newUsername,
+			usr.EmailAddress: newEmailAddress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		cert.PseudonymizedRecords[tx.NewScope(&audit.Entry{}).TableName()] = changed
+	}
+	// renaming the user also invalidates api tokens, which identify the user by name
+	if err := tx.Model(usr).UpdateColumns(map[string]interface{}{
+		"user_name":                newUsername,
+		"email_address":            newEmailAddress,
+		"account_enabled":          false,
+		"email_enabled":            false,
+		"admin_access":             false,
+		"hashed_password":          "",
+		"email_verification_token": "",
+		"customer_object_hash":     "",
+		"organization":             "",
+		"ipfs_key_names":           pq.StringArray{},
+		"ipfs_key_ids":             pq.StringArray{},
+		"ipfs_network_names":       pq.StringArray{},
+	}).Error; err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// erasedContent returns the content of a user which no other user
+// references, and the content which other users reference
+func erasedContent(db *gorm.DB, usr *models.User) (unpinned, retained []ErasedContent, err error) {
+	var owned []ErasedContent
+	if err := db.Model(&models.Upload{}).Select(
+		"DISTINCT hash, network_name",
+	).Where("user_name = ?", usr.UserName).Scan(&owned).Error; err != nil {
+		return nil, nil, err
+	}
+	if db.HasTable(&models.EncryptedUpload{}) {
+		var encrypted []ErasedContent
+		if err := db.Model(&models.EncryptedUpload{}).Select(
+			"DISTINCT ip_fs_hash AS hash, network_name",
+		).Where("user_name = ?", usr.UserName).Scan(&encrypted).Error; err != nil {
+			return nil, nil, err
+		}
+		owned = append(owned, encrypted...)
+	}
+	if usr.CustomerObjectHash != "" {
+		owned = append(owned, ErasedContent{Hash: usr.CustomerObjectHash, NetworkName: pin.PublicNetwork})
+	}
+	seen := make(map[ErasedContent]bool)
+	unpinned, retained = []ErasedContent{}, []ErasedContent{}
+	for _, content := range owned {
+		if content.NetworkName == "" {
+			content.NetworkName = pin.PublicNetwork
+		}
+		if seen[content] {
+			continue
+		}
+		seen[content] = true
+		shared, err := referencedByOthers(db, usr.UserName, content)
+		if err != nil {
+			return nil, nil, err
+		}
+		if shared {
+			retained = append(retained, content)
+		} else {
+			unpinned = append(unpinned, content)
+		}
+	}
+	sortContent(unpinned)
+	sortContent(retained)
+	return unpinned, retained, nil
+}
+
+// referencedByOthers returns whether any other user references content
+func referencedByOthers(db *gorm.DB, username string, content ErasedContent) (bool, error) {
+	if content.Hash == models.EmptyCustomerObjectHash {
+		return true, nil
+	}
+	networks := []string{content.NetworkName}
+	if content.NetworkName == pin.PublicNetwork {
+		networks = append(networks, "")
+	}
+	for _, query := range []struct {
+		model interface{}
+		where string
+		args  []interface{}
+	}{
+		{&models.Upload{}, "hash = ? AND network_name IN (?)", []interface{}{content.Hash, networks}},
+		{&models.EncryptedUpload{}, "ip_fs_hash = ? AND network_name IN (?)", []interface{}{content.Hash, networks}},
+		{&models.IPNS{}, "current_ip_fs_hash = ? AND network_name IN (?)", []interface{}{content.Hash, networks}},
+		{&models.User{}, "customer_object_hash = ?", []interface{}{content.Hash}},
+	} {
+		// tables of Temporal features which were never deployed reference nothing
+		if !db.HasTable(query.model) {
+			continue
+		}
+		var count int
+		if err := db.Model(query.model).Where(
+			"user_name != ?", username,
+		).Where(query.where, query.args...).Count(&count).Error; err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func sortContent(content []ErasedContent) {
+	sort.Slice(content, func(i, j int) bool {
+		if content[i].NetworkName != content[j].NetworkName {
+			return content[i].NetworkName < content[j].NetworkName
+		}
+		return content[i].Hash < content[j].Hash
+	})
+}
+
+// String returns a human readable summary of the certificate
+func (c *ErasureCertificate) String() string {
+	return fmt.Sprintf(
+		"subject hmac-sha256 %s\n%v pins to unpin, %v pins retained as other users reference them\n"+
+			"%v credentials revoked, %v unpin failures",
+		c.SubjectHMAC, len(c.Unpinned), len(c.Retained), len(c.RevokedCredentials), len(c.UnpinFailures),
+	)
+}
+
+// WriteJSON is used to write the certificate as indented json
+func (c *ErasureCertificate) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
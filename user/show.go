@@ -0,0 +1,227 @@
+package user
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/suspension"
+	"github.com/jinzhu/gorm"
+)
+
+// ErrLookupRequired is returned when looking up a user without a username or email
+var ErrLookupRequired = errors.New("username or email address is required to look up a user")
+
+// ProfileFormats are the formats a profile can be written in
+var ProfileFormats = []string{"text", "json"}
+
+// Profile is the account of a user, without secrets such as their
+// hashed password and email verification token
+type Profile struct {
+	UserName     string    `json:"user_name"`
+	EmailAddress string    `json:"email_address"`
+	CreatedAt    time.Time `json:"created_at"`
+	// AccountEnabled is whether the user can login
+	AccountEnabled bool `json:"account_enabled"`
+	// EmailEnabled is whether the user verified their email address
+	EmailEnabled       bool     `json:"email_enabled"`
+	AdminAccess        bool     `json:"admin_access"`
+	Free               bool     `json:"free"`
+	Organization       string   `json:"organization,omitempty"`
+	CustomerObjectHash string   `json:"customer_object_hash"`
+	IPFSKeyNames       []string `json:"ipfs_key_names"`
+	IPFSNetworkNames   []string `json:"ipfs_network_names"`
+	Credits            float64  `json:"credits"`
+	// Suspension is the active suspension of the account, if any
+	Suspension *suspension.Suspension `json:"suspension,omitempty"`
+
+	// Usage is nil for users without a usage entry
+	Usage *Usage `json:"usage"`
+
+	Uploads     int   `json:"uploads"`
+	UploadBytes int64 `json:"upload_bytes"`
+	// Expiring are the uploads which will be garbage
+	// collected soonest, ordered by garbage collection date
+	Expiring []ExpiringUpload `json:"expiring"`
+}
+
+// Usage is the tier and resource usage of a user
+type Usage struct {
+	Tier                  models.DataUsageTier `json:"tier"`
+	MonthlyDataLimitBytes uint64               `json:"monthly_data_limit_bytes"`
+	CurrentDataUsedBytes  uint64               `json:"current_data_used_bytes"`
+	IPNSRecordsPublished  int64                `json:"ipns_records_published"`
+	IPNSRecordsAllowed    int64                `json:"ipns_records_allowed"`
+	PubSubMessagesSent    int64                `json:"pubsub_messages_sent"`
+	PubSubMessagesAllowed int64                `json:"pubsub_messages_allowed"`
+	KeysCreated           int64                `json:"keys_created"`
+	KeysAllowed           int64                `json:"keys_allowed"`
+}
+
+// ExpiringUpload is an upload which will soon be garbage collected
+type ExpiringUpload struct {
+	Hash               string    `json:"hash"`
+	NetworkName        string    `json:"network_name"`
+	Size               int64     `json:"size"`
+	GarbageCollectDate time.Time `json:"garbage_collect_date"`
+}
+
+// Lookup is used to find a user by username, or by email address if
+// no username is given. Email addresses are matched case insensitively.
+func (u *User) Lookup(username, email string) (*models.User, error) {
+	switch {
+	case username != "":
+		return u.um.FindByUserName(username)
+	case email != "":
+		usr := &models.User{}
+		if err := u.um.DB.Where(
+			"lower(email_address) = ?", strings.ToLower(strings.TrimSpace(email)),
+		).First(usr).Error; err != nil {
+			return nil, err
+		}
+		return usr, nil
+	default:
+		return nil, ErrLookupRequired
+	}
+}
+
+// Show is used to build the profile of a user, including uploads
+// garbage collected within the given duration of now
+func (u *User) Show(usr *models.User, within time.Duration, now time.Time) (*Profile, error) {
+	profile := newProfile(usr)
+	usg, err := u.us.FindByUserName(usr.UserName)
+	switch err {
+	case nil:
+		profile.Usage = newUsage(usg)
+	case gorm.ErrRecordNotFound:
+	default:
+		return nil, err
+	}
+	var totals struct {
+		Count int
+		Bytes int64
+	}
+	if err := u.up.DB.Model(&models.Upload{}).Select(
+		"count(*) AS count, coalesce(sum(size), 0) AS bytes",
+	).Where("user_name = ?", usr.UserName).Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	profile.Uploads, profile.UploadBytes = totals.Count, totals.Bytes
+	switch s, err := suspension.NewManager(u.um.DB).Active(usr.UserName); err {
+	case nil:
+		profile.Suspension = s
+	case suspension.ErrNotSuspended:
+	default:
+		return nil, err
+	}
+	var expiring []models.Upload
+	if err := u.up.DB.Where(
+		"user_name = ? AND garbage_collect_date BETWEEN ? AND ?", usr.UserName, now, now.Add(within),
+	).Order("garbage_collect_date").Find(&expiring).Error; err != nil {
+		return nil, err
+	}
+	for _, upload := range expiring {
+		profile.Expiring = append(profile.Expiring, ExpiringUpload{
+			Hash:               upload.Hash,
+			NetworkName:        upload.NetworkName,
+			Size:               upload.Size,
+			GarbageCollectDate: upload.GarbageCollectDate,
+		})
+	}
+	return profile, nil
+}
+
+func newProfile(usr *models.User) *Profile {
+	return &Profile{
+		UserName:           usr.UserName,
+		EmailAddress:       usr.EmailAddress,
+		CreatedAt:          usr.CreatedAt,
+		AccountEnabled:     usr.AccountEnabled,
+		EmailEnabled:       usr.EmailEnabled,
+		AdminAccess:        usr.AdminAccess,
+		Free:               usr.Free,
+		Organization:       usr.Organization,
+		CustomerObjectHash: usr.CustomerObjectHash,
+		IPFSKeyNames:       append([]string{}, usr.IPFSKeyNames...),
+		IPFSNetworkNames:   append([]string{}, usr.IPFSNetworkNames...),
+		Credits:            usr.Credits,
+		Expiring:           []ExpiringUpload{},
+	}
+}
+
+func newUsage(usg *models.Usage) *Usage {
+	return &Usage{
+		Tier:                  usg.Tier,
+		MonthlyDataLimitBytes: usg.MonthlyDataLimitBytes,
+		CurrentDataUsedBytes:  usg.CurrentDataUsedBytes,
+		IPNSRecordsPublished:  usg.IPNSRecordsPublished,
+		IPNSRecordsAllowed:    usg.IPNSRecordsAllowed,
+		PubSubMessagesSent:    usg.PubSubMessagesSent,
+		PubSubMessagesAllowed: usg.PubSubMessagesAllowed,
+		KeysCreated:           usg.KeysCreated,
+		KeysAllowed:           usg.KeysAllowed,
+	}
+}
+
+// Write is used to write the profile in one of ProfileFormats
+func (p *Profile) Write(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		return p.WriteText(w)
+	case "json":
+		return p.WriteJSON(w)
+	default:
+		return fmt.Errorf("invalid format %q, must be one of %s", format, strings.Join(ProfileFormats, ", "))
+	}
+}
+
+// WriteText is used to write the profile as aligned text
+func (p *Profile) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "user\t%s\n", p.UserName)
+	fmt.Fprintf(tw, "email\t%s\n", p.EmailAddress)
+	fmt.Fprintf(tw, "created\t%s\n", p.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(tw, "account enabled\t%v\n", p.AccountEnabled)
+	fmt.Fprintf(tw, "email enabled\t%v\n", p.EmailEnabled)
+	if s := p.Suspension; s != nil {
+		fmt.Fprintf(tw, "suspended\t%s by %s, freeze gc %v: %s\n",
+			s.CreatedAt.Format(time.RFC3339), s.Operator, s.FreezeGC, s.Reason)
+	}
+	fmt.Fprintf(tw, "admin\t%v\n", p.AdminAccess)
+	fmt.Fprintf(tw, "free\t%v\n", p.Free)
+	if p.Organization != "" {
+		fmt.Fprintf(tw, "organization\t%s\n", p.Organization)
+	}
+	fmt.Fprintf(tw, "customer object\t%s\n", p.CustomerObjectHash)
+	fmt.Fprintf(tw, "ipfs keys\t%s\n", strings.Join(p.IPFSKeyNames, ", "))
+	fmt.Fprintf(tw, "ipfs networks\t%s\n", strings.Join(p.IPFSNetworkNames, ", "))
+	fmt.Fprintf(tw, "credits\t%v\n", p.Credits)
+	if p.Usage == nil {
+		fmt.Fprintln(tw, "usage\tnone")
+	} else {
+		fmt.Fprintf(tw, "tier\t%s\n", p.Usage.Tier)
+		fmt.Fprintf(tw, "data used\t%v of %v bytes\n", p.Usage.CurrentDataUsedBytes, p.Usage.MonthlyDataLimitBytes)
+		fmt.Fprintf(tw, "ipns records\t%v of %v\n", p.Usage.IPNSRecordsPublished, p.Usage.IPNSRecordsAllowed)
+		fmt.Fprintf(tw, "pubsub messages\t%v of %v\n", p.Usage.PubSubMessagesSent, p.Usage.PubSubMessagesAllowed)
+		fmt.Fprintf(tw, "keys\t%v of %v\n", p.Usage.KeysCreated, p.Usage.KeysAllowed)
+	}
+	fmt.Fprintf(tw, "uploads\t%v totalling %v bytes\n", p.Uploads, p.UploadBytes)
+	fmt.Fprintf(tw, "expiring\t%v\n", len(p.Expiring))
+	for _, upload := range p.Expiring {
+		fmt.Fprintf(tw, "\t%s\t%s\t%s\t%v bytes\n",
+			upload.GarbageCollectDate.Format(time.RFC3339), upload.Hash, upload.NetworkName, upload.Size)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON is used to write the profile as indented json
+func (p *Profile) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
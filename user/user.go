@@ -1,6 +1,8 @@
 package user
 
 import (
+	"time"
+
 	"github.com/RTradeLtd/database/v2/models"
 	"github.com/RTradeLtd/tutil/utils"
 	"github.com/jinzhu/gorm"
@@ -24,12 +26,29 @@ func NewUserManager(db *gorm.DB) *User {
 
 // Deletes a use and cleans out all their data
 // replacing with a generic account. helps maintain
-// compliance with GDPR
+// compliance with GDPR. A pending deletion request
+// of the user is completed by the deletion
 func (u *User) Delete(username string) error {
-	usr, err := u.um.FindByUserName(username)
+	tx := u.um.DB.Begin()
+	newUsername, err := NewUserManager(tx).delete(username)
 	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := completeDeletion(tx, username, newUsername, time.Now().UTC()); err != nil {
+		tx.Rollback()
 		return err
 	}
+	return tx.Commit().Error
+}
+
+// delete is used to delete a user, returning the
+// randomly generated username which replaced theirs
+func (u *User) delete(username string) (string, error) {
+	usr, err := u.um.FindByUserName(username)
+	if err != nil {
+		return "", err
+	}
 	// get a randomly generated username to indicate user is disabled
 	// we set a random username, overwrite the email, and disable ability to login
 	newUsername := utils.NewRandomString(200)
@@ -38,27 +57,27 @@ func (u *User) Delete(username string) error {
 	usr.AccountEnabled = false
 	usr.EmailEnabled = false
 	if err := u.um.DB.Save(usr).Error; err != nil {
-		return err
+		return "", err
 	}
 	usage, err := u.us.FindByUserName(username)
 	if err != nil {
-		return err
+		return "", err
 	}
 	usage.UserName = newUsername
 	if err := u.us.DB.Save(usage).Error; err != nil {
-		return err
+		return "", err
 	}
 	uploads, err := u.GetUploads(username)
 	if err != nil {
-		return err
+		return "", err
 	}
 	for _, upload := range uploads {
 		upload.UserName = newUsername
 		if err := u.up.DB.Save(upload).Error; err != nil {
-			return err
+			return "", err
 		}
 	}
-	return nil
+	return newUsername, nil
 }
 
 // GetUploads returns uploads for au ser
@@ -1,11 +1,22 @@
 package user
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/RTradeLtd/config"
 	"github.com/RTradeLtd/database/v2/models"
+	"github.com/RTradeLtd/tutil/audit"
+	"github.com/RTradeLtd/tutil/mail"
+	"github.com/RTradeLtd/tutil/suspension"
 	"github.com/jinzhu/gorm"
 )
 
@@ -92,10 +103,29 @@ func TestUserDelete(t *testing.T) {
 	} else {
 		defer db.Unscoped().Delete(up)
 	}
+	if err := db.AutoMigrate(&DeletionRequest{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	req, err := manager.ScheduleDeletion(username1, "user request", "tester", time.Hour, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(req)
 	// END TEST DATA GENERATION
 	if err := manager.Delete(username1); err != nil {
 		t.Fatal(err)
 	}
+	// the pending deletion request is completed by the deletion
+	if _, err := pendingDeletion(db, username1); err != ErrNoDeletionPending {
+		t.Fatalf("expected ErrNoDeletionPending, got %v", err)
+	}
+	completed := DeletionRequest{}
+	if err := db.First(&completed, req.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if completed.Pending() || completed.UserName == username1 {
+		t.Fatalf("expected completed request to not reference the deleted user: %+v", completed)
+	}
 	uploads, _ := manager.GetUploads(username1)
 	if len(uploads) != 0 {
 		t.Fatal("failed to delete uplaods")
@@ -106,6 +136,461 @@ func TestUserDelete(t *testing.T) {
 	}
 }
 
+func TestProfile(t *testing.T) {
+	profile := newProfile(&models.User{
+		UserName:               "testprofile",
+		EmailAddress:           "testprofile@example.org",
+		HashedPassword:         "hashedpassword",
+		EmailVerificationToken: "verificationtoken",
+		Credits:                10,
+	})
+	profile.Usage = newUsage(&models.Usage{Tier: models.Paid, CurrentDataUsedBytes: 100})
+	var buf bytes.Buffer
+	for _, format := range ProfileFormats {
+		if err := profile.Write(&buf, format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := buf.String()
+	for _, secret := range []string{"hashedpassword", "verificationtoken"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("expected profile to not contain %s", secret)
+		}
+	}
+	for _, want := range []string{"testprofile@example.org", "paid", `"credits": 10`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected profile to contain %s: %s", want, out)
+		}
+	}
+	if err := profile.Write(&buf, "xml"); err == nil {
+		t.Fatal("expected invalid format to be refused")
+	}
+	if _, err := (&User{}).Lookup("", ""); err != ErrLookupRequired {
+		t.Fatalf("expected ErrLookupRequired, got %v", err)
+	}
+}
+
+func TestUserShow(t *testing.T) {
+	username := "testusershow"
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&suspension.Suspension{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	manager := NewUserManager(db)
+	usr, err := manager.um.NewUserAccount(username, "password123", username+"@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(usr)
+	defer db.Unscoped().Where("user_name = ?", username).Delete(&models.Usage{})
+	for _, hold := range []int64{1, 10} {
+		up, err := manager.up.NewUpload(fmt.Sprintf("testhashshow%v", hold), "file", models.UploadOptions{
+			Username:         username,
+			NetworkName:      "public",
+			HoldTimeInMonths: hold,
+			Size:             100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Delete(up)
+	}
+	found, err := manager.Lookup("", strings.ToUpper(username)+"@EXAMPLE.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := manager.Show(found, 60*24*time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.UserName != username || profile.Usage == nil {
+		t.Fatalf("unexpected profile %+v", profile)
+	}
+	if profile.Uploads != 2 || profile.UploadBytes != 200 {
+		t.Fatalf("expected 2 uploads of 200 bytes, got %v of %v bytes", profile.Uploads, profile.UploadBytes)
+	}
+	if len(profile.Expiring) != 1 || profile.Expiring[0].Hash != "testhashshow1" {
+		t.Fatalf("expected only the 1 month upload to be expiring, got %+v", profile.Expiring)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		window  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30d", 30 * 24 * time.Hour, false},
+		{"1d", 24 * time.Hour, false},
+		{"36h", 36 * time.Hour, false},
+		{"0d", 0, true},
+		{"-1d", 0, true},
+		{"d", 0, true},
+		{"month", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			got, err := ParseWindow(tt.window)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseWindow() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseWindow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduledDeletion(t *testing.T) {
+	var (
+		username1 = "testscheduledelete"
+		username2 = "testschedulecancel"
+	)
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&DeletionRequest{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	manager := NewUserManager(db)
+	var requests []*DeletionRequest
+	defer func() {
+		for _, req := range requests {
+			db.Unscoped().Where("user_name = ?", req.UserName).Delete(&models.User{})
+			db.Unscoped().Where("user_name = ?", req.UserName).Delete(&models.Usage{})
+			db.Unscoped().Delete(req)
+		}
+	}()
+	now := time.Now().UTC()
+	for _, username := range []string{username1, username2} {
+		if _, err := manager.um.NewUserAccount(username, "password123", username+"@example.org"); err != nil {
+			t.Fatal(err)
+		}
+		req, err := manager.ScheduleDeletion(username, "user request", "tester", 30*24*time.Hour, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, req)
+		if usr, err := manager.um.FindByUserName(username); err != nil {
+			t.Fatal(err)
+		} else if usr.AccountEnabled {
+			t.Fatal("expected account to be disabled while the deletion is pending")
+		}
+	}
+	if _, err := manager.ScheduleDeletion(username1, "user request", "tester", time.Hour, now); err != ErrDeletionPending {
+		t.Fatalf("expected ErrDeletionPending, got %v", err)
+	}
+	// suspended accounts scheduled for deletion are not reactivated
+	if err := db.AutoMigrate(&suspension.Suspension{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Where("user_name = ?", username1).Delete(&suspension.Suspension{})
+	if err := db.Create(&suspension.Suspension{UserName: username1, Reason: "chargeback", Operator: "tester"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := suspension.NewManager(db).Reactivate(username1, "resolved", "tester", now); err != suspension.ErrDeletionPending {
+		t.Fatalf("expected suspension.ErrDeletionPending, got %v", err)
+	}
+	if _, err := manager.CancelDeletion(username2, "tester", now.AddDate(0, 0, 31)); err != ErrWindowClosed {
+		t.Fatalf("expected ErrWindowClosed, got %v", err)
+	}
+	if _, err := manager.CancelDeletion(username2, "tester", now.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if usr, err := manager.um.FindByUserName(username2); err != nil {
+		t.Fatal(err)
+	} else if !usr.AccountEnabled {
+		t.Fatal("expected account to be enabled once the deletion is cancelled")
+	}
+	if result, err := manager.ExecuteDueDeletions(now.AddDate(0, 0, 1)); err != nil {
+		t.Fatal(err)
+	} else if result.Deleted != 0 {
+		t.Fatal("expected no deletions to be due")
+	}
+	result, err := manager.ExecuteDueDeletions(now.AddDate(0, 0, 31))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted != 1 || len(result.Failures) != 0 {
+		t.Fatalf("expected 1 deletion, got %+v", result)
+	}
+	if len(result.Completed) != 1 || result.Completed[0] != requests[0].ID {
+		t.Fatalf("expected deletion request %v to be completed, got %v", requests[0].ID, result.Completed)
+	}
+	if _, err := manager.um.FindByUserName(username1); err == nil {
+		t.Fatal("expected user to be deleted")
+	}
+	completed := DeletionRequest{}
+	if err := db.First(&completed, requests[0].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if completed.Pending() || completed.UserName == username1 {
+		t.Fatalf("expected completed request to not reference the deleted user: %+v", completed)
+	}
+	requests[0] = &completed
+}
+
+type fakeUnpinner struct {
+	unpinned []string
+	fail     string
+}
+
+func (f *fakeUnpinner) Unpin(ctx context.Context, network, hash string) error {
+	if hash == f.fail {
+		return errors.New("node unavailable")
+	}
+	f.unpinned = append(f.unpinned, hash)
+	return nil
+}
+
+func TestErasureCertificate(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newCertificate()
+	cert.SubjectHMAC = hex.EncodeToString(subjectHMAC("testuser", key))
+	cert.Unpinned = []ErasedContent{{Hash: "testhash1", NetworkName: "public"}}
+	if err := cert.Sign(nil); err != ErrSigningKeyRequired {
+		t.Fatalf("expected ErrSigningKeyRequired, got %v", err)
+	}
+	if err := cert.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	// only the public key is needed to verify the certificate
+	if err := cert.Verify(pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Verify(otherPub); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature with another key, got %v", err)
+	}
+	if !cert.MatchesSubject("testuser", key) || cert.MatchesSubject("testuser", otherKey) || cert.MatchesSubject("otheruser", key) {
+		t.Fatal("expected the subject to only match the username with the signing key")
+	}
+	if hex.EncodeToString(subjectHMAC("testuser", key)) == hex.EncodeToString(subjectHMAC("testuser", otherKey)) {
+		t.Fatal("expected the subject to depend on the key")
+	}
+	var buf bytes.Buffer
+	if err := cert.WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "\"testuser\"") {
+		t.Fatalf("expected certificate to not contain the username: %s", buf.String())
+	}
+	if strings.Contains(buf.String(), "ipfs key") {
+		t.Fatalf("expected ipfs keys, which are not deleted, to not be listed as revoked: %s", buf.String())
+	}
+	cert.Retained = append(cert.Retained, ErasedContent{Hash: "testhash2", NetworkName: "public"})
+	if err := cert.Verify(pub); err != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature once changed, got %v", err)
+	}
+	if parsed, err := ParseErasureKey(hex.EncodeToString(key) + "\n"); err != nil {
+		t.Fatal(err)
+	} else if !parsed.Equal(key) {
+		t.Fatal("parsed a different erasure key")
+	}
+	if parsed, err := ParseErasurePublicKey(hex.EncodeToString(pub)); err != nil {
+		t.Fatal(err)
+	} else if !parsed.Equal(pub) {
+		t.Fatal("parsed a different erasure public key")
+	}
+	if _, err := ParseErasureKey(hex.EncodeToString(pub)); err != ErrSigningKeyRequired {
+		t.Fatalf("expected a public key to be refused as a private key, got %v", err)
+	}
+	if _, err := ParseErasurePublicKey("not hex"); err == nil {
+		t.Fatal("expected invalid public key to be refused")
+	}
+}
+
+func TestUserErase(t *testing.T) {
+	var (
+		username1 = "testusererase"
+		username2 = "testusernoerase"
+	)
+	cfg, err := config.LoadConfig("../testenv/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := openDatabaseConnection(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDBMigration(t, db)
+	manager := NewUserManager(db)
+	for _, username := range []string{username1, username2} {
+		usr, err := manager.um.NewUserAccount(username, "password123", username+"@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Where("id = ?", usr.ID).Delete(&models.User{})
+		usg, err := manager.us.FindByUserName(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Where("id = ?", usg.ID).Delete(&models.Usage{})
+	}
+	// testerasehash1 is shared with another user, so must not be unpinned
+	for _, upload := range []struct{ username, hash string }{
+		{username1, "testerasehash1"},
+		{username1, "testerasehash2"},
+		{username1, "testerasehash3"},
+		{username2, "testerasehash1"},
+	} {
+		up, err := manager.up.NewUpload(upload.hash, "file", models.UploadOptions{
+			Username:         upload.username,
+			NetworkName:      "public",
+			HoldTimeInMonths: 10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Delete(up)
+	}
+	// testerasehash4 is encrypted and published over ipns by another user,
+	// testerasehash5 is only encrypted by the erased user
+	if err := db.AutoMigrate(&models.EncryptedUpload{}, &models.IPNS{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []interface{}{
+		&models.EncryptedUpload{UserName: username1, NetworkName: "public", IPFSHash: "testerasehash4"},
+		&models.EncryptedUpload{UserName: username1, NetworkName: "public", IPFSHash: "testerasehash5"},
+		&models.IPNS{UserName: username1, NetworkName: "public", IPNSHash: "testeraseipns1", CurrentIPFSHash: "testerasehash5"},
+		&models.IPNS{UserName: username2, NetworkName: "public", IPNSHash: "testeraseipns2", CurrentIPFSHash: "testerasehash4"},
+	} {
+		if err := db.Create(record).Error; err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Delete(record)
+	}
+	// the suppression of the email address, and the audit log of the username
+	if err := db.AutoMigrate(&mail.Suppression{}, &audit.Entry{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&mail.Suppression{EmailAddress: username1 + "@example.org", Reason: mail.ReasonUnsubscribe}).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Where("email_address = ?", username1+"@example.org").Delete(&mail.Suppression{})
+	auditor, err := audit.New(db, "tester", "user suspend", []string{"user", "suspend", "--user=" + username1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := auditor.Record(username1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Where("operator = ? AND command = ?", "tester", "user suspend").Delete(&audit.Entry{})
+	// a pending deletion is completed by the erasure
+	if err := db.AutoMigrate(&DeletionRequest{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	req, err := manager.ScheduleDeletion(username1, "user request", "tester", time.Hour, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(req)
+	unpinner := &fakeUnpinner{fail: "testerasehash3"}
+	opts := ErasureOptions{Operator: "tester", Reason: "user request", Unpinner: unpinner}
+	if _, err := manager.Erase(context.Background(), username1, opts); err != ErrSigningKeyRequired {
+		t.Fatalf("expected ErrSigningKeyRequired, got %v", err)
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Key = key
+	preview, err := manager.PreviewErasure(username1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Unpinned) != 3 || len(preview.Retained) != 2 {
+		t.Fatalf("unexpected erasure preview %+v", preview)
+	}
+	cert, err := manager.Erase(context.Background(), username1, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Verify(pub); err != nil {
+		t.Fatal(err)
+	}
+	if !cert.MatchesSubject(username1, key) {
+		t.Fatal("expected the certificate subject to match the erased user")
+	}
+	if len(cert.Unpinned) != 2 || cert.Unpinned[0].Hash != "testerasehash2" || cert.Unpinned[1].Hash != "testerasehash5" {
+		t.Fatalf("expected testerasehash2 and testerasehash5 to be unpinned, got %+v", cert.Unpinned)
+	}
+	if len(cert.Retained) != 2 || cert.Retained[0].Hash != "testerasehash1" || cert.Retained[1].Hash != "testerasehash4" {
+		t.Fatalf("expected testerasehash1 and testerasehash4 to be retained, got %+v", cert.Retained)
+	}
+	if _, ok := cert.UnpinFailures["public/testerasehash3"]; !ok {
+		t.Fatalf("expected testerasehash3 to fail to unpin, got %+v", cert.UnpinFailures)
+	}
+	if cert.DeletedRecords["uploads"] != 3 || cert.DeletedRecords["encrypted_uploads"] != 2 || cert.DeletedRecords["ipns"] != 1 {
+		t.Fatalf("expected the uploads, encrypted uploads and ipns records to be deleted, got %+v", cert.DeletedRecords)
+	}
+	if _, err := manager.um.FindByUserName(username1); err == nil {
+		t.Fatal("expected user to be erased")
+	}
+	usr, err := manager.um.FindByUserName(cert.ReplacementUserName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.HashedPassword != "" || usr.AccountEnabled || usr.CustomerObjectHash != "" || len(usr.IPFSKeyIDs) != 0 {
+		t.Fatalf("expected personal fields to be cleared: %+v", usr)
+	}
+	if _, err := manager.us.FindByUserName(cert.ReplacementUserName); err != nil {
+		t.Fatal("expected usage to be retained with the replacement username")
+	}
+	var count int
+	if err := db.Unscoped().Model(&models.Upload{}).Where(
+		"user_name IN (?)", []string{username1, cert.ReplacementUserName},
+	).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected uploads to be deleted, found %v", count)
+	}
+	if uploads, _ := manager.GetUploads(username2); len(uploads) != 1 {
+		t.Fatal("expected uploads of other users to be kept")
+	}
+	completed := DeletionRequest{}
+	if err := db.First(&completed, req.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if completed.Pending() || completed.UserName != cert.ReplacementUserName {
+		t.Fatalf("expected the pending deletion to be completed: %+v", completed)
+	}
+	if cert.DeletedRecords["suppressions"] != 1 {
+		t.Fatalf("expected the suppression of the email address to be deleted, got %+v", cert.DeletedRecords)
+	}
+	if entries, err := audit.List(db, audit.Filter{Target: username1}); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatalf("expected the audit log to be pseudonymized, got %+v", entries)
+	}
+	entries, err := audit.List(db, audit.Filter{Target: cert.ReplacementUserName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || strings.Contains(entries[0].Arguments, username1) {
+		t.Fatalf("expected the audit log to be pseudonymized, got %+v", entries)
+	}
+}
+
 func openDatabaseConnection(cfg *config.TemporalConfig) (*gorm.DB, error) {
 	dbConnURL := fmt.Sprintf("host=127.0.0.1 port=%s user=postgres dbname=temporal password=%s sslmode=disable",
 		cfg.Database.Port, cfg.Database.Password)